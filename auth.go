@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+var errInvalidToken = errors.New("invalid token")
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// tokenClaims is the signed payload of both access and refresh tokens.
+type tokenClaims struct {
+	UserID    int    `json:"sub"`
+	Type      string `json:"typ"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// randomSecret returns a fresh signing key, used when no -token-secret is configured.
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func signToken(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseToken verifies the signature and expiry of a token and checks it is of the wanted type.
+func parseToken(token, wantType string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, errInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(parts[0]))
+	if subtle.ConstantTimeCompare(sig, mac.Sum(nil)) != 1 {
+		return claims, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errInvalidToken
+	}
+	if claims.Type != wantType || time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
+
+func issueTokens(userID int) (TokenResponse, error) {
+	now := time.Now()
+	access, err := signToken(tokenClaims{UserID: userID, Type: accessTokenType, ExpiresAt: now.Add(accessTokenTTL).Unix()})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	refresh, err := signToken(tokenClaims{UserID: userID, Type: refreshTokenType, ExpiresAt: now.Add(refreshTokenTTL).Unix()})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// dummyHash is compared against when a login names no account, so that
+// unknown usernames take as long to reject as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("micro-discover"), bcrypt.DefaultCost)
+
+func login(w http.ResponseWriter, r *http.Request) {
+	var creds Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var userID int
+	var hashedPassword string
+	err := db.QueryRow("SELECT id, password FROM users WHERE username = ?", creds.Username).Scan(&userID, &hashedPassword)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(creds.Password))
+	} else {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(creds.Password))
+	}
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	tokens, err := issueTokens(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to issue token")
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	claims, err := parseToken(body.RefreshToken, refreshTokenType)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	// The user may have been deleted since the refresh token was issued
+	if _, err := lookupUser(claims.UserID); err != nil {
+		writeError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+
+	tokens, err := issueTokens(claims.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to issue token")
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func lookupUser(id int) (User, error) {
+	var user User
+	err := db.QueryRow("SELECT id, username FROM users WHERE id = ?", id).Scan(&user.ID, &user.Username)
+	return user, err
+}
+
+// authMiddleware rejects requests without a valid bearer access token and
+// stores the authenticated User in the request context.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if header == "" || token == header {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="micro-discover"`)
+			writeError(w, http.StatusUnauthorized, "Missing bearer token")
+			return
+		}
+
+		claims, err := parseToken(token, accessTokenType)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="micro-discover", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "Invalid or expired token")
+			return
+		}
+
+		user, err := lookupUser(claims.UserID)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="micro-discover", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "Invalid or expired token")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+	})
+}
+
+func withUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// currentUser returns the authenticated caller stored by authMiddleware.
+func currentUser(r *http.Request) (User, bool) {
+	user, ok := r.Context().Value(userContextKey).(User)
+	return user, ok
+}
+
+// openSignup lets anyone create an account with POST /users, at most
+// signupLimit per client address per signupWindow. Otherwise only operators
+// create accounts. The first operator signs up for their own account without
+// a token to bootstrap the service; the accounts of further operators are
+// only ever created by an operator, even with openSignup.
+var openSignup bool
+
+const (
+	signupLimit  = 5
+	signupWindow = time.Hour
+)
+
+// signups counts the accounts each client address created in the current
+// window.
+var signups = struct {
+	sync.Mutex
+	start  time.Time
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// allowSignup records a signup from client and reports whether it is within
+// signupLimit.
+func allowSignup(client string, now time.Time) bool {
+	signups.Lock()
+	defer signups.Unlock()
+	if now.Sub(signups.start) >= signupWindow {
+		signups.start = now
+		signups.counts = make(map[string]int)
+	}
+	if signups.counts[client] >= signupLimit {
+		return false
+	}
+	signups.counts[client]++
+	return true
+}
+
+// signupGate decides who may call the signup handler next, as described at
+// openSignup.
+func signupGate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var creds Credentials
+		json.Unmarshal(body, &creds)
+
+		switch {
+		case operators[creds.Username] && !hasOperatorAccount():
+			// Bootstrap: the first operator signs up for themselves
+			next(w, r)
+		case operators[creds.Username] || !openSignup:
+			authMiddleware(requireOperator(next)).ServeHTTP(w, r)
+		default:
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			if !allowSignup(client, time.Now()) {
+				w.Header().Set("Retry-After", "3600")
+				writeError(w, http.StatusTooManyRequests, "Too many signups, try again later")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func createTestUser(t *testing.T, username, password string) User {
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	result, err := db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", username, string(hashedPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return User{ID: int(id), Username: username}
+}
+
+// asUser attaches an authenticated caller to req, as authMiddleware would.
+func asUser(req *http.Request, user User) *http.Request {
+	return req.WithContext(withUser(req.Context(), user))
+}
+
+// sendAs serves a request from user through router and fails the test unless
+// it gets status want. A string body is sent as is and any other body as
+// JSON; header lists names and values to set on the request.
+func sendAs(t *testing.T, router http.Handler, user User, method, path string, body interface{}, want int, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var requestBody []byte
+	switch body := body.(type) {
+	case nil:
+	case string:
+		requestBody = []byte(body)
+	default:
+		requestBody, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, path, bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, user))
+	if status := rr.Code; status != want {
+		t.Fatalf("%s %s: handler returned wrong status code: got %v want %v: %s", method, path, status, want, rr.Body.String())
+	}
+	return rr
+}
+
+// setOperators lists usernames in -operators and binds their existing
+// accounts; defer setOperators(t) to reset them.
+func setOperators(t *testing.T, usernames ...string) {
+	t.Helper()
+	operators = make(map[string]bool)
+	for _, username := range usernames {
+		operators[username] = true
+	}
+	if err := loadOperators(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "login@example.com", "secret")
+
+	requestBody := []byte(`{"username":"login@example.com","password":"secret"}`)
+	req, err := http.NewRequest("POST", "/login", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/login", login).Methods("POST")
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var response TokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := parseToken(response.AccessToken, accessTokenType)
+	if err != nil {
+		t.Fatalf("access token did not verify: %v", err)
+	}
+	if claims.UserID != user.ID {
+		t.Errorf("access token has wrong subject: got %v want %v", claims.UserID, user.ID)
+	}
+	if _, err := parseToken(response.RefreshToken, refreshTokenType); err != nil {
+		t.Errorf("refresh token did not verify: %v", err)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	clearDatabase()
+	createTestUser(t, "login@example.com", "secret")
+
+	requestBody := []byte(`{"username":"login@example.com","password":"wrong"}`)
+	req, err := http.NewRequest("POST", "/login", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/login", login).Methods("POST")
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "refresh@example.com", "secret")
+	tokens, err := issueTokens(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/token/refresh", refreshToken).Methods("POST")
+
+	// An access token must not be accepted as a refresh token
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{tokens.RefreshToken, http.StatusOK},
+		{tokens.AccessToken, http.StatusUnauthorized},
+	} {
+		requestBody, _ := json.Marshal(map[string]string{"refresh_token": tc.token})
+		req, err := http.NewRequest("POST", "/token/refresh", bytes.NewBuffer(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tc.want {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, tc.want)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "auth@example.com", "secret")
+	tokens, err := issueTokens(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := signToken(tokenClaims{UserID: user.ID, Type: accessTokenType, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen User
+	router := mux.NewRouter()
+	router.Use(authMiddleware)
+	router.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = currentUser(r)
+	}).Methods("GET")
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"malformed", "Basic abc", http.StatusUnauthorized},
+		{"expired", "Bearer " + expired, http.StatusUnauthorized},
+		{"refresh token", "Bearer " + tokens.RefreshToken, http.StatusUnauthorized},
+		{"tampered", "Bearer " + tokens.AccessToken + "x", http.StatusUnauthorized},
+		{"valid", "Bearer " + tokens.AccessToken, http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", "/whoami", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.want)
+		}
+	}
+
+	if seen.ID != user.ID || seen.Username != user.Username {
+		t.Errorf("middleware stored wrong user in context: got %v want %v", seen, user)
+	}
+}
+
+func TestSignupGate(t *testing.T) {
+	clearDatabase()
+	setOperators(t, "operator@example.com", "second@example.com")
+	defer setOperators(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users", signupGate(createUser)).Methods("POST")
+
+	signup := func(username, token string, want int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/users", bytes.NewBufferString(`{"username":"`+username+`","password":"secret"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Fatalf("signup of %s: handler returned wrong status code: got %v want %v: %s", username, rr.Code, want, rr.Body.String())
+		}
+	}
+
+	// The first operator signs up for themselves, and then creates the other
+	// accounts, including those of further operators
+	signup("stranger@example.com", "", http.StatusUnauthorized)
+	signup("operator@example.com", "", http.StatusCreated)
+	signup("second@example.com", "", http.StatusUnauthorized)
+	var operatorID int
+	db.QueryRow("SELECT id FROM users WHERE username = 'operator@example.com'").Scan(&operatorID)
+	tokens, _ := issueTokens(operatorID)
+	signup("member@example.com", tokens.AccessToken, http.StatusCreated)
+	signup("second@example.com", tokens.AccessToken, http.StatusCreated)
+	var memberID, secondID int
+	db.QueryRow("SELECT id FROM users WHERE username = 'member@example.com'").Scan(&memberID)
+	db.QueryRow("SELECT id FROM users WHERE username = 'second@example.com'").Scan(&secondID)
+	if !isOperator(User{ID: secondID}) {
+		t.Errorf("account created for an operator is not an operator")
+	}
+	memberTokens, _ := issueTokens(memberID)
+	signup("friend@example.com", memberTokens.AccessToken, http.StatusForbidden)
+
+	// Open signup is limited per client address
+	signups.Lock()
+	signups.start = time.Time{}
+	signups.Unlock()
+	openSignup = true
+	defer func() { openSignup = false }()
+	for i := 0; i < signupLimit; i++ {
+		signup("open"+strconv.Itoa(i)+"@example.com", "", http.StatusCreated)
+	}
+	signup("onetoomany@example.com", "", http.StatusTooManyRequests)
+	// Open signup does not create operator accounts
+	db.Exec("DELETE FROM users WHERE id = ?", secondID)
+	signup("second@example.com", "", http.StatusUnauthorized)
+	if !allowSignup("192.0.2.2", time.Now()) {
+		t.Errorf("signups from one address limited another")
+	}
+	if !allowSignup("192.0.2.1", time.Now().Add(signupWindow)) {
+		t.Errorf("signups were still limited in the next window")
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Workspace roles
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// App roles
+const (
+	RoleDeveloper = "developer"
+	RoleUser      = "user"
+)
+
+var errForbidden = errors.New("forbidden")
+
+// roleRank orders roles within their scope so the strongest grant wins.
+var roleRank = map[string]int{
+	RoleMember:    1,
+	RoleAdmin:     2,
+	RoleUser:      1,
+	RoleDeveloper: 2,
+}
+
+func validWorkspaceRole(role string) bool {
+	return role == RoleAdmin || role == RoleMember
+}
+
+func validAppRole(role string) bool {
+	return role == RoleDeveloper || role == RoleUser
+}
+
+func strongerRole(a, b string) string {
+	if roleRank[b] > roleRank[a] {
+		return b
+	}
+	return a
+}
+
+// workspaceRoleOf returns the effective role of a user in a workspace, or ""
+// if they have none. The owner of a workspace is always an admin. It returns
+// sql.ErrNoRows if the workspace does not exist.
+func workspaceRoleOf(userID, workspaceID int) (string, error) {
+	var ownerID sql.NullInt64
+	if err := db.QueryRow("SELECT user_id FROM workspaces WHERE id = ?", workspaceID).Scan(&ownerID); err != nil {
+		return "", err
+	}
+	if ownerID.Valid && int(ownerID.Int64) == userID {
+		return RoleAdmin, nil
+	}
+
+	rows, err := db.Query("SELECT role FROM workspace_roles WHERE user_id = ? AND workspace_id = ?", userID, workspaceID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	effective := ""
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return "", err
+		}
+		effective = strongerRole(effective, role)
+	}
+	return effective, rows.Err()
+}
+
+// appRoleOf returns the effective role of a user on an app, or "" if they
+// have none. Workspace admins are developers of every app in the workspace
+// and workspace members are users of them; an app without a workspace only
+// has its own roles. It returns sql.ErrNoRows if the app does not exist.
+func appRoleOf(userID, appID int) (string, error) {
+	var workspaceID int
+	if err := db.QueryRow("SELECT COALESCE(workspace_id, 0) FROM apps WHERE id = ?", appID).Scan(&workspaceID); err != nil {
+		return "", err
+	}
+
+	effective := ""
+	workspaceRole := ""
+	if workspaceID != 0 {
+		var err error
+		if workspaceRole, err = workspaceRoleOf(userID, workspaceID); err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+	switch workspaceRole {
+	case RoleAdmin:
+		effective = RoleDeveloper
+	case RoleMember:
+		effective = RoleUser
+	}
+
+	rows, err := db.Query("SELECT role FROM app_roles WHERE user_id = ? AND app_id = ?", userID, appID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return "", err
+		}
+		effective = strongerRole(effective, role)
+	}
+	return effective, rows.Err()
+}
+
+// allows reports whether role grants at least one of the allowed roles. A
+// stronger role in the same scope implies the weaker ones.
+func allows(role string, allowed []string) bool {
+	for _, a := range allowed {
+		if role == a || (role != "" && roleRank[role] > roleRank[a]) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeWorkspace checks that the caller holds one of roles in the workspace.
+func authorizeWorkspace(r *http.Request, workspaceID int, roles ...string) error {
+	user, ok := currentUser(r)
+	if !ok {
+		return errInvalidToken
+	}
+	role, err := workspaceRoleOf(user.ID, workspaceID)
+	if err != nil {
+		return err
+	}
+	if !allows(role, roles) {
+		return errForbidden
+	}
+	return nil
+}
+
+// authorizeApp checks that the caller holds one of roles on the app.
+func authorizeApp(r *http.Request, appID int, roles ...string) error {
+	user, ok := currentUser(r)
+	if !ok {
+		return errInvalidToken
+	}
+	role, err := appRoleOf(user.ID, appID)
+	if err != nil {
+		return err
+	}
+	if !allows(role, roles) {
+		return errForbidden
+	}
+	return nil
+}
+
+func writeAuthzError(w http.ResponseWriter, err error) {
+	switch err {
+	case errInvalidToken:
+		writeError(w, http.StatusUnauthorized, "Authentication required")
+	case errForbidden:
+		writeError(w, http.StatusForbidden, "Forbidden")
+	case sql.ErrNoRows:
+		writeError(w, http.StatusNotFound, "Not found")
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// requireUser returns the caller, writing a 401 if the request is anonymous.
+func requireUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	user, ok := currentUser(r)
+	if !ok {
+		writeAuthzError(w, errInvalidToken)
+	}
+	return user, ok
+}
+
+// idLookup maps the {id} route variable to the workspace or app it is scoped to.
+type idLookup func(id int) (int, error)
+
+func sameID(id int) (int, error) {
+	return id, nil
+}
+
+func workspaceOfWorkspaceRole(id int) (int, error) {
+	var workspaceID int
+	err := db.QueryRow("SELECT COALESCE(workspace_id, 0) FROM workspace_roles WHERE id = ?", id).Scan(&workspaceID)
+	return workspaceID, err
+}
+
+func appOfAppRole(id int) (int, error) {
+	var appID int
+	err := db.QueryRow("SELECT COALESCE(app_id, 0) FROM app_roles WHERE id = ?", id).Scan(&appID)
+	return appID, err
+}
+
+func routeID(r *http.Request, lookup idLookup) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, sql.ErrNoRows
+	}
+	return lookup(id)
+}
+
+// requireWorkspaceRole only calls next if the caller holds one of roles in the
+// workspace that the route's {id} resolves to.
+func requireWorkspaceRole(next http.HandlerFunc, lookup idLookup, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workspaceID, err := routeID(r, lookup)
+		if err == nil {
+			err = authorizeWorkspace(r, workspaceID, roles...)
+		}
+		if err != nil {
+			writeAuthzError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireSubdomainRole only calls next if the caller holds one of roles in the
+// workspace with the route's {subdomain}.
+func requireSubdomainRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var workspaceID int
+		err := db.QueryRow("SELECT id FROM workspaces WHERE subdomain = ?", mux.Vars(r)["subdomain"]).Scan(&workspaceID)
+		if err == nil {
+			err = authorizeWorkspace(r, workspaceID, roles...)
+		}
+		if err != nil {
+			writeAuthzError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAppRole only calls next if the caller holds one of roles on the app
+// that the route's {id} resolves to.
+func requireAppRole(next http.HandlerFunc, lookup idLookup, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appID, err := routeID(r, lookup)
+		if err == nil {
+			err = authorizeApp(r, appID, roles...)
+		}
+		if err != nil {
+			writeAuthzError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireSelf only calls next if the route's {id} is the caller's own user ID.
+func requireSelf(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		if mux.Vars(r)["id"] != strconv.Itoa(user.ID) {
+			writeAuthzError(w, errForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireExistingUser only calls next if the route's {id} is a user, so
+// listing a missing user's resources is a 404 rather than an empty list.
+func requireExistingUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if err := db.QueryRow("SELECT id FROM users WHERE id = ?", mux.Vars(r)["id"]).Scan(&id); err != nil {
+			writeAuthzError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// operatorAccounts holds the IDs of the accounts of the -operators
+// usernames. Operator rights follow these IDs, bound when the service starts
+// or when an operator's account is created, rather than the caller's current
+// username.
+var operatorAccounts = struct {
+	sync.RWMutex
+	ids map[int]bool
+}{ids: make(map[int]bool)}
+
+// loadOperators binds the existing accounts of the -operators usernames.
+func loadOperators() error {
+	operatorAccounts.Lock()
+	defer operatorAccounts.Unlock()
+	operatorAccounts.ids = make(map[int]bool)
+	if len(operators) == 0 {
+		return nil
+	}
+	var args []interface{}
+	for username := range operators {
+		args = append(args, username)
+	}
+	rows, err := db.Query("SELECT id FROM users WHERE username IN (?"+strings.Repeat(", ?", len(args)-1)+")", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		operatorAccounts.ids[id] = true
+	}
+	return rows.Err()
+}
+
+// bindOperator makes the new account id an operator if username is listed
+// in -operators.
+func bindOperator(id int, username string) {
+	if !operators[username] {
+		return
+	}
+	operatorAccounts.Lock()
+	operatorAccounts.ids[id] = true
+	operatorAccounts.Unlock()
+}
+
+// unbindOperator forgets the deleted account id.
+func unbindOperator(id int) {
+	operatorAccounts.Lock()
+	delete(operatorAccounts.ids, id)
+	operatorAccounts.Unlock()
+}
+
+// isOperator reports whether user's account is bound as an operator.
+func isOperator(user User) bool {
+	operatorAccounts.RLock()
+	defer operatorAccounts.RUnlock()
+	return operatorAccounts.ids[user.ID]
+}
+
+// hasOperatorAccount reports whether any operator has an account yet.
+func hasOperatorAccount() bool {
+	operatorAccounts.RLock()
+	defer operatorAccounts.RUnlock()
+	return len(operatorAccounts.ids) > 0
+}
+
+// renameAllowed reports whether an account may be renamed from one username
+// to another. Taking or giving up an -operators username would move operator
+// rights at the next start, so only other renames are allowed.
+func renameAllowed(from, to string) bool {
+	return from == to || (!operators[from] && !operators[to])
+}
+
+// requireOperator only calls next if the caller's account is an operator's.
+func requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		if !isOperator(user) {
+			writeAuthzError(w, errForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// visibleWorkspaces is a subquery selecting the IDs of every workspace the
+// user owns or holds a role in.
+func visibleWorkspaces(user User) (string, []interface{}) {
+	return "SELECT id FROM workspaces WHERE user_id = ? UNION SELECT workspace_id FROM workspace_roles WHERE user_id = ?",
+		[]interface{}{user.ID, user.ID}
+}
+
+// visibleApps is a subquery selecting the IDs of every app the user can see,
+// either through its workspace or through a direct app role.
+func visibleApps(user User) (string, []interface{}) {
+	workspaces, args := visibleWorkspaces(user)
+	return "SELECT id FROM apps WHERE workspace_id IN (" + workspaces + ") UNION SELECT app_id FROM app_roles WHERE user_id = ?",
+		append(args, user.ID)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequireWorkspaceRole(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	member := createTestUser(t, "member@example.com", "secret")
+	stranger := createTestUser(t, "stranger@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", owner.ID, "testsubdomain", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaceID, _ := result.LastInsertId()
+	_, err = db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", member.ID, RoleMember, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/workspaces/{id:[0-9]+}", requireWorkspaceRole(getWorkspace, sameID, RoleMember)).Methods("GET")
+	router.HandleFunc("/workspaces/{id:[0-9]+}", requireWorkspaceRole(updateWorkspace, sameID, RoleAdmin)).Methods("PUT")
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		user   User
+		want   int
+	}{
+		{"owner reads", "GET", owner, http.StatusOK},
+		{"member reads", "GET", member, http.StatusOK},
+		{"stranger reads", "GET", stranger, http.StatusForbidden},
+		{"member updates", "PUT", member, http.StatusForbidden},
+		{"owner updates", "PUT", owner, http.StatusOK},
+	} {
+		requestBody, _ := json.Marshal(Workspace{Name: "Renamed", UserID: owner.ID})
+		req, err := http.NewRequest(tc.method, fmt.Sprintf("/workspaces/%d", workspaceID), bytes.NewBuffer(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, tc.user))
+
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.want)
+		}
+	}
+
+	// A workspace that does not exist is reported as such
+	req, err := http.NewRequest("GET", "/workspaces/999999", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestWorkspaceOwnership(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	admin := createTestUser(t, "admin@example.com", "secret")
+	operator := createTestUser(t, "operator@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "owned1")
+	_, err := db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", admin.ID, RoleAdmin, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setOperators(t, operator.Username)
+	defer setOperators(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/workspaces/{id:[0-9]+}", updateWorkspace).Methods("PUT")
+
+	for _, tc := range []struct {
+		name      string
+		user      User
+		body      string
+		want      int
+		wantOwner int
+	}{
+		{"admin renames without user_id", admin, `{"name":"Renamed"}`, http.StatusOK, owner.ID},
+		{"admin takes ownership", admin, fmt.Sprintf(`{"name":"Renamed","user_id":%d}`, admin.ID), http.StatusForbidden, owner.ID},
+		{"owner hands over", owner, fmt.Sprintf(`{"name":"Renamed","user_id":%d}`, admin.ID), http.StatusOK, admin.ID},
+		{"operator hands back", operator, fmt.Sprintf(`{"name":"Renamed","user_id":%d}`, owner.ID), http.StatusOK, owner.ID},
+	} {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("/workspaces/%d", workspaceID), bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, tc.user))
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.want)
+		}
+		var userID int
+		db.QueryRow("SELECT user_id FROM workspaces WHERE id = ?", workspaceID).Scan(&userID)
+		if userID != tc.wantOwner {
+			t.Errorf("%s: workspace is owned by %d, want %d", tc.name, userID, tc.wantOwner)
+		}
+	}
+}
+
+func TestOperatorRenames(t *testing.T) {
+	clearDatabase()
+	operator := createTestUser(t, "operator@example.com", "secret")
+	user := createTestUser(t, "user@example.com", "secret")
+	setOperators(t, operator.Username, "unclaimed@example.com")
+	defer setOperators(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id:[0-9]+}", requireSelf(updateUser)).Methods("PUT")
+	router.HandleFunc("/users/{id:[0-9]+}", requireSelf(patchUser)).Methods("PATCH")
+	userPath := fmt.Sprintf("/users/%d", user.ID)
+	operatorPath := fmt.Sprintf("/users/%d", operator.ID)
+
+	// Renaming into an operator's username does not make an operator
+	sendAs(t, router, user, "PUT", userPath, `{"username":"unclaimed@example.com"}`, http.StatusForbidden)
+	sendAs(t, router, user, "PATCH", userPath, `{"username":"operator@example.com"}`, http.StatusForbidden)
+	// Nor can an operator give their username up
+	sendAs(t, router, operator, "PATCH", operatorPath, `{"username":"former@example.com"}`, http.StatusForbidden)
+	sendAs(t, router, user, "PATCH", userPath, `{"username":"renamed@example.com"}`, http.StatusOK)
+	if isOperator(user) || !isOperator(operator) {
+		t.Errorf("renames changed who is an operator")
+	}
+}
+
+func TestRequireAppRole(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	member := createTestUser(t, "member@example.com", "secret")
+	developer := createTestUser(t, "developer@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", owner.ID, "testsubdomain", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaceID, _ := result.LastInsertId()
+	result, err = db.Exec("INSERT INTO apps (name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema) VALUES (?, '', '', ?, '', '', ?, '', '')", "TestApp", "10.0.0.1:8080", workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appID, _ := result.LastInsertId()
+	_, err = db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", member.ID, RoleMember, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO app_roles (user_id, role, app_id) VALUES (?, ?, ?)", developer.ID, RoleDeveloper, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(getApp, sameID, RoleUser)).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(deleteApp, sameID, RoleDeveloper)).Methods("DELETE")
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		user   User
+		want   int
+	}{
+		{"member reads", "GET", member, http.StatusOK},
+		{"developer reads", "GET", developer, http.StatusOK},
+		{"member deletes", "DELETE", member, http.StatusForbidden},
+		{"developer deletes", "DELETE", developer, http.StatusNoContent},
+	} {
+		req, err := http.NewRequest(tc.method, fmt.Sprintf("/apps/%d", appID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, tc.user))
+
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.want)
+		}
+	}
+}
+
+func TestGetAppsOnlyReturnsVisibleApps(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	other := createTestUser(t, "other@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "Mine", owner.ID, "mine", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, _ := result.LastInsertId()
+	result, err = db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "Theirs", other.ID, "theirs", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, _ := result.LastInsertId()
+	for _, ws := range []int64{mine, theirs, theirs} {
+		if _, err := db.Exec("INSERT INTO apps (name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema) VALUES (?, '', '', ?, '', '', ?, '', '')", "app", "10.0.0.1:8080", ws); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A direct app role makes a single app in a foreign workspace visible
+	_, err = db.Exec("INSERT INTO app_roles (user_id, role, app_id) SELECT ?, ?, MAX(id) FROM apps", owner.ID, RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/apps", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", getApps).Methods("GET")
+	router.ServeHTTP(rr, asUser(req, owner))
+
+	var response []App
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 2 {
+		t.Errorf("handler returned unexpected number of apps: got %v want %v", len(response), 2)
+	}
+}
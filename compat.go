@@ -0,0 +1,449 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Compatibility levels of a schema change, from least to most disruptive
+const (
+	// CompatCompatible means the schemas accept and produce the same values
+	CompatCompatible = "compatible"
+	// CompatBackward means existing clients keep working, e.g. because an
+	// optional input or an extra output field was added
+	CompatBackward = "backward-compatible"
+	// CompatBreaking means existing clients may fail, e.g. because an input
+	// became required or an output field changed type
+	CompatBreaking = "breaking"
+)
+
+// Schema policies of a workspace
+const (
+	SchemaPolicyAllow          = "allow"
+	SchemaPolicyRejectBreaking = "reject-breaking"
+)
+
+func validSchemaPolicy(policy string) bool {
+	return policy == SchemaPolicyAllow || policy == SchemaPolicyRejectBreaking
+}
+
+// SchemaChange is one difference between the schemas of two app versions.
+type SchemaChange struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	Level   string `json:"level"`
+}
+
+// Compatibility classifies the schemas of an app against the version it
+// replaces.
+type Compatibility struct {
+	Level           string         `json:"level"`
+	PreviousID      int            `json:"previous_id"`
+	PreviousVersion string         `json:"previous_version"`
+	Changes         []SchemaChange `json:"changes"`
+}
+
+// Keywords that narrow the values a schema accepts when raised or lowered
+var (
+	lowerBounds = []string{"minimum", "exclusiveMinimum", "minLength", "minItems", "minProperties"}
+	upperBounds = []string{"maximum", "exclusiveMaximum", "maxLength", "maxItems", "maxProperties"}
+)
+
+// schemaDiff collects the changes between two schemas. An input schema
+// describes what an app accepts, so narrowing it breaks clients; an output
+// schema describes what it produces, so widening it does.
+type schemaDiff struct {
+	input   bool
+	changes []SchemaChange
+}
+
+// narrowed records a change that makes a schema accept fewer values.
+func (d *schemaDiff) narrowed(path, format string, args ...interface{}) {
+	level := CompatBackward
+	if d.input {
+		level = CompatBreaking
+	}
+	d.changes = append(d.changes, SchemaChange{Path: path, Message: fmt.Sprintf(format, args...), Level: level})
+}
+
+// widened records a change that makes a schema accept more values.
+func (d *schemaDiff) widened(path, format string, args ...interface{}) {
+	level := CompatBreaking
+	if d.input {
+		level = CompatBackward
+	}
+	d.changes = append(d.changes, SchemaChange{Path: path, Message: fmt.Sprintf(format, args...), Level: level})
+}
+
+// changed records a change that cannot be classified, which is assumed to
+// break clients.
+func (d *schemaDiff) changed(path, format string, args ...interface{}) {
+	d.changes = append(d.changes, SchemaChange{Path: path, Message: fmt.Sprintf(format, args...), Level: CompatBreaking})
+}
+
+// schemaObject turns a parsed schema into its keywords, treating true as the
+// empty schema and false as a schema that accepts nothing.
+func schemaObject(schema interface{}) map[string]interface{} {
+	switch s := schema.(type) {
+	case map[string]interface{}:
+		return s
+	case bool:
+		if !s {
+			return map[string]interface{}{"not": map[string]interface{}{}}
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// typeSet returns the types a schema allows, or nil if it allows any.
+func typeSet(s map[string]interface{}) []string {
+	switch t := s["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, name := range t {
+			types = append(types, name.(string))
+		}
+		return types
+	}
+	return nil
+}
+
+// coversTypes reports whether every type in b is allowed by a. A nil set
+// allows every type.
+func coversTypes(a, b []string) bool {
+	if a == nil {
+		return true
+	}
+	if b == nil {
+		return false
+	}
+	for _, t := range b {
+		found := false
+		for _, u := range a {
+			if t == u || (t == "integer" && u == "number") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// allowedValues returns the values enum or const restricts a schema to, or
+// nil if it is not restricted.
+func allowedValues(s map[string]interface{}) []interface{} {
+	if c, ok := s["const"]; ok {
+		return []interface{}{c}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		return enum
+	}
+	return nil
+}
+
+// coversValues reports whether every value in b is in a. A nil list allows
+// every value.
+func coversValues(a, b []interface{}) bool {
+	if a == nil {
+		return true
+	}
+	if b == nil {
+		return false
+	}
+	for _, v := range b {
+		found := false
+		for _, u := range a {
+			if reflect.DeepEqual(u, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func requiredSet(s map[string]interface{}) map[string]bool {
+	required := make(map[string]bool)
+	if names, ok := s["required"].([]interface{}); ok {
+		for _, name := range names {
+			required[name.(string)] = true
+		}
+	}
+	return required
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// compare records the changes between two parsed schemas at path.
+func (d *schemaDiff) compare(oldSchema, newSchema interface{}, path string) {
+	before, after := schemaObject(oldSchema), schemaObject(newSchema)
+
+	oldTypes, newTypes := typeSet(before), typeSet(after)
+	switch wider, narrower := coversTypes(newTypes, oldTypes), coversTypes(oldTypes, newTypes); {
+	case wider && narrower:
+	case wider:
+		d.widened(pointer(path, "type"), "type widened from %s to %s", describeTypes(oldTypes), describeTypes(newTypes))
+	case narrower:
+		d.narrowed(pointer(path, "type"), "type narrowed from %s to %s", describeTypes(oldTypes), describeTypes(newTypes))
+	default:
+		d.changed(pointer(path, "type"), "type changed from %s to %s", describeTypes(oldTypes), describeTypes(newTypes))
+	}
+
+	oldValues, newValues := allowedValues(before), allowedValues(after)
+	switch wider, narrower := coversValues(newValues, oldValues), coversValues(oldValues, newValues); {
+	case wider && narrower:
+	case wider:
+		d.widened(pointer(path, "enum"), "allowed values were added")
+	case narrower:
+		d.narrowed(pointer(path, "enum"), "allowed values were removed")
+	default:
+		d.changed(pointer(path, "enum"), "allowed values were changed")
+	}
+
+	for _, keyword := range lowerBounds {
+		d.compareBound(before, after, path, keyword, 1)
+	}
+	for _, keyword := range upperBounds {
+		d.compareBound(before, after, path, keyword, -1)
+	}
+
+	// Keywords that can only be compared for equality
+	for _, keyword := range []string{"pattern", "format", "multipleOf", "allOf", "anyOf", "oneOf", "not", "patternProperties"} {
+		o, hadOld := before[keyword]
+		n, hasNew := after[keyword]
+		switch {
+		case hadOld && hasNew && !reflect.DeepEqual(o, n):
+			d.changed(pointer(path, keyword), "%s changed", keyword)
+		case hasNew && !hadOld:
+			d.narrowed(pointer(path, keyword), "%s added", keyword)
+		case hadOld && !hasNew:
+			d.widened(pointer(path, keyword), "%s removed", keyword)
+		}
+	}
+
+	if before["uniqueItems"] != true && after["uniqueItems"] == true {
+		d.narrowed(pointer(path, "uniqueItems"), "items must now be unique")
+	} else if before["uniqueItems"] == true && after["uniqueItems"] != true {
+		d.widened(pointer(path, "uniqueItems"), "items no longer have to be unique")
+	}
+
+	d.compareProperties(before, after, path)
+
+	if o, n := before["items"], after["items"]; o != nil || n != nil {
+		d.compare(orTrue(o), orTrue(n), pointer(path, "items"))
+	}
+}
+
+func orTrue(schema interface{}) interface{} {
+	if schema == nil {
+		return true
+	}
+	return schema
+}
+
+func describeTypes(types []string) string {
+	if types == nil {
+		return "any"
+	}
+	return strings.Join(types, "|")
+}
+
+// compareBound records a change of a numeric bound; sign is 1 for lower
+// bounds, where a larger value narrows the schema, and -1 for upper bounds.
+func (d *schemaDiff) compareBound(before, after map[string]interface{}, path, keyword string, sign float64) {
+	o, hadOld := before[keyword].(float64)
+	n, hasNew := after[keyword].(float64)
+	switch {
+	case hadOld && hasNew && o != n:
+		if (n-o)*sign > 0 {
+			d.narrowed(pointer(path, keyword), "%s changed from %v to %v", keyword, o, n)
+		} else {
+			d.widened(pointer(path, keyword), "%s changed from %v to %v", keyword, o, n)
+		}
+	case hasNew && !hadOld:
+		d.narrowed(pointer(path, keyword), "%s of %v added", keyword, n)
+	case hadOld && !hasNew:
+		d.widened(pointer(path, keyword), "%s of %v removed", keyword, o)
+	}
+}
+
+func (d *schemaDiff) compareProperties(before, after map[string]interface{}, path string) {
+	oldRequired, newRequired := requiredSet(before), requiredSet(after)
+	oldProperties, _ := before["properties"].(map[string]interface{})
+	newProperties, _ := after["properties"].(map[string]interface{})
+	oldAdditional, newAdditional := orTrue(before["additionalProperties"]), orTrue(after["additionalProperties"])
+
+	names := make(map[string]interface{})
+	for name := range oldProperties {
+		names[name] = nil
+	}
+	for name := range newProperties {
+		names[name] = nil
+	}
+	for name := range oldRequired {
+		names[name] = nil
+	}
+	for name := range newRequired {
+		names[name] = nil
+	}
+
+	for _, name := range sortedKeys(names) {
+		propertyPath := pointer(pointer(path, "properties"), name)
+		if newRequired[name] && !oldRequired[name] {
+			d.narrowed(propertyPath, "property %q is now required", name)
+		} else if oldRequired[name] && !newRequired[name] {
+			d.widened(propertyPath, "property %q is no longer required", name)
+		}
+
+		o, hadOld := oldProperties[name]
+		n, hasNew := newProperties[name]
+		switch {
+		case hadOld && hasNew:
+			d.compare(o, n, propertyPath)
+		case hasNew:
+			// Clients do not know about the property yet
+			d.changes = append(d.changes, SchemaChange{Path: propertyPath, Message: fmt.Sprintf("property %q added", name), Level: CompatBackward})
+		case hadOld:
+			// Clients may still send the property, which is fine as long
+			// as it is accepted, or expect it in the output
+			level := CompatBreaking
+			if d.input && newAdditional != false {
+				level = CompatBackward
+			}
+			d.changes = append(d.changes, SchemaChange{Path: propertyPath, Message: fmt.Sprintf("property %q removed", name), Level: level})
+		}
+	}
+
+	additionalPath := pointer(path, "additionalProperties")
+	switch {
+	case reflect.DeepEqual(oldAdditional, newAdditional):
+	case newAdditional == false:
+		d.narrowed(additionalPath, "additional properties are no longer allowed")
+	case oldAdditional == false:
+		d.widened(additionalPath, "additional properties are now allowed")
+	default:
+		d.compare(oldAdditional, newAdditional, additionalPath)
+	}
+}
+
+// compareAppSchemas classifies the schemas of app against those of the app
+// version it replaces.
+func compareAppSchemas(previous, app App) *Compatibility {
+	report := &Compatibility{Level: CompatCompatible, PreviousID: previous.ID, PreviousVersion: previous.Version, Changes: []SchemaChange{}}
+	for _, field := range []struct {
+		name          string
+		input         bool
+		before, after Schema
+	}{
+		{"input_schema", true, previous.InputSchema, app.InputSchema},
+		{"output_schema", false, previous.OutputSchema, app.OutputSchema},
+	} {
+		before, beforeErrs := parseSchema(field.before)
+		after, _ := parseSchema(field.after)
+		if len(beforeErrs) > 0 {
+			// Stored before schemas were validated
+			if field.before != field.after {
+				report.Changes = append(report.Changes, SchemaChange{Path: "/" + field.name, Message: "previous schema is not valid JSON Schema", Level: CompatBreaking})
+			}
+			continue
+		}
+		diff := &schemaDiff{input: field.input}
+		diff.compare(before, after, "/"+field.name)
+		report.Changes = append(report.Changes, diff.changes...)
+	}
+
+	sort.SliceStable(report.Changes, func(i, j int) bool { return report.Changes[i].Path < report.Changes[j].Path })
+	for _, change := range report.Changes {
+		if change.Level == CompatBreaking {
+			report.Level = CompatBreaking
+			break
+		}
+		report.Level = CompatBackward
+	}
+	return report
+}
+
+// previousAppVersion finds the app that app replaces: for a new app, the
+// highest version of the app with the same name in its workspace up to its
+// own, so that a backport such as 1.4.1 released after 2.0.0 is compared
+// with 1.4.0. An app without a semantic version replaces the highest version.
+func previousAppVersion(app App) (App, bool, error) {
+	rows, err := db.Query("SELECT "+appColumns+" FROM apps WHERE workspace_id = ? AND name = ? AND id != ?", app.WorkspaceID, app.Name, app.ID)
+	if err != nil {
+		return App{}, false, err
+	}
+	defer rows.Close()
+
+	version, err := ParseVersion(app.Version)
+	hasVersion := err == nil
+	apps := []App{}
+	for rows.Next() {
+		other, err := scanApp(rows)
+		if err != nil {
+			return App{}, false, err
+		}
+		if hasVersion {
+			if otherVersion, err := ParseVersion(other.Version); err != nil || otherVersion.Compare(version) > 0 {
+				continue
+			}
+		}
+		apps = append(apps, other)
+	}
+	if err := rows.Err(); err != nil {
+		return App{}, false, err
+	}
+	previous, ok := selectApp(apps, nil)
+	return previous, ok, nil
+}
+
+// workspaceSchemaPolicy returns the schema policy of a workspace.
+func workspaceSchemaPolicy(workspaceID int) (string, error) {
+	var policy string
+	err := db.QueryRow("SELECT COALESCE(schema_policy, ?) FROM workspaces WHERE id = ?", SchemaPolicyAllow, workspaceID).Scan(&policy)
+	return policy, err
+}
+
+// checkCompatibility classifies app against the version it replaces and
+// reports whether the workspace's schema policy allows it. When it does not,
+// the rejection has been written to w.
+func checkCompatibility(w http.ResponseWriter, previous App, app *App) bool {
+	app.Compatibility = compareAppSchemas(previous, *app)
+	if app.Compatibility.Level != CompatBreaking {
+		return true
+	}
+
+	policy, err := workspaceSchemaPolicy(app.WorkspaceID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if policy != SchemaPolicyRejectBreaking {
+		return true
+	}
+
+	writeAPIError(w, &APIError{
+		Status:  http.StatusConflict,
+		Code:    CodeConflict,
+		Message: "Breaking schema change rejected by workspace policy",
+		Details: map[string]interface{}{"compatibility": app.Compatibility},
+	})
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCompareAppSchemas(t *testing.T) {
+	const input = `{"type":"object","required":["id"],"properties":{"id":{"type":"integer"},"note":{"type":"string","maxLength":100}}}`
+	const output = `{"type":"object","required":["total"],"properties":{"total":{"type":"number"},"status":{"enum":["ok","failed"]}}}`
+
+	for _, tc := range []struct {
+		name          string
+		input, output Schema
+		level         string
+		paths         []string
+	}{
+		{"unchanged", input, output, CompatCompatible, nil},
+		{"description added", `{"type":"object","description":"Input","required":["id"],"properties":{"id":{"type":"integer"},"note":{"type":"string","maxLength":100}}}`, output, CompatCompatible, nil},
+		{"optional input added", `{"type":"object","required":["id"],"properties":{"id":{"type":"integer"},"note":{"type":"string","maxLength":100},"tag":{"type":"string"}}}`, output, CompatBackward, []string{"/input_schema/properties/tag"}},
+		{"input relaxed", `{"type":"object","required":["id"],"properties":{"id":{"type":["integer","string"]},"note":{"type":"string"}}}`, output, CompatBackward, []string{"/input_schema/properties/id/type", "/input_schema/properties/note/maxLength"}},
+		{"input required", `{"type":"object","required":["id","note"],"properties":{"id":{"type":"integer"},"note":{"type":"string","maxLength":100}}}`, output, CompatBreaking, []string{"/input_schema/properties/note"}},
+		{"input type changed", `{"type":"object","required":["id"],"properties":{"id":{"type":"string"},"note":{"type":"string","maxLength":100}}}`, output, CompatBreaking, []string{"/input_schema/properties/id/type"}},
+		{"input closed", `{"type":"object","required":["id"],"additionalProperties":false,"properties":{"id":{"type":"integer"},"note":{"type":"string","maxLength":100}}}`, output, CompatBreaking, []string{"/input_schema/additionalProperties"}},
+		{"output narrowed", input, `{"type":"object","required":["total","status"],"properties":{"total":{"type":"integer"},"status":{"enum":["ok"]}}}`, CompatBackward, []string{"/output_schema/properties/status", "/output_schema/properties/status/enum", "/output_schema/properties/total/type"}},
+		{"output field removed", input, `{"type":"object","properties":{"status":{"enum":["ok","failed"]}}}`, CompatBreaking, []string{"/output_schema/properties/total", "/output_schema/properties/total"}},
+		{"output values added", input, `{"type":"object","required":["total"],"properties":{"total":{"type":"number"},"status":{"enum":["ok","failed","pending"]}}}`, CompatBreaking, []string{"/output_schema/properties/status/enum"}},
+		{"input dropped", "", output, CompatBackward, []string{"/input_schema/properties/id", "/input_schema/properties/id", "/input_schema/properties/note", "/input_schema/type"}},
+		{"output dropped", input, "", CompatBreaking, []string{"/output_schema/properties/status", "/output_schema/properties/total", "/output_schema/properties/total", "/output_schema/type"}},
+	} {
+		previous := App{ID: 1, Version: "1.0.0", InputSchema: input, OutputSchema: output}
+		report := compareAppSchemas(previous, App{InputSchema: tc.input, OutputSchema: tc.output})
+
+		var paths []string
+		for _, change := range report.Changes {
+			paths = append(paths, change.Path)
+		}
+		if report.Level != tc.level || fmt.Sprint(paths) != fmt.Sprint(tc.paths) {
+			t.Errorf("%s: got %s with changes at %v, want %s with changes at %v: %v", tc.name, report.Level, paths, tc.level, tc.paths, report.Changes)
+		}
+		if report.PreviousID != 1 || report.PreviousVersion != "1.0.0" {
+			t.Errorf("%s: report is against %d %s", tc.name, report.PreviousID, report.PreviousVersion)
+		}
+	}
+}
+
+func TestSchemaPolicy(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "policy1")
+	if _, err := db.Exec("UPDATE workspaces SET schema_policy = ? WHERE id = ?", SchemaPolicyRejectBreaking, workspaceID); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", createApp).Methods("POST")
+	router.HandleFunc("/apps/{id:[0-9]+}", updateApp).Methods("PUT")
+
+	app := App{Name: "billing", IPPort: "10.0.0.1:8080", Version: "1.0.0", WorkspaceID: workspaceID, InputSchema: `{"type":"object","properties":{"id":{"type":"integer"}}}`}
+	rr := sendAs(t, router, user, "POST", "/apps", app, http.StatusCreated)
+	var created App
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Compatibility != nil {
+		t.Errorf("first version has compatibility %v", created.Compatibility)
+	}
+
+	// A new version may add an optional field
+	app.Version = "1.1.0"
+	app.InputSchema = `{"type":"object","properties":{"id":{"type":"integer"},"note":{"type":"string"}}}`
+	rr = sendAs(t, router, user, "POST", "/apps", app, http.StatusCreated)
+	var second App
+	if err := json.Unmarshal(rr.Body.Bytes(), &second); err != nil {
+		t.Fatal(err)
+	}
+	if second.Compatibility == nil || second.Compatibility.Level != CompatBackward || second.Compatibility.PreviousID != created.ID {
+		t.Errorf("handler returned unexpected compatibility: %+v", second.Compatibility)
+	}
+
+	// But not make it required, as a new version or as an update
+	app.Version = "2.0.0"
+	app.InputSchema = `{"type":"object","required":["note"],"properties":{"id":{"type":"integer"},"note":{"type":"string"}}}`
+	rr = sendAs(t, router, user, "POST", "/apps", app, http.StatusConflict)
+	var rejection struct {
+		Code    string `json:"code"`
+		Details struct {
+			Compatibility Compatibility `json:"compatibility"`
+		} `json:"details"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &rejection); err != nil {
+		t.Fatal(err)
+	}
+	if rejection.Code != CodeConflict || rejection.Details.Compatibility.Level != CompatBreaking {
+		t.Errorf("handler returned unexpected rejection: %s", rr.Body.String())
+	}
+	app.Version = "1.1.0"
+	rr = sendAs(t, router, user, "PUT", fmt.Sprintf("/apps/%d", second.ID), app, http.StatusConflict)
+
+	// Unless the workspace allows it
+	if _, err := db.Exec("UPDATE workspaces SET schema_policy = ? WHERE id = ?", SchemaPolicyAllow, workspaceID); err != nil {
+		t.Fatal(err)
+	}
+	rr = sendAs(t, router, user, "PUT", fmt.Sprintf("/apps/%d", second.ID), app, http.StatusOK)
+	var updated App
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Compatibility == nil || updated.Compatibility.Level != CompatBreaking {
+		t.Errorf("handler returned unexpected compatibility: %+v", updated.Compatibility)
+	}
+}
+
+func TestSchemaPolicyBackport(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "policy2")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", createApp).Methods("POST")
+
+	v1 := App{Name: "billing", IPPort: "10.0.0.1:8080", Version: "1.4.0", WorkspaceID: workspaceID, InputSchema: `{"type":"object","properties":{"id":{"type":"integer"}}}`}
+	var first App
+	json.Unmarshal(sendAs(t, router, user, "POST", "/apps", v1, http.StatusCreated).Body.Bytes(), &first)
+	v2 := App{Name: "billing", IPPort: "10.0.0.2:8080", Version: "2.0.0", WorkspaceID: workspaceID, InputSchema: `{"type":"object","properties":{"id":{"type":"string"}}}`}
+	sendAs(t, router, user, "POST", "/apps", v2, http.StatusCreated)
+
+	if _, err := db.Exec("UPDATE workspaces SET schema_policy = ? WHERE id = ?", SchemaPolicyRejectBreaking, workspaceID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A patch release of the 1.x line is compared with 1.4.0, not 2.0.0
+	v1.Version, v1.IPPort = "1.4.1", "10.0.0.3:8080"
+	var backport App
+	json.Unmarshal(sendAs(t, router, user, "POST", "/apps", v1, http.StatusCreated).Body.Bytes(), &backport)
+	if backport.Compatibility == nil || backport.Compatibility.Level != CompatCompatible || backport.Compatibility.PreviousID != first.ID {
+		t.Errorf("backport has unexpected compatibility: %+v", backport.Compatibility)
+	}
+
+	// A release above 2.0.0 is still compared with it
+	v1.Version = "2.1.0"
+	sendAs(t, router, user, "POST", "/apps", v1, http.StatusConflict)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Resolution is the answer to a discovery query: the app that was selected,
+// its healthy instances and the address to reach it on. When the caller asks
+// for a load balancing strategy, Instance is the one that was picked.
+type Resolution struct {
+	App       App        `json:"app"`
+	IPPort    string     `json:"ip_port"`
+	Endpoint  string     `json:"endpoint"`
+	Instance  *Instance  `json:"instance,omitempty"`
+	Instances []Instance `json:"instances"`
+}
+
+// selectApp picks the app with the highest semantic version that satisfies
+// constraint. Apps whose version is not valid semver are only considered
+// when there is no constraint and no app has a valid version, in which case
+// the most recently registered one wins.
+func selectApp(apps []App, constraint *Constraint) (App, bool) {
+	var best App
+	var bestVersion Version
+	found, foundSemver := false, false
+	for _, app := range apps {
+		version, err := ParseVersion(app.Version)
+		if err != nil {
+			if constraint == nil && !foundSemver && (!found || app.ID > best.ID) {
+				best, found = app, true
+			}
+			continue
+		}
+		if constraint != nil && !constraint.Check(version) {
+			continue
+		}
+		if !foundSemver || version.Compare(bestVersion) > 0 || (version.Compare(bestVersion) == 0 && app.ID > best.ID) {
+			best, bestVersion = app, version
+			found, foundSemver = true, true
+		}
+	}
+	return best, found
+}
+
+// resolveApp finds the app with a given name in the workspace with a given
+// subdomain:
+// GET /resolve?workspace=<subdomain>&app=<name>[&version=<constraint>][&strategy=<strategy>][&include_unhealthy=true]
+func resolveApp(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	subdomain, name := query.Get("workspace"), query.Get("app")
+	if subdomain == "" || name == "" {
+		writeError(w, http.StatusBadRequest, "workspace and app are required")
+		return
+	}
+
+	strategy := query.Get("strategy")
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyWeighted, StrategyRandom:
+	default:
+		writeError(w, http.StatusBadRequest, errUnknownStrategy.Error())
+		return
+	}
+
+	var constraint *Constraint
+	if v := query.Get("version"); v != "" {
+		c, err := ParseConstraint(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		constraint = &c
+	}
+
+	var workspaceID int
+	err := db.QueryRow("SELECT id FROM workspaces WHERE subdomain = ?", subdomain).Scan(&workspaceID)
+	if err == nil {
+		err = authorizeWorkspace(r, workspaceID, RoleMember)
+	}
+	if err != nil {
+		writeAuthzError(w, err)
+		return
+	}
+
+	rows, err := db.Query("SELECT "+appColumns+" FROM apps WHERE workspace_id = ? AND name = ?", workspaceID, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	apps := []App{}
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		apps = append(apps, app)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	app, ok := selectApp(apps, constraint)
+	if !ok {
+		writeError(w, http.StatusNotFound, "No matching app found")
+		return
+	}
+
+	instances, err := appInstances(app)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if query.Get("include_unhealthy") != "true" {
+		instances = healthyInstances(instances)
+	}
+	if len(instances) == 0 {
+		writeError(w, http.StatusServiceUnavailable, "No healthy instances")
+		return
+	}
+
+	resolution := Resolution{App: app, IPPort: instances[0].Address, Endpoint: app.Endpoint, Instances: instances}
+	if strategy != "" {
+		instance, err := pickInstance(app.ID, instances, strategy)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resolution.IPPort = instance.Address
+		resolution.Instance = &instance
+	}
+	json.NewEncoder(w).Encode(resolution)
+}
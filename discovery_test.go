@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func createTestWorkspace(t *testing.T, owner User, subdomain string) int {
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", subdomain, owner.ID, subdomain, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+func createTestApp(t *testing.T, workspaceID int, name, version, ipPort string) int {
+	result, err := db.Exec("INSERT INTO apps (name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema) VALUES (?, '', '', ?, '/api', ?, ?, '', '')",
+		name, ipPort, version, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+func TestResolveApp(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	stranger := createTestUser(t, "stranger@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "resolve1")
+	createTestApp(t, workspaceID, "billing", "1.2.0", "10.0.0.1:8001")
+	createTestApp(t, workspaceID, "billing", "1.4.1", "10.0.0.1:8002")
+	createTestApp(t, workspaceID, "billing", "1.5.0-beta", "10.0.0.1:8003")
+	createTestApp(t, workspaceID, "billing", "2.0.0", "10.0.0.1:8004")
+	createTestApp(t, workspaceID, "payments", "9.0.0", "10.0.0.1:8005")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/resolve", resolveApp).Methods("GET")
+
+	for _, tc := range []struct {
+		query  string
+		user   User
+		want   int
+		ipPort string
+	}{
+		{"workspace=resolve1&app=billing", owner, http.StatusOK, "10.0.0.1:8004"},
+		{"workspace=resolve1&app=billing&version=%5E1.2", owner, http.StatusOK, "10.0.0.1:8002"},
+		{"workspace=resolve1&app=billing&version=1.5.0-beta", owner, http.StatusOK, "10.0.0.1:8003"},
+		{"workspace=resolve1&app=billing&version=%5E3", owner, http.StatusNotFound, ""},
+		{"workspace=resolve1&app=billing&version=%3E%3Dbogus", owner, http.StatusBadRequest, ""},
+		{"workspace=resolve1&app=missing", owner, http.StatusNotFound, ""},
+		{"workspace=nowhere&app=billing", owner, http.StatusNotFound, ""},
+		{"workspace=resolve1&app=billing", stranger, http.StatusForbidden, ""},
+		{"app=billing", owner, http.StatusBadRequest, ""},
+	} {
+		req, err := http.NewRequest("GET", "/resolve?"+tc.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, tc.user))
+
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.query, status, tc.want)
+			continue
+		}
+		if tc.want != http.StatusOK {
+			continue
+		}
+		var response Resolution
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.IPPort != tc.ipPort || response.Endpoint != "/api" {
+			t.Errorf("%s: handler resolved to unexpected app: got %v want %v", tc.query, response.IPPort, tc.ipPort)
+		}
+	}
+}
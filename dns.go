@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTTL is the TTL in seconds of every record served. It is short because
+// workspace IPs and app instances change at runtime.
+const dnsTTL = 30
+
+var (
+	dnsAddr string
+	dnsZone string
+)
+
+// dnsServer answers DNS queries over UDP for the names in its zone:
+//
+//	<subdomain>.<zone>               A/AAAA: the IPs of the workspace
+//	_<app>._tcp.<subdomain>.<zone>   SRV: the healthy instances of the app
+//	ip-<address>.<zone>              A/AAAA: the SRV target for an instance IP
+//
+// Instance IPs are encoded in SRV targets with their dots or colons replaced
+// by dashes, e.g. ip-10-0-0-1 or ip-fd00--1.
+type dnsServer struct {
+	conn net.PacketConn
+	zone string
+}
+
+// startDNSServer listens on addr and serves zone until Close is called.
+func startDNSServer(addr, zone string) (*dnsServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &dnsServer{conn: conn, zone: canonicalName(zone)}
+	go s.serve()
+	return s, nil
+}
+
+func (s *dnsServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *dnsServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("DNS server stopped: %v", err)
+			}
+			return
+		}
+		response, err := s.handle(buf[:n])
+		if err != nil {
+			// Not a DNS query worth answering
+			continue
+		}
+		s.conn.WriteTo(response, addr)
+	}
+}
+
+// canonicalName lowercases a domain name and makes it fully qualified.
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+func (s *dnsServer) handle(packet []byte) ([]byte, error) {
+	var request dnsmessage.Message
+	if err := request.Unpack(packet); err != nil {
+		return nil, err
+	}
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               request.ID,
+			Response:         true,
+			OpCode:           request.OpCode,
+			Authoritative:    true,
+			RecursionDesired: request.RecursionDesired,
+		},
+		Questions: request.Questions,
+	}
+	maxSize := 512
+	for _, additional := range request.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT && int(additional.Header.Class) > maxSize {
+			maxSize = int(additional.Header.Class)
+		}
+	}
+
+	if request.OpCode != 0 || len(request.Questions) != 1 {
+		response.RCode = dnsmessage.RCodeNotImplemented
+	} else {
+		response.Answers, response.Additionals, response.RCode = s.answer(request.Questions[0])
+	}
+
+	packed, err := response.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if len(packed) > maxSize {
+		response.Truncated = true
+		response.Answers, response.Additionals = nil, nil
+		packed, err = response.Pack()
+	}
+	return packed, err
+}
+
+// answer looks up the records for one question.
+func (s *dnsServer) answer(q dnsmessage.Question) ([]dnsmessage.Resource, []dnsmessage.Resource, dnsmessage.RCode) {
+	name := canonicalName(q.Name.String())
+	if !strings.HasSuffix(name, "."+s.zone) {
+		return nil, nil, dnsmessage.RCodeRefused
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."+s.zone), ".")
+
+	switch {
+	case len(labels) == 1 && strings.HasPrefix(labels[0], "ip-"):
+		ip := decodeIPLabel(labels[0])
+		if ip == nil {
+			return nil, nil, dnsmessage.RCodeNameError
+		}
+		return addressRecords(name, q.Type, []net.IP{ip}), nil, dnsmessage.RCodeSuccess
+
+	case len(labels) == 1:
+		var ips string
+		err := db.QueryRow("SELECT ips FROM workspaces WHERE subdomain = ?", labels[0]).Scan(&ips)
+		if err == sql.ErrNoRows {
+			return nil, nil, dnsmessage.RCodeNameError
+		}
+		if err != nil {
+			log.Printf("DNS lookup of %s failed: %v", name, err)
+			return nil, nil, dnsmessage.RCodeServerFailure
+		}
+		var addresses []net.IP
+		for _, ip := range splitIPs(ips) {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				addresses = append(addresses, parsed)
+			}
+		}
+		return addressRecords(name, q.Type, addresses), nil, dnsmessage.RCodeSuccess
+
+	case len(labels) == 3 && strings.HasPrefix(labels[0], "_") && labels[1] == "_tcp":
+		instances, err := s.lookupInstances(labels[2], labels[0][1:])
+		if err == sql.ErrNoRows {
+			return nil, nil, dnsmessage.RCodeNameError
+		}
+		if err != nil {
+			log.Printf("DNS lookup of %s failed: %v", name, err)
+			return nil, nil, dnsmessage.RCodeServerFailure
+		}
+		if q.Type != dnsmessage.TypeSRV && q.Type != dnsmessage.TypeALL {
+			return nil, nil, dnsmessage.RCodeSuccess
+		}
+		return s.srvRecords(name, instances)
+	}
+	return nil, nil, dnsmessage.RCodeNameError
+}
+
+// lookupInstances returns the healthy instances of the highest version of
+// the app with a given name in the workspace with a given subdomain.
+func (s *dnsServer) lookupInstances(subdomain, appName string) ([]Instance, error) {
+	var workspaceID int
+	if err := db.QueryRow("SELECT id FROM workspaces WHERE subdomain = ?", subdomain).Scan(&workspaceID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT "+appColumns+" FROM apps WHERE workspace_id = ? AND LOWER(name) = ?", workspaceID, appName)
+	if err != nil {
+		return nil, err
+	}
+	apps := []App{}
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	app, ok := selectApp(apps, nil)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	instances, err := appInstances(app)
+	if err != nil {
+		return nil, err
+	}
+	return healthyInstances(instances), nil
+}
+
+func (s *dnsServer) srvRecords(name string, instances []Instance) ([]dnsmessage.Resource, []dnsmessage.Resource, dnsmessage.RCode) {
+	var answers, additionals []dnsmessage.Resource
+	for _, instance := range instances {
+		host, portString, err := net.SplitHostPort(instance.Address)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			continue
+		}
+
+		target := canonicalName(host)
+		if ip := net.ParseIP(host); ip != nil {
+			target = encodeIPLabel(ip) + "." + s.zone
+			additionals = append(additionals, addressRecords(target, dnsmessage.TypeALL, []net.IP{ip})...)
+		}
+		targetName, err := dnsmessage.NewName(target)
+		if err != nil {
+			continue
+		}
+
+		weight := instance.Weight
+		if weight > 65535 {
+			weight = 65535
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: resourceHeader(name, dnsmessage.TypeSRV),
+			Body:   &dnsmessage.SRVResource{Priority: 0, Weight: uint16(weight), Port: uint16(port), Target: targetName},
+		})
+	}
+	return answers, additionals, dnsmessage.RCodeSuccess
+}
+
+// addressRecords returns the A and AAAA records of name among ips that
+// answer a question of type qtype.
+func addressRecords(name string, qtype dnsmessage.Type, ips []net.IP) []dnsmessage.Resource {
+	var records []dnsmessage.Resource
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == dnsmessage.TypeA || qtype == dnsmessage.TypeALL {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				records = append(records, dnsmessage.Resource{Header: resourceHeader(name, dnsmessage.TypeA), Body: &a})
+			}
+		} else if qtype == dnsmessage.TypeAAAA || qtype == dnsmessage.TypeALL {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			records = append(records, dnsmessage.Resource{Header: resourceHeader(name, dnsmessage.TypeAAAA), Body: &aaaa})
+		}
+	}
+	return records
+}
+
+func resourceHeader(name string, rtype dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  rtype,
+		Class: dnsmessage.ClassINET,
+		TTL:   dnsTTL,
+	}
+}
+
+func encodeIPLabel(ip net.IP) string {
+	return "ip-" + strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+}
+
+func decodeIPLabel(label string) net.IP {
+	encoded := strings.TrimPrefix(label, "ip-")
+	if ip := net.ParseIP(strings.ReplaceAll(encoded, "-", ".")); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.ReplaceAll(encoded, "-", ":"))
+}
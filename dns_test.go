@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func queryDNS(t *testing.T, server *dnsServer, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	request := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := request.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if response.ID != 42 || !response.Response || !response.Authoritative {
+		t.Errorf("%s: unexpected response header %+v", name, response.Header)
+	}
+	return response
+}
+
+func TestDNSServer(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "dns12345")
+	db.Exec("UPDATE workspaces SET ips = ? WHERE id = ?", "10.0.0.5,fd00::5", workspaceID)
+	createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8000")
+	appID := createTestApp(t, workspaceID, "billing", "2.0.0", "10.0.0.1:9000")
+	db.Exec("INSERT INTO app_instances (app_id, address, weight) VALUES (?, ?, ?)", appID, "10.0.0.7:9000", 3)
+	db.Exec("INSERT INTO app_instances (app_id, address) VALUES (?, ?)", appID, "billing.internal:9001")
+	db.Exec("INSERT INTO app_instances (app_id, address, healthy) VALUES (?, ?, 0)", appID, "10.0.0.8:9000")
+
+	server, err := startDNSServer("127.0.0.1:0", "Discover.Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	response := queryDNS(t, server, "dns12345.discover.test.", dnsmessage.TypeA)
+	if response.RCode != dnsmessage.RCodeSuccess || len(response.Answers) != 1 {
+		t.Fatalf("A query returned %v with %d answers", response.RCode, len(response.Answers))
+	}
+	if a := response.Answers[0].Body.(*dnsmessage.AResource); net.IP(a.A[:]).String() != "10.0.0.5" {
+		t.Errorf("A query returned %v, want 10.0.0.5", net.IP(a.A[:]))
+	}
+
+	response = queryDNS(t, server, "DNS12345.discover.test.", dnsmessage.TypeAAAA)
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA[:]).String() != "fd00::5" {
+		t.Errorf("AAAA query returned unexpected answers: %v", response.Answers)
+	}
+
+	// SRV records point at the healthy instances of the highest version
+	response = queryDNS(t, server, "_billing._tcp.dns12345.discover.test.", dnsmessage.TypeSRV)
+	if response.RCode != dnsmessage.RCodeSuccess || len(response.Answers) != 2 {
+		t.Fatalf("SRV query returned %v with %d answers", response.RCode, len(response.Answers))
+	}
+	srv := response.Answers[0].Body.(*dnsmessage.SRVResource)
+	if srv.Target.String() != "ip-10-0-0-7.discover.test." || srv.Port != 9000 || srv.Weight != 3 {
+		t.Errorf("SRV query returned unexpected record %+v", srv)
+	}
+	if srv := response.Answers[1].Body.(*dnsmessage.SRVResource); srv.Target.String() != "billing.internal." || srv.Port != 9001 {
+		t.Errorf("SRV query returned unexpected record %+v", srv)
+	}
+	if len(response.Additionals) != 1 || response.Additionals[0].Header.Name.String() != "ip-10-0-0-7.discover.test." {
+		t.Errorf("SRV query returned unexpected additional records: %v", response.Additionals)
+	}
+
+	response = queryDNS(t, server, "ip-10-0-0-7.discover.test.", dnsmessage.TypeA)
+	if len(response.Answers) != 1 || net.IP(response.Answers[0].Body.(*dnsmessage.AResource).A[:]).String() != "10.0.0.7" {
+		t.Errorf("A query for an SRV target returned unexpected answers: %v", response.Answers)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		qtype dnsmessage.Type
+		want  dnsmessage.RCode
+	}{
+		{"missing1.discover.test.", dnsmessage.TypeA, dnsmessage.RCodeNameError},
+		{"_payments._tcp.dns12345.discover.test.", dnsmessage.TypeSRV, dnsmessage.RCodeNameError},
+		{"dns12345.example.com.", dnsmessage.TypeA, dnsmessage.RCodeRefused},
+		{"dns12345.discover.test.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess},
+	} {
+		response := queryDNS(t, server, tc.name, tc.qtype)
+		if response.RCode != tc.want || len(response.Answers) != 0 {
+			t.Errorf("%s: query returned %v with %d answers, want %v with none", tc.name, response.RCode, len(response.Answers), tc.want)
+		}
+	}
+}
+
+func TestIPLabels(t *testing.T) {
+	for _, ip := range []string{"10.0.0.1", "fd00::1", "2001:db8::a:1"} {
+		label := encodeIPLabel(net.ParseIP(ip))
+		if decoded := decodeIPLabel(label); decoded == nil || decoded.String() != ip {
+			t.Errorf("%s was encoded as %s and decoded as %v", ip, label, decoded)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Error codes clients can rely on, unlike the messages that go with them.
+const (
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeUnsupportedMedia     = "unsupported_media_type"
+	CodeRateLimited          = "rate_limited"
+	CodeUpstreamFailed       = "upstream_failed"
+	CodeUnavailable          = "unavailable"
+	CodeInternal             = "internal_error"
+)
+
+// APIError is the body of every error response:
+//
+//	{"error": "Invalid email address", "code": "validation_failed",
+//	 "errors": [{"path": "/username", "message": "..."}]}
+//
+// errors lists the fields that failed validation, if any, and details holds
+// anything else that explains the error, keyed by what it is.
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"error"`
+	Errors  []ValidationError      `json:"errors,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// codeOf is the code of the errors that are sent with a status.
+func codeOf(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusRequestEntityTooLarge:
+		return CodeValidationFailed
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusPreconditionRequired:
+		return CodePreconditionRequired
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMedia
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return CodeUpstreamFailed
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
+
+// writeError sends an error response with the code that goes with status.
+// The message of an internal error is logged rather than sent, as it may
+// describe the database.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeAPIError(w, &APIError{Status: status, Code: codeOf(status), Message: message})
+}
+
+// routeErrors makes router answer unknown paths and methods with an APIError
+// rather than mux's plain text.
+func routeErrors(router *mux.Router) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// mux reports a wrong method as not found when the path also falls
+		// under a subrouter's prefix, so look for the path among all routes
+		if allowed := allowedMethods(router, r.URL.Path); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeError(w, http.StatusNotFound, "No such route")
+	})
+	router.NotFoundHandler = handler
+	router.MethodNotAllowedHandler = handler
+}
+
+// allowedMethods lists the methods of router's routes for path.
+func allowedMethods(router *mux.Router, path string) []string {
+	var allowed []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		pattern, err := route.GetPathRegexp()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		if regexp.MustCompile(pattern).MatchString(path) {
+			allowed = append(allowed, methods...)
+		}
+		return nil
+	})
+	sort.Strings(allowed)
+	return allowed
+}
+
+// writeValidationError rejects a request because of the fields in errs.
+func writeValidationError(w http.ResponseWriter, message string, errs ...ValidationError) {
+	writeAPIError(w, &APIError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: message, Errors: errs})
+}
+
+func writeAPIError(w http.ResponseWriter, apiErr *APIError) {
+	if apiErr.Status >= 500 && apiErr.Code == CodeInternal {
+		log.Printf("Internal error: %s", apiErr.Message)
+		apiErr.Message = "Internal server error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(apiErr)
+}
+
+// errNotFound is returned for UPDATEs and DELETEs that matched no row.
+var errNotFound = errors.New("not found")
+
+// rowsAffected turns an UPDATE or DELETE that matched no row into
+// errNotFound.
+func rowsAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a write that would have duplicated
+// a UNIQUE or primary key value.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+// writeDBError reports a failed query about a resource, such as "User",
+// without passing on what the database said.
+func writeDBError(w http.ResponseWriter, resource string, err error) {
+	var sqliteErr sqlite3.Error
+	switch {
+	case err == sql.ErrNoRows || err == errNotFound:
+		writeError(w, http.StatusNotFound, resource+" not found")
+	case err == errRevisionChanged:
+		writeError(w, http.StatusPreconditionFailed, resource+" has changed")
+	case isUniqueViolation(err):
+		writeError(w, http.StatusConflict, resource+" already exists")
+	case errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey:
+		writeError(w, http.StatusConflict, resource+" refers to a resource that does not exist")
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
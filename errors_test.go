@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestErrorResponses(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "taken@example.com", "secret")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users", createUser).Methods("POST")
+	router.HandleFunc("/users/{id:[0-9]+}", getUser).Methods("GET")
+	router.HandleFunc("/users/{id:[0-9]+}", updateUser).Methods("PUT")
+	router.HandleFunc("/workspace-roles/{id:[0-9]+}", deleteWorkspaceRole).Methods("DELETE")
+	router.HandleFunc("/app-roles/{id:[0-9]+}", deleteAppRole).Methods("DELETE")
+	router.HandleFunc("/apps/{id:[0-9]+}", deleteApp).Methods("DELETE")
+
+	send := func(method, path, body string, want int) APIError {
+		t.Helper()
+		rr := sendAs(t, router, user, method, path, body, want)
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s %s: error has content type %q", method, path, contentType)
+		}
+		if strings.Contains(strings.ToLower(rr.Body.String()), "sql") || strings.Contains(rr.Body.String(), "constraint") {
+			t.Errorf("%s %s: error leaks database details: %s", method, path, rr.Body.String())
+		}
+		var response APIError
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// Duplicate usernames conflict rather than failing with a database error
+	response := send("POST", "/users", `{"username":"taken@example.com","password":"x"}`, http.StatusConflict)
+	if response.Code != CodeConflict || response.Message != "User already exists" {
+		t.Errorf("duplicate user returned %+v", response)
+	}
+
+	response = send("POST", "/users", `{"username":"not an email","password":"x"}`, http.StatusBadRequest)
+	if response.Code != CodeValidationFailed || len(response.Errors) != 1 || response.Errors[0].Path != "/username" {
+		t.Errorf("invalid user returned %+v", response)
+	}
+
+	// Updates and deletes that match nothing are not found
+	response = send("GET", "/users/9999", "", http.StatusNotFound)
+	if response.Code != CodeNotFound || response.Message != "User not found" {
+		t.Errorf("missing user returned %+v", response)
+	}
+	send("PUT", "/users/9999", `{"username":"x@example.com","password":"x"}`, http.StatusNotFound)
+	send("DELETE", "/workspace-roles/9999", "", http.StatusNotFound)
+	send("DELETE", "/app-roles/9999", "", http.StatusNotFound)
+	send("DELETE", "/apps/9999", "", http.StatusNotFound)
+}
+
+func TestRouteErrors(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	tokens, err := issueTokens(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Laid out like the routes in main, where subrouters hide method
+	// mismatches from mux
+	router := mux.NewRouter()
+	routeErrors(router)
+	router.HandleFunc("/login", login).Methods("POST")
+	stream := router.PathPrefix("/events").Subrouter()
+	stream.HandleFunc("/stream", streamEvents).Methods("GET")
+	stream.HandleFunc("/ws", streamEventsWS).Methods("GET")
+	api := router.PathPrefix("/").Subrouter()
+	api.Use(authMiddleware)
+	api.HandleFunc("/users/{id:[0-9]+}", getUser).Methods("GET")
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+		code         string
+	}{
+		{"GET", "/nowhere", http.StatusNotFound, CodeNotFound},
+		{"GET", "/login", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{"DELETE", "/users/1", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{"POST", "/events/stream", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var response APIError
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: error is not JSON: %q", tc.method, tc.path, rr.Body.String())
+		}
+		if rr.Code != tc.want || response.Code != tc.code || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: got %v %+v, want %v %s", tc.method, tc.path, rr.Code, response, tc.want, tc.code)
+		}
+		if tc.want == http.StatusMethodNotAllowed && rr.Header().Get("Allow") == "" {
+			t.Errorf("%s %s: response has no Allow header", tc.method, tc.path)
+		}
+	}
+}
+
+func TestInternalErrorsAreNotSent(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeError(rr, http.StatusInternalServerError, "no such table: users")
+	var response APIError
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != CodeInternal || response.Message != "Internal server error" {
+		t.Errorf("internal error was sent as %+v", response)
+	}
+}
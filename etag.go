@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// requireIfMatch makes writes to resources with an ETag fail with 428 unless
+// they send If-Match.
+var requireIfMatch bool
+
+// errRevisionChanged is returned for writes whose row no longer has the
+// revision their If-Match named.
+var errRevisionChanged = errors.New("revision changed")
+
+type ifMatchKey struct{}
+
+// ifMatchRevision returns the revision that the request's If-Match named and
+// conditional found current.
+func ifMatchRevision(r *http.Request) (int, bool) {
+	revision, ok := r.Context().Value(ifMatchKey{}).(int)
+	return revision, ok
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// execIfMatch runs an UPDATE or DELETE of the single row that query's
+// trailing WHERE clause names. If the request has an If-Match, the row must still
+// be at that revision, so a write that got in since the check is never
+// overwritten: the write then fails with errRevisionChanged. Otherwise a
+// write that matches no row fails with errNotFound.
+func execIfMatch(ex execer, r *http.Request, query string, args ...interface{}) error {
+	revision, ok := ifMatchRevision(r)
+	if ok {
+		query += " AND revision = ?"
+		args = append(args, revision)
+	}
+	err := rowsAffected(ex.Exec(query, args...))
+	if err == errNotFound && ok {
+		return errRevisionChanged
+	}
+	return err
+}
+
+// etag is the entity tag of a resource at a revision.
+func etag(revision int) string {
+	return `"` + strconv.Itoa(revision) + `"`
+}
+
+// etagMatches reports whether a comma-separated If-Match or If-None-Match
+// header lists tag or is "*". Weak tags only match when weak is set.
+func etagMatches(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceRevision returns the revision of a row, which every update of the
+// row increments.
+func resourceRevision(table string, id interface{}) (int, error) {
+	return revisionBy(table, "id", id)
+}
+
+// revisionBy returns the revision of the row whose unique column is value.
+func revisionBy(table, column string, value interface{}) (int, error) {
+	var revision int
+	err := db.QueryRow("SELECT revision FROM "+table+" WHERE "+column+" = ?", value).Scan(&revision)
+	return revision, err
+}
+
+// conditional makes the route's {id} row in table a resource with an ETag:
+// reads answer If-None-Match with 304 Not Modified, writes with a stale
+// If-Match fail with 412 Precondition Failed, and successful responses carry
+// the ETag of the row as it is afterwards. Handlers write the row with
+// execIfMatch, which repeats the If-Match check in the write itself.
+func conditional(next http.HandlerFunc, table string) http.HandlerFunc {
+	return conditionalBy(next, table, "id", "id")
+}
+
+// conditionalBy is conditional for routes that name the row by the route
+// variable param, which holds its unique column, e.g. the {instance_id} of an
+// instance or the {subdomain} of a workspace.
+func conditionalBy(next http.HandlerFunc, table, column, param string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := mux.Vars(r)[param]
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+		revision, err := revisionBy(table, column, value)
+		if err != nil && err != sql.ErrNoRows {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		exists := err == nil
+
+		if read {
+			if match := r.Header.Get("If-None-Match"); exists && match != "" && etagMatches(match, etag(revision), true) {
+				w.Header().Set("ETag", etag(revision))
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else if match := r.Header.Get("If-Match"); match != "" {
+			if !exists || !etagMatches(match, etag(revision), false) {
+				if exists {
+					w.Header().Set("ETag", etag(revision))
+				}
+				writeError(w, http.StatusPreconditionFailed, "Resource has changed")
+				return
+			}
+			if strings.TrimSpace(match) != "*" {
+				r = r.WithContext(context.WithValue(r.Context(), ifMatchKey{}, revision))
+			}
+		} else if requireIfMatch {
+			writeError(w, http.StatusPreconditionRequired, "If-Match required")
+			return
+		}
+
+		next(&etagWriter{ResponseWriter: w, table: table, column: column, value: value}, r)
+	}
+}
+
+// etagWriter sets the ETag of a resource on successful responses, reading the
+// revision when the handler starts its response so that it reflects any write
+// the handler made.
+type etagWriter struct {
+	http.ResponseWriter
+	table       string
+	column      string
+	value       string
+	wroteHeader bool
+}
+
+func (w *etagWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status >= 200 && status < 300 {
+			if revision, err := revisionBy(w.table, w.column, w.value); err == nil {
+				w.Header().Set("ETag", etag(revision))
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *etagWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
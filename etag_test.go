@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestETagMatches(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{`"3"`, false, true},
+		{`"1", "3"`, false, true},
+		{`*`, false, true},
+		{`"4"`, false, false},
+		{`W/"3"`, false, false},
+		{`W/"3"`, true, true},
+	} {
+		if got := etagMatches(tc.header, `"3"`, tc.weak); got != tc.want {
+			t.Errorf("etagMatches(%q, weak=%v) = %v, want %v", tc.header, tc.weak, got, tc.want)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "etag1")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8001")
+	if err := backfillRevisions(db); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", user.ID, RoleMember, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleID, _ := result.LastInsertId()
+	result, err = db.Exec("INSERT INTO app_instances (app_id, address) VALUES (?, ?)", appID, "10.0.0.1:8001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instanceID, _ := result.LastInsertId()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps/{id:[0-9]+}", conditional(getApp, "apps")).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}", conditional(updateApp, "apps")).Methods("PUT")
+	router.HandleFunc("/apps/{id:[0-9]+}", conditional(patchApp, "apps")).Methods("PATCH")
+	router.HandleFunc("/apps/{id:[0-9]+}", conditional(deleteApp, "apps")).Methods("DELETE")
+	router.HandleFunc("/workspace-roles/{id:[0-9]+}", conditional(getWorkspaceRole, "workspace_roles")).Methods("GET")
+	router.HandleFunc("/workspace-roles/{id:[0-9]+}", conditional(updateWorkspaceRole, "workspace_roles")).Methods("PUT")
+	router.HandleFunc("/workspaces/by-subdomain/{subdomain}", conditionalBy(getWorkspaceBySubdomain, "workspaces", "subdomain", "subdomain")).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}", conditionalBy(getInstance, "app_instances", "id", "instance_id")).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}", conditionalBy(updateInstance, "app_instances", "id", "instance_id")).Methods("PUT")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}/heartbeat", heartbeatInstance).Methods("PUT")
+
+	appPath := fmt.Sprintf("/apps/%d", appID)
+
+	rr := sendAs(t, router, user, "GET", appPath, nil, http.StatusOK)
+	if tag := rr.Header().Get("ETag"); tag != `"1"` {
+		t.Fatalf("app has ETag %s, want \"1\"", tag)
+	}
+	sendAs(t, router, user, "GET", appPath, nil, http.StatusNotModified, "If-None-Match", `"1"`)
+
+	// Only one of two updates based on the same revision goes through
+	app := App{Name: "billing", IPPort: "10.0.0.1:8001", Version: "1.1.0", WorkspaceID: workspaceID}
+	rr = sendAs(t, router, user, "PUT", appPath, app, http.StatusOK, "If-Match", `"1"`)
+	if tag := rr.Header().Get("ETag"); tag != `"2"` {
+		t.Errorf("updated app has ETag %s, want \"2\"", tag)
+	}
+	app.Version = "1.2.0"
+	rr = sendAs(t, router, user, "PUT", appPath, app, http.StatusPreconditionFailed, "If-Match", `"1"`)
+	if tag := rr.Header().Get("ETag"); tag != `"2"` {
+		t.Errorf("conflict reports ETag %s, want \"2\"", tag)
+	}
+	sendAs(t, router, user, "PATCH", appPath, map[string]string{"description": "Invoices"}, http.StatusOK, "If-Match", `"2"`, "Content-Type", mergePatchType)
+	rr = sendAs(t, router, user, "GET", appPath, nil, http.StatusOK, "If-None-Match", `"2"`)
+	if tag := rr.Header().Get("ETag"); tag != `"3"` {
+		t.Errorf("patched app has ETag %s, want \"3\"", tag)
+	}
+
+	// Roles carry their own revision
+	rolePath := fmt.Sprintf("/workspace-roles/%d", roleID)
+	role := WorkspaceRole{UserID: user.ID, Role: RoleAdmin, WorkspaceID: workspaceID}
+	sendAs(t, router, user, "PUT", rolePath, role, http.StatusOK, "If-Match", `"1"`)
+	rr = sendAs(t, router, user, "GET", rolePath, nil, http.StatusOK)
+	if tag := rr.Header().Get("ETag"); tag != `"2"` {
+		t.Errorf("updated role has ETag %s, want \"2\"", tag)
+	}
+
+	// Workspaces looked up by subdomain carry the workspace's ETag
+	rr = sendAs(t, router, user, "GET", "/workspaces/by-subdomain/etag1", nil, http.StatusOK)
+	sendAs(t, router, user, "GET", "/workspaces/by-subdomain/etag1", nil, http.StatusNotModified, "If-None-Match", rr.Header().Get("ETag"))
+
+	// Updates and heartbeats both move an instance on
+	instancePath := fmt.Sprintf("/apps/%d/instances/%d", appID, instanceID)
+	rr = sendAs(t, router, user, "GET", instancePath, nil, http.StatusOK)
+	if tag := rr.Header().Get("ETag"); tag != `"1"` {
+		t.Errorf("instance has ETag %s, want \"1\"", tag)
+	}
+	instance := Instance{Address: "10.0.0.1:8002", Weight: 1}
+	sendAs(t, router, user, "PUT", instancePath, instance, http.StatusOK, "If-Match", `"1"`)
+	rr = sendAs(t, router, user, "PUT", instancePath+"/heartbeat", nil, http.StatusOK)
+	if tag := rr.Header().Get("ETag"); tag != `"3"` {
+		t.Errorf("instance has ETag %s after an update and a heartbeat, want \"3\"", tag)
+	}
+	sendAs(t, router, user, "PUT", instancePath, instance, http.StatusPreconditionFailed, "If-Match", `"2"`)
+
+	requireIfMatch = true
+	defer func() { requireIfMatch = false }()
+	sendAs(t, router, user, "PUT", instancePath+"/heartbeat", nil, http.StatusOK)
+	sendAs(t, router, user, "DELETE", appPath, nil, http.StatusPreconditionRequired)
+	sendAs(t, router, user, "DELETE", appPath, nil, http.StatusPreconditionFailed, "If-Match", `"2"`)
+	sendAs(t, router, user, "DELETE", appPath, nil, http.StatusNoContent, "If-Match", `"3"`)
+	sendAs(t, router, user, "GET", appPath, nil, http.StatusNotFound, "If-None-Match", `"3"`)
+}
+
+func TestConditionalWriteLosesRace(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "etag2")
+	revision, err := resourceRevision("workspaces", workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The If-Match was checked, then another write got in before this one
+	requestBody, _ := json.Marshal(Workspace{Name: "Mine"})
+	req, err := http.NewRequest("PUT", fmt.Sprintf("/workspaces/%d", workspaceID), bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = asUser(req, user)
+	req = req.WithContext(context.WithValue(req.Context(), ifMatchKey{}, revision))
+	if _, err := db.Exec("UPDATE workspaces SET name = 'Theirs', revision = revision + 1 WHERE id = ?", workspaceID); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/workspaces/{id:[0-9]+}", updateWorkspace).Methods("PUT")
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusPreconditionFailed {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPreconditionFailed)
+	}
+	var name string
+	db.QueryRow("SELECT name FROM workspaces WHERE id = ?", workspaceID).Scan(&name)
+	if name != "Theirs" {
+		t.Errorf("stale write overwrote the workspace: name is %q", name)
+	}
+}
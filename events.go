@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventWorkspaceCreated      = "workspace.created"
+	EventWorkspaceUpdated      = "workspace.updated"
+	EventWorkspaceDeleted      = "workspace.deleted"
+	EventAppRegistered         = "app.registered"
+	EventAppUpdated            = "app.updated"
+	EventAppDeregistered       = "app.deregistered"
+	EventInstanceRegistered    = "instance.registered"
+	EventInstanceUpdated       = "instance.updated"
+	EventInstanceExpired       = "instance.expired"
+	EventInstanceRecovered     = "instance.recovered"
+	EventInstanceHealthChanged = "instance.health_changed"
+	EventInstanceDeregistered  = "instance.deregistered"
+	EventRoleGranted           = "role.granted"
+	EventRoleChanged           = "role.changed"
+	EventRoleRevoked           = "role.revoked"
+	EventIPAllocated           = "ip.allocated"
+	EventIPReleased            = "ip.released"
+	EventIPPoolCreated         = "ip_pool.created"
+	EventIPPoolDeleted         = "ip_pool.deleted"
+	EventUserCreated           = "user.created"
+	EventUserUpdated           = "user.updated"
+	EventUserDeleted           = "user.deleted"
+)
+
+// Event describes a change to the registry. Index is the registry index the
+// change moved it to.
+type Event struct {
+	Type        string      `json:"type"`
+	Index       uint64      `json:"index"`
+	WorkspaceID int         `json:"workspace_id,omitempty"`
+	Data        interface{} `json:"data,omitempty"`
+	Time        time.Time   `json:"time"`
+}
+
+// deleted is the data of an event about something that no longer exists.
+type deleted struct {
+	ID int `json:"id"`
+}
+
+// ipEvent is the data of an event about an IP lease.
+type ipEvent struct {
+	IP string `json:"ip"`
+}
+
+// eventBroker fans events out to every subscriber. Subscribers that cannot
+// keep up miss events rather than blocking the publisher.
+type eventBroker struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+var events = &eventBroker{subscribers: make(map[chan Event]struct{})}
+
+// publish bumps the registry index and hands the event to every subscriber.
+// Both happen under the broker's lock, so subscribers get events in index
+// order.
+func (b *eventBroker) publish(event Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	event.Index = bumpRegistryIndex()
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (b *eventBroker) subscribe() chan Event {
+	ch := make(chan Event, 64)
+	b.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan Event) {
+	b.Lock()
+	delete(b.subscribers, ch)
+	b.Unlock()
+}
@@ -4,6 +4,8 @@ go 1.20
 
 require (
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v1.14.24
 	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.30.0
 )
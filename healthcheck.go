@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health check types
+const (
+	CheckHTTP = "http"
+	CheckTCP  = "tcp"
+	CheckNone = "none"
+)
+
+// Health states
+const (
+	HealthPassing = "passing"
+	HealthFailing = "failing"
+	HealthWarning = "warning"
+	HealthUnknown = "unknown"
+)
+
+const defaultHealthTimeout = 2 * time.Second
+
+var (
+	healthInterval time.Duration
+	healthWorkers  int
+)
+
+// HealthCheck configures how the instances of an app are probed. Without one,
+// an app is probed with an HTTP GET of its endpoint that must return 200.
+type HealthCheck struct {
+	Type           string `json:"type"`
+	Path           string `json:"path,omitempty"`
+	ExpectedStatus int    `json:"expected_status,omitempty"`
+	TimeoutMs      int    `json:"timeout_ms,omitempty"`
+}
+
+// HealthStatus is the outcome of the latest probe of one instance.
+type HealthStatus struct {
+	Address   string    `json:"address"`
+	Status    string    `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// healthEvent is the data of an event about an instance that started or
+// stopped failing its health check.
+type healthEvent struct {
+	AppID int `json:"app_id"`
+	HealthStatus
+}
+
+// AppHealth summarizes the probes of every instance of an app: passing if
+// they all pass, failing if none do and warning otherwise.
+type AppHealth struct {
+	Status    string         `json:"status"`
+	Instances []HealthStatus `json:"instances"`
+}
+
+// healthResults holds the latest probe of every instance, by app ID and address.
+var healthResults = struct {
+	sync.RWMutex
+	byApp map[int]map[string]HealthStatus
+}{byApp: make(map[int]map[string]HealthStatus)}
+
+func validateHealthCheck(check *HealthCheck) error {
+	if check == nil {
+		return nil
+	}
+	switch check.Type {
+	case "", CheckHTTP, CheckTCP, CheckNone:
+	default:
+		return fmt.Errorf("unknown health check type %q", check.Type)
+	}
+	if check.ExpectedStatus != 0 && (check.ExpectedStatus < 100 || check.ExpectedStatus > 599) {
+		return errors.New("expected_status must be an HTTP status code")
+	}
+	if check.TimeoutMs < 0 {
+		return errors.New("timeout_ms must not be negative")
+	}
+	return nil
+}
+
+// healthCheckOf returns the check to run against an app with the defaults
+// filled in.
+func healthCheckOf(app App) HealthCheck {
+	var check HealthCheck
+	if app.HealthCheck != nil {
+		check = *app.HealthCheck
+	}
+	if check.Type == "" {
+		check.Type = CheckHTTP
+	}
+	if check.Path == "" {
+		check.Path = app.Endpoint
+	}
+	check.Path = absolutePath(check.Path)
+	if check.ExpectedStatus == 0 {
+		check.ExpectedStatus = http.StatusOK
+	}
+	return check
+}
+
+func (c HealthCheck) timeout() time.Duration {
+	if c.TimeoutMs > 0 {
+		return time.Duration(c.TimeoutMs) * time.Millisecond
+	}
+	return defaultHealthTimeout
+}
+
+// marshalHealthCheck returns the stored form of a health check, "" for none.
+func marshalHealthCheck(check *HealthCheck) string {
+	if check == nil {
+		return ""
+	}
+	data, _ := json.Marshal(check)
+	return string(data)
+}
+
+func unmarshalHealthCheck(data string) *HealthCheck {
+	if data == "" {
+		return nil
+	}
+	var check HealthCheck
+	if err := json.Unmarshal([]byte(data), &check); err != nil {
+		return nil
+	}
+	return &check
+}
+
+// probe runs one health check against the instance at address.
+func probe(check HealthCheck, address string) HealthStatus {
+	status := HealthStatus{Address: address, Status: HealthPassing, CheckedAt: time.Now().UTC()}
+	start := time.Now()
+
+	var err error
+	switch check.Type {
+	case CheckTCP:
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", address, check.timeout())
+		if err == nil {
+			conn.Close()
+		}
+	default:
+		client := http.Client{Timeout: check.timeout()}
+		var resp *http.Response
+		resp, err = client.Get("http://" + address + check.Path)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != check.ExpectedStatus {
+				err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}
+	}
+
+	status.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		status.Status = HealthFailing
+		status.LastError = err.Error()
+	}
+	return status
+}
+
+// checkHealth probes every instance of every app once, using at most
+// healthWorkers concurrent probes, and replaces the recorded results.
+func checkHealth() error {
+	rows, err := db.Query("SELECT " + appColumns + " FROM apps")
+	if err != nil {
+		return err
+	}
+	apps := []App{}
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		apps = append(apps, app)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	type target struct {
+		appID   int
+		check   HealthCheck
+		address string
+	}
+	targets := make(chan target)
+	results := make(map[int]map[string]HealthStatus)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	workers := healthWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range targets {
+				status := probe(t.check, t.address)
+				mu.Lock()
+				if results[t.appID] == nil {
+					results[t.appID] = make(map[string]HealthStatus)
+				}
+				results[t.appID][t.address] = status
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, app := range apps {
+		check := healthCheckOf(app)
+		if check.Type == CheckNone {
+			continue
+		}
+		instances, err := registeredInstances(app)
+		if err != nil {
+			log.Printf("Loading instances of app %d failed: %v", app.ID, err)
+			continue
+		}
+		for _, instance := range instances {
+			targets <- target{app.ID, check, instance.Address}
+		}
+	}
+	close(targets)
+	wg.Wait()
+
+	healthResults.Lock()
+	previous := healthResults.byApp
+	healthResults.byApp = results
+	healthResults.Unlock()
+
+	// Discovery skips failing instances, so watchers need to hear when an
+	// instance starts or stops failing
+	for _, app := range apps {
+		for address, status := range results[app.ID] {
+			last, probed := previous[app.ID][address]
+			if (probed && last.Status == HealthFailing) != (status.Status == HealthFailing) {
+				events.publish(Event{Type: EventInstanceHealthChanged, WorkspaceID: app.WorkspaceID, Data: healthEvent{app.ID, status}})
+			}
+		}
+	}
+	return nil
+}
+
+// runHealthChecker calls checkHealth every healthInterval until the process exits.
+func runHealthChecker() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := checkHealth(); err != nil {
+			log.Printf("Health checking failed: %v", err)
+		}
+	}
+}
+
+// healthOf returns the latest probe of an instance, if it has been probed.
+func healthOf(appID int, address string) (HealthStatus, bool) {
+	healthResults.RLock()
+	defer healthResults.RUnlock()
+	status, ok := healthResults.byApp[appID][address]
+	return status, ok
+}
+
+// appHealth summarizes the latest probes of an app's instances.
+func appHealth(appID int) *AppHealth {
+	healthResults.RLock()
+	defer healthResults.RUnlock()
+
+	health := &AppHealth{Status: HealthUnknown, Instances: []HealthStatus{}}
+	passing := 0
+	for _, status := range healthResults.byApp[appID] {
+		health.Instances = append(health.Instances, status)
+		if status.Status == HealthPassing {
+			passing++
+		}
+	}
+	sort.Slice(health.Instances, func(i, j int) bool {
+		return health.Instances[i].Address < health.Instances[j].Address
+	})
+	switch {
+	case len(health.Instances) == 0:
+	case passing == len(health.Instances):
+		health.Status = HealthPassing
+	case passing == 0:
+		health.Status = HealthFailing
+	default:
+		health.Status = HealthWarning
+	}
+	return health
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := closed.Addr().String()
+	closed.Close()
+
+	for _, tc := range []struct {
+		check   HealthCheck
+		address string
+		want    string
+	}{
+		{HealthCheck{Type: CheckHTTP, Path: "/healthz", ExpectedStatus: http.StatusOK}, address, HealthPassing},
+		{HealthCheck{Type: CheckHTTP, Path: "/other", ExpectedStatus: http.StatusOK}, address, HealthFailing},
+		{HealthCheck{Type: CheckHTTP, Path: "/other", ExpectedStatus: http.StatusServiceUnavailable}, address, HealthPassing},
+		{HealthCheck{Type: CheckTCP}, address, HealthPassing},
+		{HealthCheck{Type: CheckTCP}, closedAddress, HealthFailing},
+	} {
+		status := probe(tc.check, tc.address)
+		if status.Status != tc.want {
+			t.Errorf("probe %+v of %s returned %s (%s), want %s", tc.check, tc.address, status.Status, status.LastError, tc.want)
+		}
+		if tc.want == HealthFailing && status.LastError == "" {
+			t.Errorf("probe %+v of %s failed without an error", tc.check, tc.address)
+		}
+	}
+
+	// Endpoints registered without a leading slash are probed as paths
+	check := healthCheckOf(App{Endpoint: "healthz"})
+	if status := probe(check, address); check.Path != "/healthz" || status.Status != HealthPassing {
+		t.Errorf("probe of endpoint healthz used path %q and returned %s (%s)", check.Path, status.Status, status.LastError)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	clearDatabase()
+	healthWorkers = 2
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "health1")
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	upAddress, downAddress := strings.TrimPrefix(up.URL, "http://"), strings.TrimPrefix(down.URL, "http://")
+
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", upAddress)
+	for _, address := range []string{upAddress, downAddress} {
+		if _, err := db.Exec("INSERT INTO app_instances (app_id, address) VALUES (?, ?)", appID, address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
+	if err := checkHealth(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the failing instance changes what discovery returns
+	select {
+	case event := <-feed:
+		data, _ := event.Data.(healthEvent)
+		if event.Type != EventInstanceHealthChanged || data.Address != downAddress || data.Status != HealthFailing {
+			t.Errorf("health checker published unexpected event: %+v", event)
+		}
+	default:
+		t.Errorf("health checker did not publish an event for the failing instance")
+	}
+	select {
+	case event := <-feed:
+		t.Errorf("health checker published an event for the passing instance: %+v", event)
+	default:
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", getApps).Methods("GET")
+	router.HandleFunc("/apps", createApp).Methods("POST")
+	router.HandleFunc("/resolve", resolveApp).Methods("GET")
+
+	req, _ := http.NewRequest("GET", "/apps", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	var apps []App
+	json.Unmarshal(rr.Body.Bytes(), &apps)
+	if len(apps) != 1 || apps[0].Health == nil || apps[0].Health.Status != HealthWarning || len(apps[0].Health.Instances) != 2 {
+		t.Fatalf("handler returned unexpected health: %+v", apps)
+	}
+
+	// Discovery leaves out the failing instance unless asked not to
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"workspace=health1&app=billing", 1},
+		{"workspace=health1&app=billing&include_unhealthy=true", 2},
+	} {
+		req, _ := http.NewRequest("GET", "/resolve?"+tc.query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, owner))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var resolution Resolution
+		json.Unmarshal(rr.Body.Bytes(), &resolution)
+		if len(resolution.Instances) != tc.want {
+			t.Errorf("%s: handler returned %d instances, want %d", tc.query, len(resolution.Instances), tc.want)
+		}
+		if tc.want == 1 && resolution.IPPort != upAddress {
+			t.Errorf("%s: handler resolved to %s, want %s", tc.query, resolution.IPPort, upAddress)
+		}
+	}
+
+	body := `{"name": "bad", "ip_port": "10.0.0.1:80", "workspace_id": ` + strconv.Itoa(workspaceID) + `, "health_check": {"type": "icmp"}}`
+	req, _ = http.NewRequest("POST", "/apps", bytes.NewBufferString(body))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Load balancing strategies accepted by the resolve endpoint
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyWeighted   = "weighted"
+	StrategyRandom     = "random"
+)
+
+var (
+	errNoHealthyInstances = errors.New("no healthy instances")
+	errUnknownStrategy    = errors.New("unknown load balancing strategy")
+)
+
+// Instance is one replica of an app. An app without registered instances is
+// served by a single implicit instance at its ip_port, which has ID 0.
+//
+// An instance with a TTL (in seconds) has to send a heartbeat at least that
+// often. Once it misses one the reaper marks it unhealthy, and once it has
+// been silent for deregisterAfter on top of that it is deregistered.
+type Instance struct {
+	ID            int               `json:"id"`
+	AppID         int               `json:"app_id"`
+	Address       string            `json:"address"`
+	Weight        int               `json:"weight"`
+	Zone          string            `json:"zone"`
+	Metadata      map[string]string `json:"metadata"`
+	Healthy       bool              `json:"healthy"`
+	TTL           int               `json:"ttl"`
+	LastHeartbeat *time.Time        `json:"last_heartbeat,omitempty"`
+	Health        *HealthStatus     `json:"health,omitempty"`
+}
+
+// expiresAt returns when the instance's TTL runs out, if it has one.
+func (i Instance) expiresAt() (time.Time, bool) {
+	if i.TTL <= 0 || i.LastHeartbeat == nil {
+		return time.Time{}, false
+	}
+	return i.LastHeartbeat.Add(time.Duration(i.TTL) * time.Second), true
+}
+
+var (
+	reapInterval    time.Duration
+	deregisterAfter time.Duration
+)
+
+// roundRobin remembers the next instance to hand out per app.
+var roundRobin = struct {
+	sync.Mutex
+	next map[int]int
+}{next: make(map[int]int)}
+
+const instanceColumns = "id, app_id, address, weight, zone, metadata, healthy, ttl, last_heartbeat"
+
+func scanInstance(row rowScanner) (Instance, error) {
+	var instance Instance
+	var metadata string
+	var lastHeartbeat sql.NullTime
+	err := row.Scan(&instance.ID, &instance.AppID, &instance.Address, &instance.Weight, &instance.Zone, &metadata, &instance.Healthy, &instance.TTL, &lastHeartbeat)
+	if err != nil {
+		return instance, err
+	}
+	if lastHeartbeat.Valid {
+		instance.LastHeartbeat = &lastHeartbeat.Time
+	}
+	instance.Metadata = map[string]string{}
+	json.Unmarshal([]byte(metadata), &instance.Metadata)
+	return instance, nil
+}
+
+// appInstances returns every instance of app along with the latest health
+// check of each.
+func appInstances(app App) ([]Instance, error) {
+	instances, err := registeredInstances(app)
+	if err != nil {
+		return nil, err
+	}
+	for i := range instances {
+		if status, ok := healthOf(app.ID, instances[i].Address); ok {
+			instances[i].Health = &status
+		}
+	}
+	return instances, nil
+}
+
+// registeredInstances returns every instance of app, falling back to the
+// implicit instance at its ip_port when none are registered.
+func registeredInstances(app App) ([]Instance, error) {
+	rows, err := db.Query("SELECT "+instanceColumns+" FROM app_instances WHERE app_id = ? ORDER BY id", app.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	instances := []Instance{}
+	for rows.Next() {
+		instance, err := scanInstance(rows)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(instances) == 0 && app.IPPort != "" {
+		instances = append(instances, Instance{AppID: app.ID, Address: app.IPPort, Weight: 1, Metadata: map[string]string{}, Healthy: true})
+	}
+	return instances, nil
+}
+
+// healthyInstances leaves out instances that missed their heartbeat or are
+// failing their health check.
+func healthyInstances(instances []Instance) []Instance {
+	healthy := []Instance{}
+	for _, instance := range instances {
+		if instance.Healthy && (instance.Health == nil || instance.Health.Status != HealthFailing) {
+			healthy = append(healthy, instance)
+		}
+	}
+	return healthy
+}
+
+// pickInstance chooses one of the given healthy instances of an app.
+func pickInstance(appID int, instances []Instance, strategy string) (Instance, error) {
+	if len(instances) == 0 {
+		return Instance{}, errNoHealthyInstances
+	}
+
+	switch strategy {
+	case StrategyRoundRobin:
+		roundRobin.Lock()
+		defer roundRobin.Unlock()
+		i := roundRobin.next[appID] % len(instances)
+		roundRobin.next[appID] = i + 1
+		return instances[i], nil
+	case StrategyWeighted:
+		total := 0
+		for _, instance := range instances {
+			total += instance.Weight
+		}
+		if total <= 0 {
+			return instances[rand.Intn(len(instances))], nil
+		}
+		n := rand.Intn(total)
+		for _, instance := range instances {
+			if n < instance.Weight {
+				return instance, nil
+			}
+			n -= instance.Weight
+		}
+	case StrategyRandom:
+		return instances[rand.Intn(len(instances))], nil
+	}
+	return Instance{}, errUnknownStrategy
+}
+
+// validateInstance checks an instance from a request body and fills in defaults.
+func validateInstance(instance *Instance) error {
+	if _, _, err := net.SplitHostPort(instance.Address); err != nil {
+		return errors.New("address must be host:port")
+	}
+	if instance.Weight <= 0 {
+		instance.Weight = 1
+	}
+	if instance.TTL < 0 {
+		return errors.New("ttl must not be negative")
+	}
+	if instance.Metadata == nil {
+		instance.Metadata = map[string]string{}
+	}
+	return nil
+}
+
+var instanceList = listSpec{
+	sorts: map[string]string{
+		"id":      "id",
+		"address": "address",
+		"zone":    "zone",
+		"weight":  "weight",
+	},
+	defaultSort: "id",
+}
+
+// getInstances lists the instances of an app with their latest health checks:
+// GET /apps/{id}/instances
+// It takes the sort and page parameters described on listSpec. An app without
+// registered instances lists its implicit instance.
+func getInstances(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	app, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", params["id"]))
+	if err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+
+	q, err := parseList(r, instanceList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.where("app_id = ?", app.ID)
+	rows, err := q.run(instanceColumns, q.filtered("app_instances"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	instances := []Instance{}
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
+		instance, err := scanInstance(row)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if status, ok := healthOf(app.ID, instance.Address); ok {
+			instance.Health = &status
+		}
+		instances = append(instances, instance)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if len(instances) == 0 && q.after == nil {
+		// Nothing is registered, so list the implicit instance at ip_port
+		if instances, err = appInstances(app); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	q.writeNextPage(w)
+	json.NewEncoder(w).Encode(instances)
+}
+
+func getInstance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	instance, err := scanInstance(db.QueryRow("SELECT "+instanceColumns+" FROM app_instances WHERE id = ? AND app_id = ?", params["instance_id"], params["id"]))
+	if err != nil {
+		writeDBError(w, "Instance", err)
+		return
+	}
+	if status, ok := healthOf(instance.AppID, instance.Address); ok {
+		instance.Health = &status
+	}
+	json.NewEncoder(w).Encode(instance)
+}
+
+func createInstance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var instance Instance
+	if err := json.NewDecoder(r.Body).Decode(&instance); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateInstance(&instance); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := db.QueryRow("SELECT id FROM apps WHERE id = ?", params["id"]).Scan(&instance.AppID); err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	metadata, _ := json.Marshal(instance.Metadata)
+	result, err := db.Exec("INSERT INTO app_instances (app_id, address, weight, zone, metadata, ttl, last_heartbeat) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		instance.AppID, instance.Address, instance.Weight, instance.Zone, string(metadata), instance.TTL, now)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	instance.ID = int(id)
+	instance.Healthy = true
+	instance.LastHeartbeat = &now
+	events.publish(Event{Type: EventInstanceRegistered, WorkspaceID: workspaceOfApp(instance.AppID), Data: instance})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(instance)
+}
+
+func updateInstance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var instance Instance
+	if err := json.NewDecoder(r.Body).Decode(&instance); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateInstance(&instance); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metadata, _ := json.Marshal(instance.Metadata)
+	err := execIfMatch(db, r, "UPDATE app_instances SET address = ?, weight = ?, zone = ?, metadata = ?, ttl = ?, revision = revision + 1 WHERE id = ? AND app_id = ?",
+		instance.Address, instance.Weight, instance.Zone, string(metadata), instance.TTL, params["instance_id"], params["id"])
+	if err != nil {
+		writeDBError(w, "Instance", err)
+		return
+	}
+
+	instance, err = scanInstance(db.QueryRow("SELECT "+instanceColumns+" FROM app_instances WHERE id = ?", params["instance_id"]))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	events.publish(Event{Type: EventInstanceUpdated, WorkspaceID: workspaceOfApp(instance.AppID), Data: instance})
+	json.NewEncoder(w).Encode(instance)
+}
+
+func deleteInstance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	err := execIfMatch(db, r, "DELETE FROM app_instances WHERE id = ? AND app_id = ?", params["instance_id"], params["id"])
+	if err != nil {
+		writeDBError(w, "Instance", err)
+		return
+	}
+	appID, _ := strconv.Atoi(params["id"])
+	id, _ := strconv.Atoi(params["instance_id"])
+	events.publish(Event{Type: EventInstanceDeregistered, WorkspaceID: workspaceOfApp(appID), Data: deleted{id}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// heartbeatInstance renews an instance's TTL and marks it healthy again if it
+// had expired but not yet been deregistered. Heartbeats do not take If-Match,
+// even with -require-if-match, but they do move the instance's ETag on.
+func heartbeatInstance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	err = rowsAffected(tx.Exec("UPDATE app_instances SET last_heartbeat = ?, revision = revision + 1 WHERE id = ? AND app_id = ?",
+		time.Now().UTC(), params["instance_id"], params["id"]))
+	if err != nil {
+		writeDBError(w, "Instance", err)
+		return
+	}
+	// Only the heartbeat that brings an expired instance back reports it
+	result, err := tx.Exec("UPDATE app_instances SET healthy = 1 WHERE id = ? AND app_id = ? AND healthy = 0", params["instance_id"], params["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	recovered, _ := result.RowsAffected()
+
+	instance, err := scanInstance(tx.QueryRow("SELECT "+instanceColumns+" FROM app_instances WHERE id = ? AND app_id = ?", params["instance_id"], params["id"]))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if revision, err := resourceRevision("app_instances", instance.ID); err == nil {
+		w.Header().Set("ETag", etag(revision))
+	}
+	if recovered > 0 {
+		events.publish(Event{Type: EventInstanceRecovered, WorkspaceID: workspaceOfApp(instance.AppID), Data: instance})
+	}
+	json.NewEncoder(w).Encode(instance)
+}
+
+// reapInstances marks instances whose TTL ran out before now as unhealthy and
+// deregisters the ones that have been expired for longer than deregisterAfter.
+func reapInstances(now time.Time) error {
+	expired, dead, err := expiredInstances(now)
+	if err != nil {
+		return err
+	}
+	return reap(expired, dead)
+}
+
+// expiredInstances lists the healthy instances whose TTL ran out before now
+// and the instances that have been expired for longer than deregisterAfter.
+func expiredInstances(now time.Time) (expired, dead []Instance, err error) {
+	rows, err := db.Query("SELECT " + instanceColumns + " FROM app_instances WHERE ttl > 0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		instance, err := scanInstance(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		expiresAt, ok := instance.expiresAt()
+		switch {
+		case !ok || !now.After(expiresAt):
+		case now.After(expiresAt.Add(deregisterAfter)):
+			dead = append(dead, instance)
+		case instance.Healthy:
+			expired = append(expired, instance)
+		}
+	}
+	return expired, dead, rows.Err()
+}
+
+// reap marks expired instances unhealthy and deregisters dead ones, leaving
+// out any that sent a heartbeat since they were listed.
+func reap(expired, dead []Instance) error {
+	for _, instance := range expired {
+		result, err := db.Exec("UPDATE app_instances SET healthy = 0, revision = revision + 1 WHERE id = ? AND last_heartbeat = ?", instance.ID, *instance.LastHeartbeat)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		instance.Healthy = false
+		events.publish(Event{Type: EventInstanceExpired, WorkspaceID: workspaceOfApp(instance.AppID), Data: instance})
+	}
+	for _, instance := range dead {
+		result, err := db.Exec("DELETE FROM app_instances WHERE id = ? AND last_heartbeat = ?", instance.ID, *instance.LastHeartbeat)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		instance.Healthy = false
+		events.publish(Event{Type: EventInstanceDeregistered, WorkspaceID: workspaceOfApp(instance.AppID), Data: instance})
+	}
+	return nil
+}
+
+func workspaceOfApp(appID int) int {
+	var workspaceID int
+	db.QueryRow("SELECT COALESCE(workspace_id, 0) FROM apps WHERE id = ?", appID).Scan(&workspaceID)
+	return workspaceID
+}
+
+// runReaper calls reapInstances every reapInterval until the process exits.
+func runReaper() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := reapInstances(now.UTC()); err != nil {
+			log.Printf("Reaping instances failed: %v", err)
+		}
+	}
+}
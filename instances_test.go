@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPickInstance(t *testing.T) {
+	instances := []Instance{
+		{ID: 1, Address: "10.0.0.1:80", Weight: 1},
+		{ID: 2, Address: "10.0.0.2:80", Weight: 3},
+		{ID: 3, Address: "10.0.0.3:80", Weight: 0},
+	}
+
+	for i := 0; i < 6; i++ {
+		instance, err := pickInstance(-1, instances, StrategyRoundRobin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instance.ID != instances[i%3].ID {
+			t.Errorf("round-robin pick %d returned instance %d, want %d", i, instance.ID, instances[i%3].ID)
+		}
+	}
+
+	counts := map[int]int{}
+	for i := 0; i < 4000; i++ {
+		instance, err := pickInstance(-1, instances, StrategyWeighted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[instance.ID]++
+	}
+	if counts[3] != 0 {
+		t.Errorf("weighted picked an instance with weight 0 %d times", counts[3])
+	}
+	if counts[2] < 2*counts[1] {
+		t.Errorf("weighted picks not proportional to weight: %v", counts)
+	}
+
+	if _, err := pickInstance(-1, nil, StrategyRandom); err != errNoHealthyInstances {
+		t.Errorf("pickInstance without instances returned %v, want %v", err, errNoHealthyInstances)
+	}
+	if _, err := pickInstance(-1, instances, "fastest"); err != errUnknownStrategy {
+		t.Errorf("pickInstance with unknown strategy returned %v, want %v", err, errUnknownStrategy)
+	}
+}
+
+func TestAppInstances(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "instances1")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8000")
+	path := "/apps/" + strconv.Itoa(appID) + "/instances"
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps/{id:[0-9]+}/instances", getInstances).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances", createInstance).Methods("POST")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}", updateInstance).Methods("PUT")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}", deleteInstance).Methods("DELETE")
+	router.HandleFunc("/resolve", resolveApp).Methods("GET")
+
+	list := func() []Instance {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, owner))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var instances []Instance
+		json.Unmarshal(rr.Body.Bytes(), &instances)
+		return instances
+	}
+
+	// Without registered instances the app's own ip_port is its only instance
+	if instances := list(); len(instances) != 1 || instances[0].Address != "10.0.0.1:8000" || instances[0].ID != 0 {
+		t.Errorf("handler returned unexpected implicit instances: %v", instances)
+	}
+
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{"address": "not-an-address"}`))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	var created []Instance
+	for _, body := range []string{
+		`{"address": "10.0.0.2:8000", "weight": 2, "zone": "eu-west-1a", "metadata": {"canary": "true"}}`,
+		`{"address": "10.0.0.3:8000"}`,
+	} {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, owner))
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+		var instance Instance
+		json.Unmarshal(rr.Body.Bytes(), &instance)
+		created = append(created, instance)
+	}
+	if created[1].Weight != 1 || !created[1].Healthy {
+		t.Errorf("handler did not fill in instance defaults: %v", created[1])
+	}
+
+	instances := list()
+	if len(instances) != 2 || instances[0].Zone != "eu-west-1a" || instances[0].Metadata["canary"] != "true" {
+		t.Errorf("handler returned unexpected instances: %v", instances)
+	}
+
+	req, _ = http.NewRequest("PUT", path+"/"+strconv.Itoa(created[1].ID), bytes.NewBufferString(`{"address": "10.0.0.4:8000", "weight": 5}`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Round-robin resolution alternates between the registered instances
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "/resolve?workspace=instances1&app=billing&strategy=round-robin", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, owner))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var resolution Resolution
+		json.Unmarshal(rr.Body.Bytes(), &resolution)
+		if len(resolution.Instances) != 2 || resolution.Instance == nil || resolution.Instance.Address != resolution.IPPort {
+			t.Fatalf("handler returned unexpected resolution: %+v", resolution)
+		}
+		seen[resolution.IPPort]++
+	}
+	if seen["10.0.0.2:8000"] != 2 || seen["10.0.0.4:8000"] != 2 {
+		t.Errorf("round-robin did not alternate between instances: %v", seen)
+	}
+
+	req, _ = http.NewRequest("GET", "/resolve?workspace=instances1&app=billing&strategy=fastest", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	for _, instance := range created {
+		req, _ := http.NewRequest("DELETE", path+"/"+strconv.Itoa(instance.ID), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, owner))
+		if status := rr.Code; status != http.StatusNoContent {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+		}
+	}
+	if instances := list(); len(instances) != 1 || instances[0].Address != "10.0.0.1:8000" {
+		t.Errorf("handler did not fall back to the implicit instance: %v", instances)
+	}
+}
+
+func TestReapInstances(t *testing.T) {
+	clearDatabase()
+	deregisterAfter = time.Minute
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "reaper1")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8000")
+	path := "/apps/" + strconv.Itoa(appID) + "/instances"
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps/{id:[0-9]+}/instances", createInstance).Methods("POST")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}/heartbeat", heartbeatInstance).Methods("PUT")
+
+	var instances []Instance
+	for _, body := range []string{`{"address": "10.0.0.2:8000", "ttl": 10}`, `{"address": "10.0.0.3:8000"}`} {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, owner))
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+		var instance Instance
+		json.Unmarshal(rr.Body.Bytes(), &instance)
+		instances = append(instances, instance)
+	}
+	ttl, forever := instances[0], instances[1]
+
+	healthy := func(id int) (bool, bool) {
+		var healthy bool
+		err := db.QueryRow("SELECT healthy FROM app_instances WHERE id = ?", id).Scan(&healthy)
+		return healthy, err == nil
+	}
+
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
+
+	if err := reapInstances(ttl.LastHeartbeat.Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := healthy(ttl.ID); !ok {
+		t.Errorf("instance expired before its TTL ran out")
+	}
+
+	if err := reapInstances(ttl.LastHeartbeat.Add(15 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := healthy(ttl.ID); ok {
+		t.Errorf("instance was not marked unhealthy after its TTL ran out")
+	}
+	select {
+	case event := <-feed:
+		if event.Type != EventInstanceExpired || event.WorkspaceID != workspaceID {
+			t.Errorf("reaper published unexpected event: %+v", event)
+		}
+	default:
+		t.Errorf("reaper did not publish an event for the expired instance")
+	}
+
+	// A heartbeat brings the instance back
+	req, _ := http.NewRequest("PUT", path+"/"+strconv.Itoa(ttl.ID)+"/heartbeat", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if ok, _ := healthy(ttl.ID); !ok {
+		t.Errorf("heartbeat did not mark the instance healthy")
+	}
+	select {
+	case event := <-feed:
+		if event.Type != EventInstanceRecovered || event.WorkspaceID != workspaceID {
+			t.Errorf("heartbeat published unexpected event: %+v", event)
+		}
+	default:
+		t.Errorf("heartbeat did not publish an event for the recovered instance")
+	}
+
+	// A heartbeat sent through another app leaves the instance alone
+	var revision int
+	db.QueryRow("SELECT revision FROM app_instances WHERE id = ?", forever.ID).Scan(&revision)
+	otherApp := createTestApp(t, workspaceID, "search", "1.0.0", "10.0.0.4:8000")
+	sendAs(t, router, owner, "PUT", "/apps/"+strconv.Itoa(otherApp)+"/instances/"+strconv.Itoa(forever.ID)+"/heartbeat", nil, http.StatusNotFound)
+	var after int
+	db.QueryRow("SELECT revision FROM app_instances WHERE id = ?", forever.ID).Scan(&after)
+	if after != revision {
+		t.Errorf("heartbeat through another app changed the instance")
+	}
+
+	if err := reapInstances(time.Now().Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := healthy(ttl.ID); exists {
+		t.Errorf("instance was not deregistered after staying expired")
+	}
+	if ok, exists := healthy(forever.ID); !ok || !exists {
+		t.Errorf("instance without a TTL was reaped")
+	}
+	select {
+	case event := <-feed:
+		if event.Type != EventInstanceDeregistered {
+			t.Errorf("reaper published unexpected event: %+v", event)
+		}
+	default:
+		t.Errorf("reaper did not publish an event for the deregistered instance")
+	}
+
+	req, _ = http.NewRequest("PUT", path+"/"+strconv.Itoa(ttl.ID)+"/heartbeat", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestReaperSkipsHeartbeatsSinceScan(t *testing.T) {
+	clearDatabase()
+	deregisterAfter = time.Minute
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "reaper2")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8000")
+
+	now := time.Now().UTC()
+	var ids []int
+	for _, lastHeartbeat := range []time.Time{now.Add(-30 * time.Second), now.Add(-time.Hour)} {
+		result, err := db.Exec("INSERT INTO app_instances (app_id, address, ttl, last_heartbeat) VALUES (?, ?, ?, ?)", appID, "10.0.0.2:8000", 10, lastHeartbeat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		ids = append(ids, int(id))
+	}
+
+	expired, dead, err := expiredInstances(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || len(dead) != 1 {
+		t.Fatalf("got %d expired and %d dead instances, want 1 and 1", len(expired), len(dead))
+	}
+
+	// Both instances send a heartbeat before the reaper writes
+	router := mux.NewRouter()
+	router.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}/heartbeat", heartbeatInstance).Methods("PUT")
+	for _, id := range ids {
+		sendAs(t, router, owner, "PUT", fmt.Sprintf("/apps/%d/instances/%d/heartbeat", appID, id), nil, http.StatusOK)
+	}
+
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
+	if err := reap(expired, dead); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		var healthy bool
+		if err := db.QueryRow("SELECT healthy FROM app_instances WHERE id = ?", id).Scan(&healthy); err != nil {
+			t.Errorf("instance %d was deregistered after its heartbeat: %v", id, err)
+		} else if !healthy {
+			t.Errorf("instance %d was marked unhealthy after its heartbeat", id)
+		}
+	}
+	if len(feed) != 0 {
+		t.Errorf("reaper published %+v for instances that sent a heartbeat", <-feed)
+	}
+
+	// Without a heartbeat the expiry moves the instance's revision on
+	expired, _, err = expiredInstances(time.Now().UTC().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := resourceRevision("app_instances", expired[0].ID)
+	if err := reap(expired, nil); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := resourceRevision("app_instances", expired[0].ID); after != before+1 {
+		t.Errorf("expiry left the instance at revision %d, want %d", after, before+1)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// readPayload reads a request body to be validated, which must fit in
+// maxReplayBody.
+func readPayload(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxReplayBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	if len(body) > maxReplayBody {
+		writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return nil, false
+	}
+	return body, true
+}
+
+// validateAppPayload checks the request body against the app's input schema,
+// or its output schema with ?schema=output.
+func validateAppPayload(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	app, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", params["id"]))
+	if err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+
+	schema := app.InputSchema
+	switch r.URL.Query().Get("schema") {
+	case "", "input":
+	case "output":
+		schema = app.OutputSchema
+	default:
+		writeError(w, http.StatusBadRequest, "schema must be input or output")
+		return
+	}
+
+	body, ok := readPayload(w, r)
+	if !ok {
+		return
+	}
+	result, err := validatePayload(schema, body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// invokeApp validates the request body against the app's input schema and
+// POSTs it to the endpoint of one of the app's healthy instances. The
+// response, which must also fit in maxReplayBody, is passed on; with
+// ?validate_output=true a successful one is first checked against the output
+// schema. A stored schema that does not compile is a server fault.
+func invokeApp(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	app, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", params["id"]))
+	if err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+
+	body, ok := readPayload(w, r)
+	if !ok {
+		return
+	}
+	result, err := validatePayload(app.InputSchema, body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !result.Valid {
+		writeSchemaErrors(w, http.StatusUnprocessableEntity, "Request does not match the input schema", result.Errors)
+		return
+	}
+
+	instances, err := appInstances(app)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	instance, err := pickInstance(app.ID, healthyInstances(instances), StrategyRoundRobin)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "No healthy instances")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "http://"+instance.Address+absolutePath(app.Endpoint), bytes.NewReader(body))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Unlike the proxy, which streams, invoke buffers the response, so
+	// -proxy-timeout limits the whole call rather than only the headers
+	client := &http.Client{Timeout: proxyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Invoking app %d at %s failed: %v", app.ID, instance.Address, err)
+		writeError(w, http.StatusBadGateway, "Upstream unavailable")
+		return
+	}
+	defer resp.Body.Close()
+
+	output, err := io.ReadAll(io.LimitReader(resp.Body, maxReplayBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Upstream unavailable")
+		return
+	}
+	if len(output) > maxReplayBody {
+		writeError(w, http.StatusBadGateway, "Upstream response too large")
+		return
+	}
+	if r.URL.Query().Get("validate_output") == "true" && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		result, err := validatePayload(app.OutputSchema, output)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !result.Valid {
+			writeSchemaErrors(w, http.StatusBadGateway, "Response does not match the output schema", result.Errors)
+			return
+		}
+	}
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Del("Content-Length")
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(output)
+}
+
+// absolutePath adds the leading slash that an app's endpoint may be
+// registered without.
+func absolutePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
@@ -0,0 +1,975 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errNoAvailableIPs = errors.New("no available IPs")
+	errUnknownPool    = errors.New("unknown IP pool")
+)
+
+// IPPool is a CIDR range that workspace addresses are leased from. Leases
+// live in the ip_leases table, so allocations survive restarts and are made
+// in the same transaction as the workspace row that owns them. Pools are
+// read from the ip_pools table on every allocation, so pools added at
+// runtime are used straight away.
+type IPPool struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	CIDR     string   `json:"cidr"`
+	Gateway  string   `json:"gateway,omitempty"`
+	Excluded []string `json:"excluded"`
+
+	prefix   netip.Prefix
+	reserved []addrRange
+}
+
+// PoolUsage reports how much of a pool is leased. Counts are arbitrary
+// precision because IPv6 pools easily exceed 64 bits.
+type PoolUsage struct {
+	IPPool
+	Total       *big.Int `json:"total"`
+	Used        int      `json:"used"`
+	Available   *big.Int `json:"available"`
+	Utilization float64  `json:"utilization"`
+}
+
+// IPLease is an address leased to a workspace.
+type IPLease struct {
+	IP          string    `json:"ip"`
+	WorkspaceID int       `json:"workspace_id"`
+	Workspace   string    `json:"workspace"`
+	Subdomain   string    `json:"subdomain"`
+	Pool        string    `json:"pool"`
+	AllocatedAt time.Time `json:"allocated_at"`
+}
+
+// addrRange is an inclusive range of addresses within one family.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+func (r addrRange) size() *big.Int {
+	size := new(big.Int).Sub(addrInt(r.last), addrInt(r.first))
+	return size.Add(size, big.NewInt(1))
+}
+
+func addrInt(addr netip.Addr) *big.Int {
+	b := addr.As16()
+	return new(big.Int).SetBytes(b[:])
+}
+
+// lastAddr returns the highest address in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - uint(i%8))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// parseAddrRange accepts a single address, a CIDR or a "first-last" range.
+func parseAddrRange(s string) (addrRange, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return addrRange{}, err
+		}
+		return addrRange{prefix.Masked().Addr(), lastAddr(prefix)}, nil
+	}
+	if first, last, ok := strings.Cut(s, "-"); ok {
+		a, err := netip.ParseAddr(strings.TrimSpace(first))
+		if err != nil {
+			return addrRange{}, err
+		}
+		b, err := netip.ParseAddr(strings.TrimSpace(last))
+		if err != nil {
+			return addrRange{}, err
+		}
+		if a.Is4() != b.Is4() || b.Less(a) {
+			return addrRange{}, fmt.Errorf("invalid range %q", s)
+		}
+		return addrRange{a, b}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return addrRange{}, err
+	}
+	return addrRange{addr, addr}, nil
+}
+
+// invalidPoolError is a problem with a pool definition, found at the JSON
+// Pointer Path of the offending field.
+type invalidPoolError struct {
+	ValidationError
+}
+
+func (e *invalidPoolError) Error() string {
+	return e.Message
+}
+
+func invalidPool(path, format string, args ...interface{}) error {
+	return &invalidPoolError{ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}}
+}
+
+// parse validates the pool definition and works out which addresses in it
+// may never be leased: the network address, the IPv4 broadcast address, the
+// gateway and any excluded ranges.
+func (p *IPPool) parse() error {
+	prefix, err := netip.ParsePrefix(p.CIDR)
+	if err != nil {
+		return invalidPool("/cidr", "invalid cidr %q", p.CIDR)
+	}
+	p.prefix = prefix.Masked()
+	p.CIDR = p.prefix.String()
+
+	first, last := p.prefix.Addr(), lastAddr(p.prefix)
+	var reserved []addrRange
+	if first.Is4() && p.prefix.Bits() <= 30 {
+		reserved = append(reserved, addrRange{first, first}, addrRange{last, last})
+	} else if first.Is6() && p.prefix.Bits() <= 126 {
+		// The subnet-router anycast address
+		reserved = append(reserved, addrRange{first, first})
+	}
+
+	if p.Gateway != "" {
+		gateway, err := netip.ParseAddr(p.Gateway)
+		if err != nil || !p.prefix.Contains(gateway) {
+			return invalidPool("/gateway", "gateway %q is not inside %s", p.Gateway, p.CIDR)
+		}
+		reserved = append(reserved, addrRange{gateway, gateway})
+	}
+
+	for i, excluded := range p.Excluded {
+		r, err := parseAddrRange(excluded)
+		if err != nil {
+			return invalidPool(fmt.Sprintf("/excluded/%d", i), "invalid excluded range %q", excluded)
+		}
+		if r.first.Is4() != first.Is4() || last.Less(r.first) || r.last.Less(first) {
+			return invalidPool(fmt.Sprintf("/excluded/%d", i), "excluded range %q is not inside %s", excluded, p.CIDR)
+		}
+		// Clip to the pool
+		if r.first.Less(first) {
+			r.first = first
+		}
+		if last.Less(r.last) {
+			r.last = last
+		}
+		reserved = append(reserved, r)
+	}
+
+	// Sort and merge so every address is counted once
+	sort.Slice(reserved, func(i, j int) bool { return reserved[i].first.Less(reserved[j].first) })
+	p.reserved = p.reserved[:0]
+	for _, r := range reserved {
+		n := len(p.reserved)
+		if n > 0 && !p.reserved[n-1].last.Next().Less(r.first) {
+			if p.reserved[n-1].last.Less(r.last) {
+				p.reserved[n-1].last = r.last
+			}
+			continue
+		}
+		p.reserved = append(p.reserved, r)
+	}
+	return nil
+}
+
+// reservedRange returns the reserved range containing addr, if any.
+func (p *IPPool) reservedRange(addr netip.Addr) (addrRange, bool) {
+	for _, r := range p.reserved {
+		if !addr.Less(r.first) && !r.last.Less(addr) {
+			return r, true
+		}
+	}
+	return addrRange{}, false
+}
+
+// size is the number of leasable addresses in the pool.
+func (p *IPPool) size() *big.Int {
+	total := addrRange{p.prefix.Addr(), lastAddr(p.prefix)}.size()
+	for _, r := range p.reserved {
+		total.Sub(total, r.size())
+	}
+	return total
+}
+
+func (p *IPPool) overlaps(other *IPPool) bool {
+	return p.prefix.Overlaps(other.prefix)
+}
+
+// allocate leases the first free address in the pool to a workspace within tx.
+func (p *IPPool) allocate(tx *sql.Tx, leased map[string]bool, workspaceID int) (string, error) {
+	for addr := p.prefix.Addr(); p.prefix.Contains(addr); addr = addr.Next() {
+		if r, ok := p.reservedRange(addr); ok {
+			addr = r.last
+			continue
+		}
+		ip := addr.String()
+		if leased[ip] {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO ip_leases (ip, workspace_id, pool_id) VALUES (?, ?, ?)", ip, workspaceID, p.ID); err != nil {
+			return "", err
+		}
+		leased[ip] = true
+		return ip, nil
+	}
+	return "", errNoAvailableIPs
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+const poolColumns = "id, name, cidr, gateway, excluded"
+
+func loadPools(q queryer, where string, args ...interface{}) ([]*IPPool, error) {
+	rows, err := q.Query("SELECT "+poolColumns+" FROM ip_pools "+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pools := []*IPPool{}
+	for rows.Next() {
+		pool, err := scanPool(rows)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	return pools, rows.Err()
+}
+
+func scanPool(row rowScanner) (*IPPool, error) {
+	var pool IPPool
+	var excluded string
+	if err := row.Scan(&pool.ID, &pool.Name, &pool.CIDR, &pool.Gateway, &excluded); err != nil {
+		return nil, err
+	}
+	pool.Excluded = []string{}
+	if excluded != "" {
+		pool.Excluded = strings.Split(excluded, ",")
+	}
+	if err := pool.parse(); err != nil {
+		return nil, fmt.Errorf("pool %s: %v", pool.Name, err)
+	}
+	return &pool, nil
+}
+
+func leasedIPs(tx *sql.Tx) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT ip FROM ip_leases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leased := make(map[string]bool)
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		leased[ip] = true
+	}
+	return leased, rows.Err()
+}
+
+// allocateIP leases a free address to a workspace within tx, from the named
+// pool or, if poolName is empty, from the first pool with room. The lease is
+// only kept if tx commits.
+func allocateIP(tx *sql.Tx, workspaceID int, poolName string) (string, error) {
+	var pools []*IPPool
+	var err error
+	if poolName != "" {
+		pools, err = loadPools(tx, "WHERE name = ?", poolName)
+		if err == nil && len(pools) == 0 {
+			err = errUnknownPool
+		}
+	} else {
+		pools, err = loadPools(tx, "")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	leased, err := leasedIPs(tx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pool := range pools {
+		ip, err := pool.allocate(tx, leased, workspaceID)
+		if err == errNoAvailableIPs {
+			continue
+		}
+		return ip, err
+	}
+	return "", errNoAvailableIPs
+}
+
+// releaseWorkspaceIPs drops every lease held by a workspace within tx and
+// returns the ip.released events to publish once tx commits.
+func releaseWorkspaceIPs(tx *sql.Tx, workspaceID int) ([]Event, error) {
+	released, err := releasedIPEvents(tx, "workspace_id = ?", workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM ip_leases WHERE workspace_id = ?", workspaceID)
+	return released, err
+}
+
+// releasedIPEvents lists an ip.released event for each lease matching where,
+// ahead of deleting them within tx.
+func releasedIPEvents(tx *sql.Tx, where string, args ...interface{}) ([]Event, error) {
+	rows, err := tx.Query("SELECT ip, workspace_id FROM ip_leases WHERE "+where+" ORDER BY allocated_at, rowid", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var released []Event
+	for rows.Next() {
+		var ip string
+		var workspaceID int
+		if err := rows.Scan(&ip, &workspaceID); err != nil {
+			return nil, err
+		}
+		released = append(released, Event{Type: EventIPReleased, WorkspaceID: workspaceID, Data: ipEvent{ip}})
+	}
+	return released, rows.Err()
+}
+
+// syncWorkspaceIPs rewrites the ips column of a workspace from its leases
+// within tx and returns the workspace's IPs in allocation order.
+func syncWorkspaceIPs(tx *sql.Tx, workspaceID int) ([]string, error) {
+	rows, err := tx.Query("SELECT ip FROM ip_leases WHERE workspace_id = ? ORDER BY allocated_at, rowid", workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE workspaces SET ips = ?, revision = revision + 1 WHERE id = ?", strings.Join(ips, ","), workspaceID)
+	return ips, err
+}
+
+// splitIPs parses the comma-joined ips column.
+func splitIPs(ips string) []string {
+	if ips == "" {
+		return []string{}
+	}
+	return strings.Split(ips, ",")
+}
+
+// subdomainAttempts is how many generated subdomains insertWorkspace tries
+// before giving up.
+const subdomainAttempts = 5
+
+// insertWorkspace creates the workspace row and leases its first IP within tx.
+// A workspace without a subdomain gets a generated one, which the UNIQUE
+// constraint on the column keeps from being taken twice.
+func insertWorkspace(tx *sql.Tx, workspace *Workspace) error {
+	if workspace.SchemaPolicy == "" {
+		workspace.SchemaPolicy = SchemaPolicyAllow
+	}
+	generate := workspace.Subdomain == ""
+	var result sql.Result
+	var err error
+	for attempt := 1; ; attempt++ {
+		if generate {
+			workspace.Subdomain = generateSubdomain()
+		}
+		result, err = tx.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips, schema_policy) VALUES (?, ?, ?, '', ?)",
+			workspace.Name, workspace.UserID, workspace.Subdomain, workspace.SchemaPolicy)
+		if err == nil || !generate || attempt == subdomainAttempts || !isUniqueViolation(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+	workspace.ID = int(id)
+
+	ip, err := allocateIP(tx, workspace.ID, workspace.Pool)
+	if err != nil {
+		return err
+	}
+	workspace.IPs = []string{ip}
+
+	_, err = tx.Exec("UPDATE workspaces SET ips = ? WHERE id = ?", strings.Join(workspace.IPs, ","), workspace.ID)
+	return err
+}
+
+// writeAllocationError reports a failed insertWorkspace or allocateIP.
+func writeAllocationError(w http.ResponseWriter, err error) {
+	switch err {
+	case errUnknownPool:
+		writeError(w, http.StatusBadRequest, "Unknown IP pool")
+	case errNoAvailableIPs:
+		writeError(w, http.StatusServiceUnavailable, "No IPs available to allocate")
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// savePool validates a pool and inserts it, or updates the pool with the same
+// name when upsert is set. Pools may not overlap. Problems with the pool
+// itself are returned as *invalidPoolError.
+func savePool(pool *IPPool, upsert bool) error {
+	if pool.Name == "" {
+		return invalidPool("/name", "pool name is required")
+	}
+	if pool.Excluded == nil {
+		pool.Excluded = []string{}
+	}
+	if err := pool.parse(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	existing, err := loadPools(tx, "")
+	if err != nil {
+		return err
+	}
+	for _, other := range existing {
+		if other.Name == pool.Name {
+			// Without upsert the insert below fails on the name
+			if upsert {
+				if err := checkLeasesKept(tx, other, pool); err != nil {
+					return err
+				}
+				pool.ID = other.ID
+			}
+			continue
+		}
+		if pool.overlaps(other) {
+			return invalidPool("/cidr", "%s overlaps pool %s (%s)", pool.CIDR, other.Name, other.CIDR)
+		}
+	}
+
+	excluded := strings.Join(pool.Excluded, ",")
+	if pool.ID != 0 {
+		_, err = tx.Exec("UPDATE ip_pools SET cidr = ?, gateway = ?, excluded = ?, revision = revision + 1 WHERE id = ?",
+			pool.CIDR, pool.Gateway, excluded, pool.ID)
+	} else {
+		var result sql.Result
+		result, err = tx.Exec("INSERT INTO ip_pools (name, cidr, gateway, excluded) VALUES (?, ?, ?, ?)",
+			pool.Name, pool.CIDR, pool.Gateway, excluded)
+		if err == nil {
+			id, _ := result.LastInsertId()
+			pool.ID = int(id)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkLeasesKept refuses to redeclare a pool in a way that would strand its
+// leases: a new cidr, or a gateway or exclusion covering a leased address.
+func checkLeasesKept(tx *sql.Tx, old, pool *IPPool) error {
+	rows, err := tx.Query("SELECT ip FROM ip_leases WHERE pool_id = ? ORDER BY ip", old.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var leased []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return err
+		}
+		leased = append(leased, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(leased) > 0 && pool.CIDR != old.CIDR {
+		return invalidPool("/cidr", "pool %s has %d leases, so its cidr cannot change from %s to %s", pool.Name, len(leased), old.CIDR, pool.CIDR)
+	}
+	for _, ip := range leased {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return err
+		}
+		if _, reserved := pool.reservedRange(addr); !reserved {
+			continue
+		}
+		if pool.Gateway != "" && addr == netip.MustParseAddr(pool.Gateway) {
+			return invalidPool("/gateway", "gateway %s of pool %s is leased", ip, pool.Name)
+		}
+		return invalidPool("/excluded", "excluded ranges of pool %s cover leased address %s", pool.Name, ip)
+	}
+	return nil
+}
+
+// loadPoolConfig declares the pools listed in a JSON file, creating or
+// updating them by name.
+func loadPoolConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var pools []IPPool
+	if err := json.Unmarshal(data, &pools); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range pools {
+		if err := savePool(&pools[i], true); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		log.Printf("Declared IP pool %s (%s)", pools[i].Name, pools[i].CIDR)
+	}
+	return nil
+}
+
+func poolUsage(pool *IPPool) (PoolUsage, error) {
+	usage := PoolUsage{IPPool: *pool, Total: pool.size()}
+	err := db.QueryRow("SELECT COUNT(*) FROM ip_leases WHERE pool_id = ?", pool.ID).Scan(&usage.Used)
+	if err != nil {
+		return usage, err
+	}
+	usage.Available = new(big.Int).Sub(usage.Total, big.NewInt(int64(usage.Used)))
+	if usage.Total.Sign() > 0 {
+		ratio, _ := new(big.Float).Quo(new(big.Float).SetInt64(int64(usage.Used)), new(big.Float).SetInt(usage.Total)).Float64()
+		usage.Utilization = ratio
+	}
+	return usage, nil
+}
+
+// restoreAllocations records a lease for every IP stored on a workspace row
+// that does not have one yet, such as rows written before leases were
+// persisted.
+func restoreAllocations() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, ips FROM workspaces")
+	if err != nil {
+		return err
+	}
+
+	owners := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var ips string
+		if err := rows.Scan(&id, &ips); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, ip := range strings.Split(ips, ",") {
+			if ip == "" {
+				continue
+			}
+			if owner, ok := owners[ip]; ok {
+				log.Printf("IP %s is assigned to both workspace %d and workspace %d", ip, owner, id)
+				continue
+			}
+			owners[ip] = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	pools, err := loadPools(tx, "")
+	if err != nil {
+		return err
+	}
+
+	for ip, id := range owners {
+		var owner int
+		err := tx.QueryRow("SELECT workspace_id FROM ip_leases WHERE ip = ?", ip).Scan(&owner)
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := tx.Exec("INSERT INTO ip_leases (ip, workspace_id, pool_id) VALUES (?, ?, ?)", ip, id, poolOf(pools, ip)); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case owner != id:
+			log.Printf("IP %s is recorded on workspace %d but leased to workspace %d", ip, id, owner)
+		}
+	}
+
+	// Attribute leases made before pools were configurable
+	rows, err = tx.Query("SELECT ip FROM ip_leases WHERE pool_id IS NULL")
+	if err != nil {
+		return err
+	}
+	var unpooled []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			rows.Close()
+			return err
+		}
+		unpooled = append(unpooled, ip)
+	}
+	rows.Close()
+	for _, ip := range unpooled {
+		if _, err := tx.Exec("UPDATE ip_leases SET pool_id = ? WHERE ip = ?", poolOf(pools, ip), ip); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// poolOf returns the ID of the pool containing ip, or nil if there is none.
+func poolOf(pools []*IPPool, ip string) interface{} {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	for _, pool := range pools {
+		if pool.prefix.Contains(addr) {
+			return pool.ID
+		}
+	}
+	return nil
+}
+
+var poolList = listSpec{
+	filters: map[string]listFilter{
+		"name_prefix": {"name", filterPrefix},
+	},
+	sorts: map[string]string{
+		"id":   "id",
+		"name": "name",
+	},
+	defaultSort: "id",
+}
+
+// getIPPools lists the IP pools with their utilization:
+// GET /ip-pools[?name_prefix=<prefix>]
+// It takes the sort and page parameters described on listSpec.
+func getIPPools(w http.ResponseWriter, r *http.Request) {
+	q, err := parseList(r, poolList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows, err := q.run(poolColumns, q.filtered("ip_pools"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var pools []*IPPool
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
+		pool, err := scanPool(row)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		pools = append(pools, pool)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rows.Close()
+
+	usages := []PoolUsage{}
+	for _, pool := range pools {
+		usage, err := poolUsage(pool)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		usages = append(usages, usage)
+	}
+
+	q.writeNextPage(w)
+	json.NewEncoder(w).Encode(usages)
+}
+
+func getIPPool(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	pools, err := loadPools(db, "WHERE id = ?", params["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(pools) == 0 {
+		writeError(w, http.StatusNotFound, "IP pool not found")
+		return
+	}
+
+	usage, err := poolUsage(pools[0])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(usage)
+}
+
+func createIPPool(w http.ResponseWriter, r *http.Request) {
+	var pool IPPool
+	if err := json.NewDecoder(r.Body).Decode(&pool); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var invalid *invalidPoolError
+	if err := savePool(&pool, false); errors.As(err, &invalid) {
+		writeValidationError(w, "Invalid IP pool", invalid.ValidationError)
+		return
+	} else if err != nil {
+		writeDBError(w, "IP pool", err)
+		return
+	}
+
+	events.publish(Event{Type: EventIPPoolCreated, Data: pool})
+
+	usage, err := poolUsage(&pool)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(usage)
+}
+
+func deleteIPPool(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	// The write lock taken by the transaction keeps a lease from being
+	// allocated from the pool between counting and deleting
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	var leases int
+	err = tx.QueryRow("SELECT COUNT(*) FROM ip_leases WHERE pool_id = ?", params["id"]).Scan(&leases)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if leases > 0 {
+		writeError(w, http.StatusConflict, "IP pool still has leases")
+		return
+	}
+
+	if err := execIfMatch(tx, r, "DELETE FROM ip_pools WHERE id = ?", params["id"]); err != nil {
+		writeDBError(w, "IP pool", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	events.publish(Event{Type: EventIPPoolDeleted, Data: deleted{id}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leaseRows joins each lease with its workspace and pool, numbering leases by
+// rowid so they can be listed.
+const leaseRows = `(SELECT l.rowid AS id, l.ip, l.workspace_id, w.name AS workspace, w.subdomain, COALESCE(l.pool_id, 0) AS pool_id, COALESCE(p.name, '') AS pool, l.allocated_at
+	FROM ip_leases l
+	JOIN workspaces w ON w.id = l.workspace_id
+	LEFT JOIN ip_pools p ON p.id = l.pool_id)`
+
+var leaseList = listSpec{
+	filters: map[string]listFilter{
+		"workspace_id": {"workspace_id", filterInt},
+		"pool":         {"pool", filterString},
+	},
+	sorts: map[string]string{
+		"id":           "id",
+		"ip":           "ip",
+		"workspace_id": "workspace_id",
+		"pool":         "pool",
+		"pool_id":      "pool_id",
+		"allocated_at": "CAST(allocated_at AS TEXT)",
+	},
+	defaultSort: "pool_id,allocated_at",
+}
+
+// getIPs lists the leases the caller can see:
+// GET /ips[?workspace_id=<id>][&pool=<name>]
+// It takes the sort and page parameters described on listSpec.
+func getIPs(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	q, err := parseList(r, leaseList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Operators see every lease, everyone else only the leases of their workspaces
+	if !isOperator(user) {
+		visible, args := visibleWorkspaces(user)
+		q.where("workspace_id IN ("+visible+")", args...)
+	}
+
+	rows, err := q.run("ip, workspace_id, workspace, subdomain, pool, allocated_at", q.filtered(leaseRows))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	leases := []IPLease{}
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
+		var lease IPLease
+		if err := row.Scan(&lease.IP, &lease.WorkspaceID, &lease.Workspace, &lease.Subdomain, &lease.Pool, &lease.AllocatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		leases = append(leases, lease)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	q.writeNextPage(w)
+	json.NewEncoder(w).Encode(leases)
+}
+
+func addWorkspaceIP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var body struct {
+		Pool string `json:"pool"`
+	}
+	// The body is optional
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	workspace, err := scanWorkspace(tx.QueryRow("SELECT "+workspaceColumns+" FROM workspaces WHERE id = ?", params["id"]))
+	if err != nil {
+		writeDBError(w, "Workspace", err)
+		return
+	}
+
+	ip, err := allocateIP(tx, workspace.ID, body.Pool)
+	if err != nil {
+		writeAllocationError(w, err)
+		return
+	}
+	workspace.IPs, err = syncWorkspaceIPs(tx, workspace.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	events.publish(Event{Type: EventIPAllocated, WorkspaceID: workspace.ID, Data: ipEvent{ip}})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(workspace)
+}
+
+// releaseWorkspaceIP releases one of a workspace's IPs, given in any form,
+// such as an uncompressed IPv6 address. A workspace keeps at least one IP.
+func releaseWorkspaceIP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	addr, err := netip.ParseAddr(params["ip"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid IP address")
+		return
+	}
+	// Leases are stored in canonical form
+	ip := addr.String()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM ip_leases WHERE ip = ? AND workspace_id = ?", ip, params["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "IP is not leased to this workspace")
+		return
+	}
+
+	workspaceID, _ := strconv.Atoi(params["id"])
+	ips, err := syncWorkspaceIPs(tx, workspaceID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(ips) == 0 {
+		writeError(w, http.StatusConflict, "Cannot release the workspace's last IP")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	events.publish(Event{Type: EventIPReleased, WorkspaceID: workspaceID, Data: ipEvent{ip}})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestIPPoolSize(t *testing.T) {
+	for _, tc := range []struct {
+		pool IPPool
+		want int64
+	}{
+		// Network and broadcast are never leased
+		{IPPool{CIDR: "10.1.0.0/24"}, 254},
+		{IPPool{CIDR: "10.1.0.0/24", Gateway: "10.1.0.1"}, 253},
+		{IPPool{CIDR: "10.1.0.0/24", Gateway: "10.1.0.1", Excluded: []string{"10.1.0.0/28", "10.1.0.10-10.1.0.20"}}, 234},
+		{IPPool{CIDR: "10.1.0.0/31"}, 2},
+		// Only the subnet-router anycast address is reserved in IPv6
+		{IPPool{CIDR: "fd00::/120"}, 255},
+		{IPPool{CIDR: "fd00::/120", Excluded: []string{"fd00::80/121"}}, 127},
+	} {
+		pool := tc.pool
+		if err := pool.parse(); err != nil {
+			t.Fatalf("%v: %v", tc.pool.CIDR, err)
+		}
+		if got := pool.size().Int64(); got != tc.want {
+			t.Errorf("%v %v: unexpected size: got %v want %v", tc.pool.CIDR, tc.pool.Excluded, got, tc.want)
+		}
+	}
+
+	for _, pool := range []IPPool{
+		{CIDR: "not-a-cidr"},
+		{CIDR: "10.1.0.0/24", Gateway: "10.2.0.1"},
+		{CIDR: "10.1.0.0/24", Excluded: []string{"10.9.0.0/24"}},
+		{CIDR: "10.1.0.0/24", Excluded: []string{"fd00::1"}},
+	} {
+		if err := pool.parse(); err == nil {
+			t.Errorf("pool %v was accepted", pool)
+		}
+	}
+}
+
+func TestAllocateFromNamedPool(t *testing.T) {
+	clearDatabase()
+	pool := IPPool{Name: "small", CIDR: "192.168.50.0/29", Gateway: "192.168.50.1", Excluded: []string{"192.168.50.2-192.168.50.3"}}
+	if err := savePool(&pool, false); err != nil {
+		t.Fatal(err)
+	}
+	owner := createTestUser(t, "owner@example.com", "secret")
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		workspace := Workspace{Name: "ws", UserID: owner.ID, Subdomain: generateSubdomain(), Pool: "small"}
+		if err := insertWorkspace(tx, &workspace); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, workspace.IPs...)
+	}
+	want := []string{"192.168.50.4", "192.168.50.5", "192.168.50.6"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("unexpected allocation order: got %v want %v", got, want)
+			break
+		}
+	}
+
+	workspace := Workspace{Name: "ws", UserID: owner.ID, Subdomain: generateSubdomain(), Pool: "small"}
+	if err := insertWorkspace(tx, &workspace); err != errNoAvailableIPs {
+		t.Errorf("exhausted pool returned unexpected error: got %v want %v", err, errNoAvailableIPs)
+	}
+	workspace = Workspace{Name: "ws", UserID: owner.ID, Subdomain: generateSubdomain(), Pool: "missing"}
+	if err := insertWorkspace(tx, &workspace); err != errUnknownPool {
+		t.Errorf("unknown pool returned unexpected error: got %v want %v", err, errUnknownPool)
+	}
+}
+
+func TestAllocateIPv6(t *testing.T) {
+	clearDatabase()
+	pool := IPPool{Name: "v6", CIDR: "fd00:10::/64"}
+	if err := savePool(&pool, false); err != nil {
+		t.Fatal(err)
+	}
+	workspaceID := createTestWorkspace(t, createTestUser(t, "owner@example.com", "secret"), "v6")
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	ip, err := allocateIP(tx, workspaceID, "v6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "fd00:10::1" {
+		t.Errorf("unexpected IPv6 allocation: got %v want %v", ip, "fd00:10::1")
+	}
+}
+
+func TestGeneratedSubdomainConflict(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	defer rand.Seed(time.Now().UnixNano())
+
+	// Reseeding makes the first generated subdomain the one already taken
+	rand.Seed(1)
+	taken := Workspace{Name: "taken", UserID: owner.ID, Subdomain: generateSubdomain()}
+	rand.Seed(1)
+	workspace := Workspace{Name: "ws", UserID: owner.ID}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := insertWorkspace(tx, &taken); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertWorkspace(tx, &workspace); err != nil {
+		t.Fatal(err)
+	}
+	if workspace.Subdomain == "" || workspace.Subdomain == taken.Subdomain {
+		t.Errorf("workspace got subdomain %q next to %q, want another one", workspace.Subdomain, taken.Subdomain)
+	}
+	// A subdomain the caller chose is not replaced
+	duplicate := Workspace{Name: "duplicate", UserID: owner.ID, Subdomain: taken.Subdomain}
+	if err := insertWorkspace(tx, &duplicate); !isUniqueViolation(err) {
+		t.Errorf("duplicate subdomain returned unexpected error: %v", err)
+	}
+}
+
+func TestCreateIPPool(t *testing.T) {
+	clearDatabase()
+	operator := createTestUser(t, "netops@example.com", "secret")
+	user := createTestUser(t, "user@example.com", "secret")
+	setOperators(t, operator.Username)
+	defer setOperators(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ip-pools", requireOperator(createIPPool)).Methods("POST")
+
+	for _, tc := range []struct {
+		name string
+		body string
+		user User
+		want int
+		path string // of the field that failed validation
+	}{
+		{"not an operator", `{"name":"lab","cidr":"192.168.60.0/24"}`, user, http.StatusForbidden, ""},
+		{"operator", `{"name":"lab","cidr":"192.168.60.0/24","gateway":"192.168.60.1"}`, operator, http.StatusCreated, ""},
+		{"duplicate name", `{"name":"lab","cidr":"192.168.61.0/24"}`, operator, http.StatusConflict, ""},
+		{"overlapping", `{"name":"lab2","cidr":"192.168.60.128/25"}`, operator, http.StatusBadRequest, "/cidr"},
+		{"gateway outside", `{"name":"lab2","cidr":"192.168.62.0/24","gateway":"192.168.63.1"}`, operator, http.StatusBadRequest, "/gateway"},
+		{"bad exclusion", `{"name":"lab2","cidr":"192.168.62.0/24","excluded":["192.168.62.9","nope"]}`, operator, http.StatusBadRequest, "/excluded/1"},
+	} {
+		req, err := http.NewRequest("POST", "/ip-pools", bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, tc.user))
+
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, tc.want)
+		}
+		if tc.path != "" {
+			var response APIError
+			json.Unmarshal(rr.Body.Bytes(), &response)
+			if len(response.Errors) != 1 || response.Errors[0].Path != tc.path {
+				t.Errorf("%s: handler returned unexpected errors: %+v", tc.name, response)
+			}
+		}
+		if tc.want == http.StatusCreated {
+			var response PoolUsage
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Total.Int64() != 253 || response.Used != 0 {
+				t.Errorf("handler returned unexpected usage: got %v/%v want 0/253", response.Used, response.Total)
+			}
+		}
+	}
+}
+
+func TestRedeclarePoolWithLeases(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "redeclare1")
+	pool := IPPool{Name: "lab", CIDR: "192.168.70.0/24"}
+	if err := savePool(&pool, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO ip_leases (ip, workspace_id, pool_id) VALUES ('192.168.70.5', ?, ?)", workspaceID, pool.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		pool IPPool
+		path string // of the field that strands the lease, if any
+	}{
+		{IPPool{Name: "lab", CIDR: "192.168.70.0/23"}, "/cidr"},
+		{IPPool{Name: "lab", CIDR: "192.168.70.0/24", Gateway: "192.168.70.5"}, "/gateway"},
+		{IPPool{Name: "lab", CIDR: "192.168.70.0/24", Excluded: []string{"192.168.70.4-192.168.70.6"}}, "/excluded"},
+		{IPPool{Name: "lab", CIDR: "192.168.70.0/24", Gateway: "192.168.70.1", Excluded: []string{"192.168.70.200-192.168.70.254"}}, ""},
+	} {
+		var invalid *invalidPoolError
+		err := savePool(&tc.pool, true)
+		switch {
+		case tc.path == "" && err != nil:
+			t.Errorf("redeclaring %+v failed: %v", tc.pool, err)
+		case tc.path != "" && (!errors.As(err, &invalid) || invalid.Path != tc.path):
+			t.Errorf("redeclaring %+v returned %v, want an error at %s", tc.pool, err, tc.path)
+		}
+	}
+
+	// Once the lease is released the cidr can change
+	if _, err := db.Exec("DELETE FROM ip_leases"); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePool(&IPPool{Name: "lab", CIDR: "192.168.70.0/23"}, true); err != nil {
+		t.Errorf("redeclaring a pool without leases failed: %v", err)
+	}
+}
+
+func TestIPPoolETag(t *testing.T) {
+	clearDatabase()
+	operator := createTestUser(t, "netops@example.com", "secret")
+	pool := IPPool{Name: "lab", CIDR: "192.168.60.0/24"}
+	if err := savePool(&pool, false); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ip-pools/{id:[0-9]+}", conditional(getIPPool, "ip_pools")).Methods("GET")
+	router.HandleFunc("/ip-pools/{id:[0-9]+}", conditional(deleteIPPool, "ip_pools")).Methods("DELETE")
+
+	poolPath := fmt.Sprintf("/ip-pools/%d", pool.ID)
+	if tag := sendAs(t, router, operator, "GET", poolPath, nil, http.StatusOK).Header().Get("ETag"); tag != `"1"` {
+		t.Errorf("pool has ETag %s, want \"1\"", tag)
+	}
+	// Declaring the pool again in the pool config changes it
+	pool.Gateway = "192.168.60.1"
+	if err := savePool(&pool, true); err != nil {
+		t.Fatal(err)
+	}
+	if tag := sendAs(t, router, operator, "GET", poolPath, nil, http.StatusOK).Header().Get("ETag"); tag != `"2"` {
+		t.Errorf("updated pool has ETag %s, want \"2\"", tag)
+	}
+	sendAs(t, router, operator, "DELETE", poolPath, nil, http.StatusPreconditionFailed, "If-Match", `"1"`)
+	sendAs(t, router, operator, "DELETE", poolPath, nil, http.StatusNoContent, "If-Match", `"2"`)
+}
+
+func TestWorkspaceIPs(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace := Workspace{Name: "ws", UserID: user.ID, Subdomain: generateSubdomain()}
+	if err := insertWorkspace(tx, &workspace); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/workspaces/{id:[0-9]+}/ips", addWorkspaceIP).Methods("POST")
+	router.HandleFunc("/workspaces/{id:[0-9]+}/ips/{ip}", releaseWorkspaceIP).Methods("DELETE")
+	router.HandleFunc("/ips", getIPs).Methods("GET")
+
+	// Add a second IP, from an IPv6 pool
+	pool := IPPool{Name: "v6", CIDR: "fd00:10::/64"}
+	if err := savePool(&pool, false); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("/workspaces/%d/ips", workspace.ID), bytes.NewBufferString(`{"pool": "v6"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, user))
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var response Workspace
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.IPs) != 2 || response.IPs[0] != workspace.IPs[0] {
+		t.Fatalf("handler returned unexpected IPs: got %v", response.IPs)
+	}
+
+	// Release the first one
+	req, err = http.NewRequest("DELETE", fmt.Sprintf("/workspaces/%d/ips/%s", workspace.ID, workspace.IPs[0]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, user))
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	var ips string
+	if err := db.QueryRow("SELECT ips FROM workspaces WHERE id = ?", workspace.ID).Scan(&ips); err != nil {
+		t.Fatal(err)
+	}
+	if ips != response.IPs[1] {
+		t.Errorf("workspace row was not kept in sync with its leases: got %v want %v", ips, response.IPs[1])
+	}
+
+	// Releasing it again fails
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, user))
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// The last IP stays, and it is found however it is written
+	last := netip.MustParseAddr(response.IPs[1]).StringExpanded()
+	sendAs(t, router, user, "DELETE", fmt.Sprintf("/workspaces/%d/ips/%s", workspace.ID, last), nil, http.StatusConflict)
+	sendAs(t, router, user, "DELETE", fmt.Sprintf("/workspaces/%d/ips/not-an-ip", workspace.ID), nil, http.StatusBadRequest)
+
+	// The remaining lease is listed with its owner
+	req, err = http.NewRequest("GET", "/ips", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, user))
+	var leases []IPLease
+	if err := json.Unmarshal(rr.Body.Bytes(), &leases); err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 || leases[0].IP != response.IPs[1] || leases[0].WorkspaceID != workspace.ID || leases[0].Pool == "" {
+		t.Errorf("handler returned unexpected leases: got %+v", leases)
+	}
+}
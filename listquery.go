@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Kinds of list filters
+const (
+	filterInt       = iota // column equals the integer parameter
+	filterString           // column equals the parameter
+	filterPrefix           // column starts with the parameter, ignoring ASCII case
+	filterCondition        // column is a condition taking the integer parameter as every argument
+)
+
+type listFilter struct {
+	column string
+	kind   int
+}
+
+// listSpec describes how the rows of a list endpoint can be filtered and
+// sorted. Every list takes:
+//
+//	?<filter>=<value>     for each of its filters
+//	?sort=<field>[,-<field>...]
+//	                      sorts by the given fields, descending when prefixed
+//	                      by "-", with ties broken by id
+//	?limit=<n>            returns at most n rows (default 100, at most 1000)
+//	?page_token=<token>   continues after the page that returned the token in
+//	                      its X-Next-Page-Token header
+type listSpec struct {
+	filters map[string]listFilter
+	// sorts maps sort fields to the SQL expressions they sort by, which must
+	// never be NULL
+	sorts       map[string]string
+	defaultSort string
+}
+
+type sortKey struct {
+	expr string
+	desc bool
+}
+
+// listQuery is a request for one page of a list.
+type listQuery struct {
+	conditions []string
+	args       []interface{}
+	sort       []sortKey
+	sortParam  string
+	after      []interface{}
+	limit      int
+
+	count int
+	last  []interface{}
+	more  bool
+}
+
+// pageToken is the position of the last row of a page, encoded for clients.
+type pageToken struct {
+	Sort   string        `json:"sort"`
+	Values []interface{} `json:"values"`
+}
+
+var errInvalidPageToken = errors.New("invalid page_token")
+
+// parseList reads the filter, sort and pagination parameters of a request.
+func parseList(r *http.Request, spec listSpec) (*listQuery, error) {
+	query := r.URL.Query()
+	q := &listQuery{limit: defaultPageSize}
+
+	for param, filter := range spec.filters {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		switch filter.kind {
+		case filterInt:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", param)
+			}
+			q.where(filter.column+" = ?", n)
+		case filterCondition:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", param)
+			}
+			args := make([]interface{}, strings.Count(filter.column, "?"))
+			for i := range args {
+				args[i] = n
+			}
+			q.where(filter.column, args...)
+		case filterString:
+			q.where(filter.column+" = ?", value)
+		case filterPrefix:
+			escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+			q.where(filter.column+` LIKE ? ESCAPE '\'`, escaped+"%")
+		}
+	}
+
+	q.sortParam = query.Get("sort")
+	if q.sortParam == "" {
+		q.sortParam = spec.defaultSort
+	}
+	hasID := false
+	for _, field := range strings.Split(q.sortParam, ",") {
+		key := sortKey{}
+		if strings.HasPrefix(field, "-") {
+			key.desc = true
+			field = field[1:]
+		}
+		expr, ok := spec.sorts[field]
+		if !ok {
+			return nil, fmt.Errorf("cannot sort by %q", field)
+		}
+		key.expr = expr
+		hasID = hasID || field == "id"
+		q.sort = append(q.sort, key)
+	}
+	if !hasID {
+		// Rows with the same sort values still need a stable order
+		q.sort = append(q.sort, sortKey{expr: "id", desc: q.sort[len(q.sort)-1].desc})
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return nil, errors.New("limit must be a positive integer")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		q.limit = limit
+	}
+
+	if v := query.Get("page_token"); v != "" {
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errInvalidPageToken
+		}
+		var token pageToken
+		if err := json.Unmarshal(data, &token); err != nil || token.Sort != q.sortParam || len(token.Values) != len(q.sort) {
+			return nil, errInvalidPageToken
+		}
+		q.after = token.Values
+	}
+	return q, nil
+}
+
+// where adds a condition rows must meet.
+func (q *listQuery) where(condition string, args ...interface{}) {
+	q.conditions = append(q.conditions, condition)
+	q.args = append(q.args, args...)
+}
+
+// filtered selects the rows of table that meet the conditions, to be used as
+// the source of the query.
+func (q *listQuery) filtered(table string) string {
+	return "(SELECT * FROM " + table + q.whereClause() + ")"
+}
+
+func (q *listQuery) whereClause() string {
+	if len(q.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.conditions, " AND ")
+}
+
+// run queries one page of columns from source, which is built with filtered
+// and so takes the arguments of the conditions.
+func (q *listQuery) run(columns, source string) (*sql.Rows, error) {
+	args := append([]interface{}{}, q.args...)
+	exprs := make([]string, len(q.sort))
+	order := make([]string, len(q.sort))
+	for i, key := range q.sort {
+		exprs[i] = key.expr
+		order[i] = key.expr
+		if key.desc {
+			order[i] += " DESC"
+		}
+	}
+
+	after := ""
+	if q.after != nil {
+		// Rows past the last one, comparing the sort values in order
+		var alternatives []string
+		for i, key := range q.sort {
+			var equal []string
+			for _, previous := range q.sort[:i] {
+				equal = append(equal, previous.expr+" = ?")
+			}
+			op := " > ?"
+			if key.desc {
+				op = " < ?"
+			}
+			alternatives = append(alternatives, "("+strings.Join(append(equal, key.expr+op), " AND ")+")")
+			args = append(args, q.after[:i+1]...)
+		}
+		after = " WHERE " + strings.Join(alternatives, " OR ")
+	}
+
+	args = append(args, q.limit+1)
+	return db.Query("SELECT "+columns+", "+strings.Join(exprs, ", ")+" FROM "+source+" AS listed"+after+
+		" ORDER BY "+strings.Join(order, ", ")+" LIMIT ?", args...)
+}
+
+// next advances rows to the next row on the page and returns a scanner for
+// it, or false at the end of the page.
+func (q *listQuery) next(rows *sql.Rows) (rowScanner, bool) {
+	if !rows.Next() {
+		return nil, false
+	}
+	if q.count == q.limit {
+		q.more = true
+		return nil, false
+	}
+	q.count++
+	return &listRow{rows: rows, q: q}, true
+}
+
+// listRow scans a row of a listQuery, keeping its sort values for the next
+// page token.
+type listRow struct {
+	rows *sql.Rows
+	q    *listQuery
+}
+
+func (row *listRow) Scan(dest ...interface{}) error {
+	values := make([]interface{}, len(row.q.sort))
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	if err := row.rows.Scan(dest...); err != nil {
+		return err
+	}
+	row.q.last = values
+	return nil
+}
+
+// writeNextPage sets X-Next-Page-Token if there are rows after this page. It
+// must be called before the body is written.
+func (q *listQuery) writeNextPage(w http.ResponseWriter) {
+	if !q.more {
+		return
+	}
+	data, _ := json.Marshal(pageToken{Sort: q.sortParam, Values: q.last})
+	w.Header().Set("X-Next-Page-Token", base64.RawURLEncoding.EncodeToString(data))
+}
+
+// nestedList serves a list scoped to the resource in the {id} route variable,
+// such as /workspaces/{id}/apps, by calling the flat list handler with that id
+// as its filter parameter.
+func nestedList(next http.HandlerFunc, filter string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		query := r.URL.Query()
+		query.Set(filter, mux.Vars(r)["id"])
+		r.URL.RawQuery = query.Encode()
+		next(w, r)
+	}
+}
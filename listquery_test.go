@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestListPagination(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "paging1")
+	for i, name := range []string{"billing", "billing", "auth", "search", "bill_run"} {
+		createTestApp(t, workspaceID, name, fmt.Sprintf("1.%d.0", i), fmt.Sprintf("10.0.0.%d:8080", i+1))
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", getApps).Methods("GET")
+
+	list := func(query url.Values, want int) ([]App, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "/apps?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = asUser(req, user)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != want {
+			t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, want, rr.Body.String())
+		}
+		var apps []App
+		if want == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &apps); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return apps, rr.Header().Get("X-Next-Page-Token")
+	}
+	describe := func(apps []App) string {
+		var names []string
+		for _, app := range apps {
+			names = append(names, app.Name+"@"+app.Version)
+		}
+		return fmt.Sprint(names)
+	}
+
+	// Pages follow each other without gaps or repeats in the default order
+	var all []App
+	query := url.Values{"limit": {"2"}}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("pagination did not end")
+		}
+		apps, token := list(query, http.StatusOK)
+		all = append(all, apps...)
+		if token == "" {
+			break
+		}
+		query.Set("page_token", token)
+	}
+	if got, want := describe(all), "[auth@1.2.0 bill_run@1.4.0 billing@1.1.0 billing@1.0.0 search@1.3.0]"; got != want {
+		t.Errorf("pages returned %s, want %s", got, want)
+	}
+
+	apps, token := list(url.Values{"sort": {"-version"}, "limit": {"3"}}, http.StatusOK)
+	if got, want := describe(apps), "[bill_run@1.4.0 search@1.3.0 auth@1.2.0]"; got != want || token == "" {
+		t.Errorf("sorted page returned %s with token %q, want %s", got, token, want)
+	}
+	apps, token = list(url.Values{"sort": {"-version"}, "limit": {"3"}, "page_token": {token}}, http.StatusOK)
+	if got, want := describe(apps), "[billing@1.1.0 billing@1.0.0]"; got != want || token != "" {
+		t.Errorf("second sorted page returned %s with token %q, want %s", got, token, want)
+	}
+
+	// The prefix is matched literally, so "_" is not a wildcard
+	apps, _ = list(url.Values{"name_prefix": {"bill_"}}, http.StatusOK)
+	if got, want := describe(apps), "[bill_run@1.4.0]"; got != want {
+		t.Errorf("prefix filter returned %s, want %s", got, want)
+	}
+
+	list(url.Values{"sort": {"password"}}, http.StatusBadRequest)
+	list(url.Values{"limit": {"0"}}, http.StatusBadRequest)
+	list(url.Values{"page_token": {"not-a-token"}}, http.StatusBadRequest)
+	// A token only continues the order it was issued for
+	_, token = list(url.Values{"limit": {"1"}}, http.StatusOK)
+	list(url.Values{"sort": {"id"}, "page_token": {token}}, http.StatusBadRequest)
+}
+
+func TestListFilters(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	member := createTestUser(t, "member@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "filters1")
+	otherID := createTestWorkspace(t, owner, "filters2")
+	for _, role := range []WorkspaceRole{
+		{UserID: member.ID, Role: RoleMember, WorkspaceID: workspaceID},
+		{UserID: member.ID, Role: RoleAdmin, WorkspaceID: otherID},
+	} {
+		if _, err := db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", role.UserID, role.Role, role.WorkspaceID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users", getUsers).Methods("GET")
+	router.HandleFunc("/workspace-roles", getWorkspaceRoles).Methods("GET")
+
+	get := func(path string, response interface{}) {
+		t.Helper()
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = asUser(req, owner)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), response); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var users []User
+	get("/users?username_prefix=MEM", &users)
+	if len(users) != 1 || users[0].ID != member.ID {
+		t.Errorf("handler returned unexpected users: %+v", users)
+	}
+	get("/users?sort=-username", &users)
+	if len(users) != 2 || users[0].ID != owner.ID {
+		t.Errorf("handler returned unexpected users: %+v", users)
+	}
+
+	var roles []WorkspaceRole
+	get(fmt.Sprintf("/workspace-roles?workspace_id=%d", workspaceID), &roles)
+	if len(roles) != 1 || roles[0].Role != RoleMember {
+		t.Errorf("handler returned unexpected roles: %+v", roles)
+	}
+	get(fmt.Sprintf("/workspace-roles?user_id=%d&role=%s", member.ID, RoleAdmin), &roles)
+	if len(roles) != 1 || roles[0].WorkspaceID != otherID {
+		t.Errorf("handler returned unexpected roles: %+v", roles)
+	}
+	get("/workspace-roles?sort=-workspace_id", &roles)
+	if len(roles) != 2 || roles[0].WorkspaceID != otherID {
+		t.Errorf("handler returned unexpected roles: %+v", roles)
+	}
+}
+
+func TestNestedRoutes(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	member := createTestUser(t, "member@example.com", "secret")
+	stranger := createTestUser(t, "stranger@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "nested1")
+	otherID := createTestWorkspace(t, owner, "nested2")
+	if _, err := db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", member.ID, RoleMember, workspaceID); err != nil {
+		t.Fatal(err)
+	}
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8001")
+	createTestApp(t, workspaceID, "auth", "1.0.0", "10.0.0.1:8002")
+	createTestApp(t, otherID, "search", "1.0.0", "10.0.0.1:8003")
+	if _, err := db.Exec("INSERT INTO app_roles (user_id, role, app_id) VALUES (?, ?, ?)", stranger.ID, RoleUser, appID); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id:[0-9]+}/workspaces", requireExistingUser(nestedList(getWorkspaces, "member_id"))).Methods("GET")
+	router.HandleFunc("/workspaces/by-subdomain/{subdomain}", requireSubdomainRole(getWorkspaceBySubdomain, RoleMember)).Methods("GET")
+	router.HandleFunc("/workspaces/{id:[0-9]+}/apps", requireWorkspaceRole(nestedList(getApps, "workspace_id"), sameID, RoleMember)).Methods("GET")
+	router.HandleFunc("/workspaces/{id:[0-9]+}/roles", requireWorkspaceRole(nestedList(getWorkspaceRoles, "workspace_id"), sameID, RoleMember)).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/roles", requireAppRole(nestedList(getAppRoles, "app_id"), sameID, RoleUser)).Methods("GET")
+
+	get := func(user User, path string, want int, response interface{}) http.Header {
+		t.Helper()
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = asUser(req, user)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != want {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", path, status, want)
+		}
+		if response != nil {
+			if err := json.Unmarshal(rr.Body.Bytes(), response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Header()
+	}
+
+	// The route's workspace overrides any workspace_id in the query, and the
+	// list still pages
+	var apps []App
+	header := get(member, fmt.Sprintf("/workspaces/%d/apps?workspace_id=%d&limit=1", workspaceID, otherID), http.StatusOK, &apps)
+	if len(apps) != 1 || apps[0].Name != "auth" || header.Get("X-Next-Page-Token") == "" {
+		t.Errorf("handler returned unexpected apps: %+v", apps)
+	}
+	get(member, fmt.Sprintf("/workspaces/%d/apps", otherID), http.StatusForbidden, nil)
+
+	var workspaceRoles []WorkspaceRole
+	get(member, fmt.Sprintf("/workspaces/%d/roles", workspaceID), http.StatusOK, &workspaceRoles)
+	if len(workspaceRoles) != 1 || workspaceRoles[0].UserID != member.ID {
+		t.Errorf("handler returned unexpected roles: %+v", workspaceRoles)
+	}
+
+	var appRoles []AppRole
+	get(stranger, fmt.Sprintf("/apps/%d/roles", appID), http.StatusOK, &appRoles)
+	if len(appRoles) != 1 || appRoles[0].UserID != stranger.ID {
+		t.Errorf("handler returned unexpected roles: %+v", appRoles)
+	}
+
+	// Only the workspaces both users can see are listed
+	var workspaces []Workspace
+	get(owner, fmt.Sprintf("/users/%d/workspaces", member.ID), http.StatusOK, &workspaces)
+	if len(workspaces) != 1 || workspaces[0].ID != workspaceID {
+		t.Errorf("handler returned unexpected workspaces: %+v", workspaces)
+	}
+	get(member, fmt.Sprintf("/users/%d/workspaces", owner.ID), http.StatusOK, &workspaces)
+	if len(workspaces) != 1 || workspaces[0].ID != workspaceID {
+		t.Errorf("handler returned unexpected workspaces: %+v", workspaces)
+	}
+	get(owner, "/users/9999/workspaces", http.StatusNotFound, nil)
+
+	var workspace Workspace
+	get(member, "/workspaces/by-subdomain/nested1", http.StatusOK, &workspace)
+	if workspace.ID != workspaceID {
+		t.Errorf("handler returned unexpected workspace: %+v", workspace)
+	}
+	get(member, "/workspaces/by-subdomain/nested2", http.StatusForbidden, nil)
+	get(member, "/workspaces/by-subdomain/missing", http.StatusNotFound, nil)
+}
+
+func TestListPaginationOfPoolsLeasesInstancesAndRevisions(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "paging2")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8080")
+	for _, statement := range []string{
+		"INSERT INTO ip_pools (name, cidr) VALUES ('lab-b', '10.1.0.0/24'), ('lab-a', '10.2.0.0/24'), ('lab-c', '10.3.0.0/24')",
+		fmt.Sprintf("INSERT INTO ip_leases (ip, workspace_id, pool_id) SELECT ip, %d, (SELECT id FROM ip_pools WHERE name = pool) FROM (SELECT '10.1.0.5' AS ip, 'lab-b' AS pool UNION ALL SELECT '10.1.0.3', 'lab-b' UNION ALL SELECT '10.2.0.2', 'lab-a')", workspaceID),
+		fmt.Sprintf("INSERT INTO app_instances (app_id, address, zone) VALUES (%d, '10.0.0.2:8080', 'b'), (%d, '10.0.0.3:8080', 'a'), (%d, '10.0.0.4:8080', 'b')", appID, appID, appID),
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := recordRevision(tx, &App{ID: appID, Name: "billing", WorkspaceID: workspaceID}, user.ID, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ip-pools", getIPPools).Methods("GET")
+	router.HandleFunc("/ips", getIPs).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/instances", getInstances).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/revisions", getAppRevisions).Methods("GET")
+
+	// pages lists path one row at a time and describes every row with field
+	pages := func(path string, field string) string {
+		t.Helper()
+		var all []string
+		query := url.Values{"limit": {"1"}}
+		for pages := 0; ; pages++ {
+			if pages > 3 {
+				t.Fatalf("pagination of %s did not end", path)
+			}
+			rr := sendAs(t, router, user, "GET", path+"&"+query.Encode(), nil, http.StatusOK)
+			var rows []map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &rows); err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range rows {
+				all = append(all, fmt.Sprint(row[field]))
+			}
+			token := rr.Header().Get("X-Next-Page-Token")
+			if token == "" {
+				return fmt.Sprint(all)
+			}
+			query.Set("page_token", token)
+		}
+	}
+
+	for _, tc := range []struct {
+		path  string
+		field string
+		want  string
+	}{
+		{"/ip-pools?name_prefix=lab-&sort=name", "name", "[lab-a lab-b lab-c]"},
+		{"/ips?pool=lab-b", "ip", "[10.1.0.5 10.1.0.3]"},
+		{"/ips?workspace_id=" + strconv.Itoa(workspaceID) + "&sort=-pool,ip", "ip", "[10.1.0.3 10.1.0.5 10.2.0.2]"},
+		{fmt.Sprintf("/apps/%d/instances?sort=zone", appID), "address", "[10.0.0.3:8080 10.0.0.2:8080 10.0.0.4:8080]"},
+		{fmt.Sprintf("/apps/%d/revisions?", appID), "revision", "[3 2 1]"},
+	} {
+		if got := pages(tc.path, tc.field); got != tc.want {
+			t.Errorf("pages of %s returned %s, want %s", tc.path, got, tc.want)
+		}
+	}
+
+	sendAs(t, router, user, "GET", "/ips?sort=workspace", nil, http.StatusBadRequest)
+	sendAs(t, router, user, "GET", fmt.Sprintf("/apps/%d/revisions?limit=0", appID), nil, http.StatusBadRequest)
+}
@@ -7,11 +7,12 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"net"
 	"net/http"
 	"net/mail"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -31,19 +32,27 @@ type Workspace struct {
 	UserID    int      `json:"user_id"`
 	Subdomain string   `json:"subdomain"`
 	IPs       []string `json:"ips"`
+	Pool      string   `json:"pool,omitempty"` // IP pool to allocate from on creation
+	// SchemaPolicy decides whether apps may make breaking schema changes
+	SchemaPolicy string `json:"schema_policy"`
 }
 
 type App struct {
-	ID           int    `json:"id"`
-	Name         string `json:"name"`
-	Description  string `json:"description"`
-	GitHash      string `json:"git_hash"`
-	IPPort       string `json:"ip_port"`
-	Endpoint     string `json:"endpoint"`
-	Version      string `json:"version"`
-	WorkspaceID  int    `json:"workspace_id"`
-	InputSchema  string `json:"input_schema"`
-	OutputSchema string `json:"output_schema"`
+	ID           int          `json:"id"`
+	Name         string       `json:"name"`
+	Description  string       `json:"description"`
+	GitHash      string       `json:"git_hash"`
+	IPPort       string       `json:"ip_port"`
+	Endpoint     string       `json:"endpoint"`
+	Version      string       `json:"version"`
+	WorkspaceID  int          `json:"workspace_id"`
+	InputSchema  Schema       `json:"input_schema"`
+	OutputSchema Schema       `json:"output_schema"`
+	HealthCheck  *HealthCheck `json:"health_check,omitempty"`
+	Health       *AppHealth   `json:"health,omitempty"`
+	Revision     int          `json:"revision"`
+	// Compatibility is set when an app is registered or updated
+	Compatibility *Compatibility `json:"compatibility,omitempty"`
 }
 
 type WorkspaceRole struct {
@@ -62,101 +71,164 @@ type AppRole struct {
 
 var (
 	db          *sql.DB
-	ipPool      *IPPool
-	mutex       sync.Mutex
-	subdomains  map[string]bool
 	port        int
 	bindAddress string
-)
 
-type IPPool struct {
-	available []net.IP
-	inUse     map[string]bool
-	mutex     sync.Mutex
-}
+	tokenSecret     []byte
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	operators       map[string]bool
+)
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
-	subdomains = make(map[string]bool)
 }
 
 func deleteWorkspace(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 
-	// Get the workspace's IPs before deleting
-	var ips string
-	err := db.QueryRow("SELECT ips FROM workspaces WHERE id = ?", params["id"]).Scan(&ips)
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	// Delete the workspace
-	_, err = db.Exec("DELETE FROM workspaces WHERE id = ?", params["id"])
+	var id int
+	err = tx.QueryRow("SELECT id FROM workspaces WHERE id = ?", params["id"]).Scan(&id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "Workspace", err)
 		return
 	}
 
-	// Release the IPs
-	for _, ip := range strings.Split(ips, ",") {
-		ipPool.ReleaseIP(ip)
+	// Release the IPs together with the workspace row; its apps, instances
+	// and roles are deleted with it
+	released, err := releaseWorkspaceIPs(tx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cascade, err := workspaceCascadeEvents(tx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := execIfMatch(tx, r, "DELETE FROM workspaces WHERE id = ?", id); err != nil {
+		writeDBError(w, "Workspace", err)
+		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, event := range append(released, cascade...) {
+		events.publish(event)
+	}
+	events.publish(Event{Type: EventWorkspaceDeleted, WorkspaceID: id, Data: deleted{id}})
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (p *IPPool) ReleaseIP(ip string) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-
-	if p.inUse[ip] {
-		delete(p.inUse, ip)
-		p.available = append(p.available, net.ParseIP(ip))
-	}
+var workspaceList = listSpec{
+	filters: map[string]listFilter{
+		"name_prefix": {"name", filterPrefix},
+		"user_id":     {"user_id", filterInt},
+		"subdomain":   {"subdomain", filterString},
+		"member_id":   {"id IN (SELECT id FROM workspaces WHERE user_id = ? UNION SELECT workspace_id FROM workspace_roles WHERE user_id = ?)", filterCondition},
+	},
+	sorts: map[string]string{
+		"id":        "id",
+		"name":      "name",
+		"subdomain": "COALESCE(subdomain, '')",
+	},
+	defaultSort: "id",
 }
 
+// getWorkspaces lists the workspaces the caller can see:
+// GET /workspaces[?name_prefix=<prefix>][&user_id=<id>][&subdomain=<subdomain>][&member_id=<id>]
+// member_id selects the workspaces a user owns or has a role in.
+// It takes the sort and page parameters described on listSpec.
 func getWorkspaces(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, name, user_id, subdomain, ips FROM workspaces")
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	q, err := parseList(r, workspaceList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visible, args := visibleWorkspaces(user)
+	q.where("id IN ("+visible+")", args...)
+
+	rows, err := q.run(workspaceColumns, q.filtered("workspaces"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	defer rows.Close()
 
 	workspaces := []Workspace{}
-	for rows.Next() {
-		var ws Workspace
-		var ips string
-		if err := rows.Scan(&ws.ID, &ws.Name, &ws.UserID, &ws.Subdomain, &ips); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
+		ws, err := scanWorkspace(row)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		ws.IPs = strings.Split(ips, ",")
 		workspaces = append(workspaces, ws)
 	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	q.writeNextPage(w)
 	json.NewEncoder(w).Encode(workspaces)
 }
 
+var userList = listSpec{
+	filters: map[string]listFilter{
+		"username_prefix": {"username", filterPrefix},
+	},
+	sorts: map[string]string{
+		"id":       "id",
+		"username": "username",
+	},
+	defaultSort: "id",
+}
+
+// getUsers lists users: GET /users[?username_prefix=<prefix>]
+// It takes the sort and page parameters described on listSpec.
 func getUsers(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, username FROM users")
+	q, err := parseList(r, userList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows, err := q.run("id, username", q.filtered("users"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	defer rows.Close()
 
 	users := []User{}
-	for rows.Next() {
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := row.Scan(&u.ID, &u.Username); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 		users = append(users, u)
 	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	q.writeNextPage(w)
 	json.NewEncoder(w).Encode(users)
 }
 
@@ -164,61 +236,72 @@ func updateWorkspaceRole(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	var role WorkspaceRole
 	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validWorkspaceRole(role.Role) {
+		writeValidationError(w, "Invalid workspace role", ValidationError{Path: "/role", Message: "must be admin or member"})
+		return
+	}
+	// The role may be moved to another workspace, which the caller must also
+	// administer; a missing workspace is reported by checkReferences instead
+	if err := authorizeWorkspace(r, role.WorkspaceID, RoleAdmin); err != nil && err != sql.ErrNoRows {
+		writeAuthzError(w, err)
+		return
+	}
+	if !checkReferences(w, reference{"/user_id", "users", "user", role.UserID}, reference{"/workspace_id", "workspaces", "workspace", role.WorkspaceID}) {
 		return
 	}
 
-	_, err := db.Exec("UPDATE workspace_roles SET user_id = ?, role = ?, workspace_id = ? WHERE id = ?",
+	err := execIfMatch(db, r, "UPDATE workspace_roles SET user_id = ?, role = ?, workspace_id = ?, revision = revision + 1 WHERE id = ?",
 		role.UserID, role.Role, role.WorkspaceID, params["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "Workspace role", err)
 		return
 	}
+	role.ID, _ = strconv.Atoi(params["id"])
+	events.publish(Event{Type: EventRoleChanged, WorkspaceID: role.WorkspaceID, Data: role})
 
 	json.NewEncoder(w).Encode(role)
 }
 
-func NewIPPool() *IPPool {
-	pool := &IPPool{
-		available: make([]net.IP, 0),
-		inUse:     make(map[string]bool),
-	}
-
-	// Generate IPs for 10.0.0.0/16 and 172.16.0.0/16
-	for i := 0; i <= 255; i++ {
-		for j := 0; j <= 255; j++ {
-			pool.available = append(pool.available, net.IPv4(10, 0, byte(i), byte(j)))
-			pool.available = append(pool.available, net.IPv4(172, 16, byte(i), byte(j)))
-		}
-	}
-
-	return pool
-}
-
 func createWorkspace(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 	var workspace Workspace
 	if err := json.NewDecoder(r.Body).Decode(&workspace); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if workspace.SchemaPolicy == "" {
+		workspace.SchemaPolicy = SchemaPolicyAllow
+	}
+	if !validSchemaPolicy(workspace.SchemaPolicy) {
+		writeValidationError(w, "Invalid schema policy", ValidationError{Path: "/schema_policy", Message: "must be allow or reject-breaking"})
+		return
+	}
+	workspace.UserID = user.ID // The creator owns the workspace
+	workspace.Subdomain = ""   // insertWorkspace generates one
 
-	workspace.Subdomain = generateSubdomain()
-	ip, err := ipPool.AllocateIP()
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, "Failed to allocate IP", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	workspace.IPs = []string{ip}
+	defer tx.Rollback()
 
-	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)",
-		workspace.Name, workspace.UserID, workspace.Subdomain, strings.Join(workspace.IPs, ","))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := insertWorkspace(tx, &workspace); err != nil {
+		writeAllocationError(w, err)
 		return
 	}
 
-	id, _ := result.LastInsertId()
-	workspace.ID = int(id)
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	events.publish(Event{Type: EventWorkspaceCreated, WorkspaceID: workspace.ID, Data: workspace})
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(workspace)
@@ -227,19 +310,32 @@ func createWorkspace(w http.ResponseWriter, r *http.Request) {
 func createWorkspaceRole(w http.ResponseWriter, r *http.Request) {
 	var role WorkspaceRole
 	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validWorkspaceRole(role.Role) {
+		writeValidationError(w, "Invalid workspace role", ValidationError{Path: "/role", Message: "must be admin or member"})
+		return
+	}
+	// A missing workspace is reported by checkReferences instead
+	if err := authorizeWorkspace(r, role.WorkspaceID, RoleAdmin); err != nil && err != sql.ErrNoRows {
+		writeAuthzError(w, err)
+		return
+	}
+	if !checkReferences(w, reference{"/user_id", "users", "user", role.UserID}, reference{"/workspace_id", "workspaces", "workspace", role.WorkspaceID}) {
 		return
 	}
 
 	result, err := db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)",
 		role.UserID, role.Role, role.WorkspaceID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "Workspace role", err)
 		return
 	}
 
 	id, _ := result.LastInsertId()
 	role.ID = int(id)
+	events.publish(Event{Type: EventRoleGranted, WorkspaceID: role.WorkspaceID, Data: role})
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(role)
@@ -247,57 +343,87 @@ func createWorkspaceRole(w http.ResponseWriter, r *http.Request) {
 
 func getWorkspace(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	var workspace Workspace
-	var ips string
-	err := db.QueryRow("SELECT id, name, user_id, subdomain, ips FROM workspaces WHERE id = ?", params["id"]).
-		Scan(&workspace.ID, &workspace.Name, &workspace.UserID, &workspace.Subdomain, &ips)
+	workspace, err := scanWorkspace(db.QueryRow("SELECT "+workspaceColumns+" FROM workspaces WHERE id = ?", params["id"]))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeDBError(w, "Workspace", err)
 		return
 	}
-	workspace.IPs = strings.Split(ips, ",")
 	json.NewEncoder(w).Encode(workspace)
 }
 
-func (p *IPPool) AllocateIP() (string, error) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-
-	if len(p.available) == 0 {
-		return "", fmt.Errorf("no available IPs")
+// getWorkspaceBySubdomain addresses a workspace by its subdomain instead of
+// its id: GET /workspaces/by-subdomain/{subdomain}
+func getWorkspaceBySubdomain(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	workspace, err := scanWorkspace(db.QueryRow("SELECT "+workspaceColumns+" FROM workspaces WHERE subdomain = ?", params["subdomain"]))
+	if err != nil {
+		writeDBError(w, "Workspace", err)
+		return
 	}
+	json.NewEncoder(w).Encode(workspace)
+}
 
-	ip := p.available[0]
-	p.available = p.available[1:]
-	ipStr := ip.String()
-	p.inUse[ipStr] = true
-
-	return ipStr, nil
+var workspaceRoleList = listSpec{
+	filters: map[string]listFilter{
+		"workspace_id": {"workspace_id", filterInt},
+		"user_id":      {"user_id", filterInt},
+		"role":         {"role", filterString},
+	},
+	sorts: map[string]string{
+		"id":           "id",
+		"workspace_id": "COALESCE(workspace_id, 0)",
+		"user_id":      "COALESCE(user_id, 0)",
+		"role":         "role",
+	},
+	defaultSort: "id",
 }
 
+// getWorkspaceRoles lists the roles in the workspaces the caller can see:
+// GET /workspace-roles[?workspace_id=<id>][&user_id=<id>][&role=<role>]
+// It takes the sort and page parameters described on listSpec.
 func getWorkspaceRoles(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, user_id, role, workspace_id FROM workspace_roles")
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	q, err := parseList(r, workspaceRoleList)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visible, args := visibleWorkspaces(user)
+	q.where("workspace_id IN ("+visible+")", args...)
+
+	rows, err := q.run(workspaceRoleColumns, q.filtered("workspace_roles"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	defer rows.Close()
 
 	roles := []WorkspaceRole{}
-	for rows.Next() {
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
 		var role WorkspaceRole
-		if err := rows.Scan(&role.ID, &role.UserID, &role.Role, &role.WorkspaceID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := row.Scan(&role.ID, &role.UserID, &role.Role, &role.WorkspaceID); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 		roles = append(roles, role)
 	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	q.writeNextPage(w)
 	json.NewEncoder(w).Encode(roles)
 }
 
 func initDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// Write transactions take the database lock up front, so two concurrent
+	// allocations can never both see the same IP as free. Foreign keys are
+	// enforced on every connection, so deletes cascade as the schema says.
+	db, err := sql.Open(sqliteDriver, dbPath+"?_txlock=immediate&_foreign_keys=on")
 	if err != nil {
 		return nil, err
 	}
@@ -306,7 +432,8 @@ func initDB(dbPath string) (*sql.DB, error) {
 		CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			username TEXT NOT NULL UNIQUE,
-			password TEXT NOT NULL
+			password TEXT NOT NULL,
+			revision INTEGER NOT NULL DEFAULT 1
 		);
 		CREATE TABLE IF NOT EXISTS workspaces (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -314,6 +441,8 @@ func initDB(dbPath string) (*sql.DB, error) {
 			user_id INTEGER,
 			subdomain TEXT NOT NULL UNIQUE,
 			ips TEXT NOT NULL,
+			schema_policy TEXT NOT NULL DEFAULT 'allow',
+			revision INTEGER NOT NULL DEFAULT 1,
 			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
 		);
 		CREATE TABLE IF NOT EXISTS apps (
@@ -327,6 +456,8 @@ func initDB(dbPath string) (*sql.DB, error) {
 			workspace_id INTEGER,
 			input_schema TEXT,
 			output_schema TEXT,
+			health_check TEXT,
+			revision INTEGER NOT NULL DEFAULT 0,
 			FOREIGN KEY(workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE
 		);
 		CREATE TABLE IF NOT EXISTS workspace_roles (
@@ -334,6 +465,7 @@ func initDB(dbPath string) (*sql.DB, error) {
 			user_id INTEGER,
 			role TEXT NOT NULL,
 			workspace_id INTEGER,
+			revision INTEGER NOT NULL DEFAULT 1,
 			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
 			FOREIGN KEY(workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE
 		);
@@ -342,9 +474,116 @@ func initDB(dbPath string) (*sql.DB, error) {
 			user_id INTEGER,
 			role TEXT NOT NULL,
 			app_id INTEGER,
+			revision INTEGER NOT NULL DEFAULT 1,
 			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
 			FOREIGN KEY(app_id) REFERENCES apps(id) ON DELETE CASCADE
 		);
+		CREATE TABLE IF NOT EXISTS ip_pools (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			cidr TEXT NOT NULL,
+			gateway TEXT NOT NULL DEFAULT '',
+			excluded TEXT NOT NULL DEFAULT '',
+			revision INTEGER NOT NULL DEFAULT 1
+		);
+		CREATE TABLE IF NOT EXISTS ip_leases (
+			ip TEXT PRIMARY KEY,
+			workspace_id INTEGER NOT NULL,
+			pool_id INTEGER,
+			allocated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY(workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+			FOREIGN KEY(pool_id) REFERENCES ip_pools(id)
+		);
+		CREATE TABLE IF NOT EXISTS app_instances (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			app_id INTEGER NOT NULL,
+			address TEXT NOT NULL,
+			weight INTEGER NOT NULL DEFAULT 1,
+			zone TEXT NOT NULL DEFAULT '',
+			metadata TEXT NOT NULL DEFAULT '{}',
+			healthy BOOLEAN NOT NULL DEFAULT 1,
+			ttl INTEGER NOT NULL DEFAULT 0,
+			last_heartbeat DATETIME,
+			revision INTEGER NOT NULL DEFAULT 1,
+			FOREIGN KEY(app_id) REFERENCES apps(id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS app_revisions (
+			app_id INTEGER NOT NULL,
+			revision INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL,
+			git_hash TEXT NOT NULL,
+			ip_port TEXT NOT NULL,
+			endpoint TEXT NOT NULL,
+			version TEXT NOT NULL,
+			workspace_id INTEGER NOT NULL,
+			input_schema TEXT NOT NULL,
+			output_schema TEXT NOT NULL,
+			health_check TEXT NOT NULL,
+			author_id INTEGER NOT NULL,
+			rollback_of INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY(app_id, revision),
+			FOREIGN KEY(app_id) REFERENCES apps(id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS meta (
+			key TEXT PRIMARY KEY,
+			value INTEGER NOT NULL
+		);
+		INSERT OR IGNORE INTO meta (key, value) VALUES ('registry_index', 0);
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Databases created before pools were configurable
+	if err := ensureColumn(db, "ip_leases", "pool_id", "INTEGER REFERENCES ip_pools(id)"); err != nil {
+		return nil, err
+	}
+	// Databases created before apps were health checked
+	if err := ensureColumn(db, "apps", "health_check", "TEXT"); err != nil {
+		return nil, err
+	}
+	// Databases created before instances could expire
+	if err := ensureColumn(db, "app_instances", "ttl", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := ensureColumn(db, "app_instances", "last_heartbeat", "DATETIME"); err != nil {
+		return nil, err
+	}
+	// Databases created before workspaces had a schema policy
+	if err := ensureColumn(db, "workspaces", "schema_policy", "TEXT NOT NULL DEFAULT 'allow'"); err != nil {
+		return nil, err
+	}
+	// Databases created before schemas were stored compacted
+	if err := normalizeSchemas(db); err != nil {
+		return nil, err
+	}
+	// Databases created before app revisions were kept
+	if err := ensureColumn(db, "apps", "revision", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := backfillRevisions(db); err != nil {
+		return nil, err
+	}
+	// Databases created before every resource had an ETag
+	for _, table := range []string{"users", "workspaces", "workspace_roles", "app_roles", "app_instances", "ip_pools"} {
+		if err := ensureColumn(db, table, "revision", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Databases created before foreign keys were enforced
+	if err := checkDanglingReferences(db); err != nil {
+		return nil, err
+	}
+
+	// Start out with the ranges the service has always used
+	_, err = db.Exec(`
+		INSERT INTO ip_pools (name, cidr)
+		SELECT 'default-10', '10.0.0.0/16' WHERE NOT EXISTS (SELECT 1 FROM ip_pools)
+		UNION ALL
+		SELECT 'default-172', '172.16.0.0/16' WHERE NOT EXISTS (SELECT 1 FROM ip_pools)
 	`)
 	if err != nil {
 		return nil, err
@@ -353,75 +592,143 @@ func initDB(dbPath string) (*sql.DB, error) {
 	return db, nil
 }
 
+// ensureColumn adds a column to a table created by an earlier version of the service.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func updateAppRole(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	var role AppRole
 	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validAppRole(role.Role) {
+		writeValidationError(w, "Invalid app role", ValidationError{Path: "/role", Message: "must be developer or user"})
+		return
+	}
+	// The role may be moved to another app, which the caller must also
+	// develop; a missing app is reported by checkReferences instead
+	if err := authorizeApp(r, role.AppID, RoleDeveloper); err != nil && err != sql.ErrNoRows {
+		writeAuthzError(w, err)
+		return
+	}
+	if !checkReferences(w, reference{"/user_id", "users", "user", role.UserID}, reference{"/app_id", "apps", "app", role.AppID}) {
 		return
 	}
 
-	_, err := db.Exec("UPDATE app_roles SET user_id = ?, role = ?, app_id = ? WHERE id = ?",
+	err := execIfMatch(db, r, "UPDATE app_roles SET user_id = ?, role = ?, app_id = ?, revision = revision + 1 WHERE id = ?",
 		role.UserID, role.Role, role.AppID, params["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "App role", err)
 		return
 	}
+	role.ID, _ = strconv.Atoi(params["id"])
+	events.publish(Event{Type: EventRoleChanged, WorkspaceID: workspaceOfApp(role.AppID), Data: role})
 
 	json.NewEncoder(w).Encode(role)
 }
 
+func getWorkspaceRole(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var role WorkspaceRole
+	err := db.QueryRow("SELECT "+workspaceRoleColumns+" FROM workspace_roles WHERE id = ?", params["id"]).Scan(&role.ID, &role.UserID, &role.Role, &role.WorkspaceID)
+	if err != nil {
+		writeDBError(w, "Workspace role", err)
+		return
+	}
+	json.NewEncoder(w).Encode(role)
+}
+
+func getAppRole(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var role AppRole
+	err := db.QueryRow("SELECT "+appRoleColumns+" FROM app_roles WHERE id = ?", params["id"]).Scan(&role.ID, &role.UserID, &role.Role, &role.AppID)
+	if err != nil {
+		writeDBError(w, "App role", err)
+		return
+	}
+	json.NewEncoder(w).Encode(role)
+}
+
 func deleteWorkspaceRole(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	_, err := db.Exec("DELETE FROM workspace_roles WHERE id = ?", params["id"])
+	id, _ := strconv.Atoi(params["id"])
+	workspaceID, _ := workspaceOfWorkspaceRole(id)
+	err := execIfMatch(db, r, "DELETE FROM workspace_roles WHERE id = ?", params["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "Workspace role", err)
 		return
 	}
+	events.publish(Event{Type: EventRoleRevoked, WorkspaceID: workspaceID, Data: deleted{id}})
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// generateSubdomain returns a random subdomain. It may already be taken;
+// insertWorkspace picks another when it is.
 func generateSubdomain() string {
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
-	for {
-		result := make([]byte, 8)
-		for i := range result {
-			result[i] = chars[rand.Intn(len(chars))]
-		}
-		subdomain := string(result)
-		if !subdomains[subdomain] {
-			subdomains[subdomain] = true
-			return subdomain
-		}
+	result := make([]byte, 8)
+	for i := range result {
+		result[i] = chars[rand.Intn(len(chars))]
 	}
+	return string(result)
 }
 
 func createUser(w http.ResponseWriter, r *http.Request) {
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var body userPatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	user := User{Username: body.Username, Password: body.Password}
 
 	// Validate email
 	_, err := mail.ParseAddress(user.Username)
 	if err != nil {
-		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		writeValidationError(w, "Invalid email address", ValidationError{Path: "/username", Message: "must be an email address"})
+		return
+	}
+	if user.Password == "" {
+		writeValidationError(w, "Password required", ValidationError{Path: "/password", Message: "must not be empty"})
 		return
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Failed to hash password")
 		return
 	}
 
-	result, err := db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", user.Username, string(hashedPassword))
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO users (username, password) VALUES (?, ?)", user.Username, string(hashedPassword))
+	if err != nil {
+		writeDBError(w, "User", err)
 		return
 	}
 
@@ -429,81 +736,238 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	user.ID = int(id)
 
 	// Create default workspace for the user
-	subdomain := generateSubdomain()
-	ip, err := ipPool.AllocateIP()
-	if err != nil {
-		http.Error(w, "Failed to allocate IP", http.StatusInternalServerError)
+	workspace := Workspace{Name: "default", UserID: user.ID}
+	if err := insertWorkspace(tx, &workspace); err != nil {
+		writeAllocationError(w, err)
 		return
 	}
 
-	_, err = db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)",
-		"default", user.ID, subdomain, ip)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	bindOperator(user.ID, user.Username)
+	events.publish(Event{Type: EventUserCreated, Data: user})
+	events.publish(Event{Type: EventWorkspaceCreated, WorkspaceID: workspace.ID, Data: workspace})
 
 	user.Password = "" // Don't send password back
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
 }
 
+// workspaceColumns selects the columns of a workspace row in the order
+// scanWorkspace expects.
+const workspaceColumns = "id, name, COALESCE(user_id, 0), subdomain, ips, schema_policy"
+
+func scanWorkspace(row rowScanner) (Workspace, error) {
+	var workspace Workspace
+	var ips string
+	err := row.Scan(&workspace.ID, &workspace.Name, &workspace.UserID, &workspace.Subdomain, &ips, &workspace.SchemaPolicy)
+	workspace.IPs = splitIPs(ips)
+	return workspace, err
+}
+
+// workspaceRoleColumns and appRoleColumns select a role row. References are
+// NULL where -null-dangling-references cleared them.
+const (
+	workspaceRoleColumns = "id, COALESCE(user_id, 0), role, COALESCE(workspace_id, 0)"
+	appRoleColumns       = "id, COALESCE(user_id, 0), role, COALESCE(app_id, 0)"
+)
+
+// appColumns selects the columns of an app row in the order scanApp expects.
+const appColumns = "id, name, COALESCE(description, ''), COALESCE(git_hash, ''), ip_port, COALESCE(endpoint, ''), COALESCE(version, ''), COALESCE(workspace_id, 0), COALESCE(input_schema, ''), COALESCE(output_schema, ''), COALESCE(health_check, ''), revision"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanApp(row rowScanner) (App, error) {
+	var app App
+	var healthCheck string
+	err := row.Scan(&app.ID, &app.Name, &app.Description, &app.GitHash, &app.IPPort, &app.Endpoint, &app.Version, &app.WorkspaceID, &app.InputSchema, &app.OutputSchema, &healthCheck, &app.Revision)
+	app.HealthCheck = unmarshalHealthCheck(healthCheck)
+	return app, err
+}
+
 func getApp(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	var app App
-	err := db.QueryRow("SELECT id, name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema FROM apps WHERE id = ?", params["id"]).
-		Scan(&app.ID, &app.Name, &app.Description, &app.GitHash, &app.IPPort, &app.Endpoint, &app.Version, &app.WorkspaceID, &app.InputSchema, &app.OutputSchema)
+	app, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", params["id"]))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeDBError(w, "App", err)
 		return
 	}
+	app.Health = appHealth(app.ID)
 	json.NewEncoder(w).Encode(app)
 }
 
 func main() {
 	flag.IntVar(&port, "port", 8080, "Port to start the service on")
 	flag.StringVar(&bindAddress, "bind", "", "IP address to bind the service to")
+	secret := flag.String("token-secret", os.Getenv("DISCOVER_TOKEN_SECRET"), "Secret used to sign bearer tokens (defaults to $DISCOVER_TOKEN_SECRET)")
+	flag.DurationVar(&accessTokenTTL, "access-token-ttl", 15*time.Minute, "Lifetime of access tokens")
+	flag.DurationVar(&refreshTokenTTL, "refresh-token-ttl", 7*24*time.Hour, "Lifetime of refresh tokens")
+	poolConfig := flag.String("pool-config", "", "JSON file declaring IP pools")
+	operatorList := flag.String("operators", "", "Comma-separated usernames whose accounts may manage IP pools and create accounts")
+	flag.BoolVar(&openSignup, "open-signup", false, "Let anyone create an account, at most 5 per client address per hour")
+	flag.DurationVar(&reapInterval, "reap-interval", 5*time.Second, "How often to look for instances that missed their heartbeat")
+	flag.DurationVar(&deregisterAfter, "deregister-after", time.Minute, "How long an expired instance stays registered as unhealthy before it is removed")
+	flag.DurationVar(&healthInterval, "health-interval", 10*time.Second, "How often to probe app instances (0 disables health checks)")
+	flag.IntVar(&healthWorkers, "health-workers", 8, "Maximum number of concurrent health checks")
+	flag.StringVar(&dnsAddr, "dns-addr", "", "UDP address to serve DNS on, e.g. :5353 (disabled if empty)")
+	flag.StringVar(&dnsZone, "dns-zone", "discover.local.", "DNS zone that workspace subdomains live in")
+	flag.StringVar(&proxyAddr, "proxy-addr", "", "Address to serve the reverse proxy to apps on, e.g. :8000 (disabled if empty)")
+	flag.StringVar(&proxyDomain, "proxy-domain", "discover.local", "Domain whose subdomains the reverse proxy routes to workspaces")
+	flag.DurationVar(&proxyTimeout, "proxy-timeout", 30*time.Second, "Time to wait for an app instance's response headers (0 = no limit)")
+	flag.IntVar(&proxyRetries, "proxy-retries", 2, "How many other instances the reverse proxy tries when one fails")
+	flag.BoolVar(&requireIfMatch, "require-if-match", false, "Reject updates and deletes of resources that do not send If-Match")
+	flag.BoolVar(&nullDanglingReferences, "null-dangling-references", false, "Set references to deleted rows to NULL, or delete the rows where they cannot be NULL, at startup instead of refusing to start")
 	flag.Parse()
 
-	initDB("./discovery.db")
+	operators = make(map[string]bool)
+	for _, username := range strings.Split(*operatorList, ",") {
+		if username != "" {
+			operators[username] = true
+		}
+	}
+
+	if *secret != "" {
+		tokenSecret = []byte(*secret)
+	} else {
+		log.Printf("No token secret configured, using a random one; issued tokens will not survive a restart")
+		tokenSecret = randomSecret()
+	}
+
+	var err error
+	db, err = initDB("./discovery.db")
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer db.Close()
 
-	ipPool = NewIPPool()
+	if *poolConfig != "" {
+		if err := loadPoolConfig(*poolConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := loadOperators(); err != nil {
+		log.Fatal(err)
+	}
+	if err := restoreAllocations(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRegistryIndex(); err != nil {
+		log.Fatal(err)
+	}
+	go runReaper()
+	if healthInterval > 0 {
+		go runHealthChecker()
+	}
+	if dnsAddr != "" {
+		dns, err := startDNSServer(dnsAddr, dnsZone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer dns.Close()
+		log.Printf("DNS server for %s listening on %s", dnsZone, dns.Addr())
+	}
+	if proxyAddr != "" {
+		go func() {
+			log.Printf("Reverse proxy for *.%s listening on %s", proxyDomain, proxyAddr)
+			log.Fatal(http.ListenAndServe(proxyAddr, newAppProxy(proxyDomain, proxyTimeout, proxyRetries)))
+		}()
+	}
 
 	r := mux.NewRouter()
+	routeErrors(r)
+
+	// Public routes
+	r.HandleFunc("/login", login).Methods("POST")
+	r.HandleFunc("/token/refresh", refreshToken).Methods("POST")
+	r.HandleFunc("/users", signupGate(createUser)).Methods("POST")
+
+	// Event streams, which also accept the access token as ?access_token
+	stream := r.PathPrefix("/events").Subrouter()
+	stream.Use(queryToken, authMiddleware)
+	stream.HandleFunc("/stream", streamEvents).Methods("GET")
+	stream.HandleFunc("/ws", streamEventsWS).Methods("GET")
+
+	// Everything else requires a bearer token
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(authMiddleware)
 
 	// User routes
-	r.HandleFunc("/users", createUser).Methods("POST")
-	r.HandleFunc("/users", getUsers).Methods("GET")
-	r.HandleFunc("/users/{id:[0-9]+}", getUser).Methods("GET")
-	r.HandleFunc("/users/{id:[0-9]+}", updateUser).Methods("PUT")
-	r.HandleFunc("/users/{id:[0-9]+}", deleteUser).Methods("DELETE")
+	api.HandleFunc("/users", blockingQuery(getUsers)).Methods("GET")
+	api.HandleFunc("/users/{id:[0-9]+}", blockingQuery(conditional(getUser, "users"))).Methods("GET")
+	api.HandleFunc("/users/{id:[0-9]+}", requireSelf(conditional(updateUser, "users"))).Methods("PUT")
+	api.HandleFunc("/users/{id:[0-9]+}", requireSelf(conditional(patchUser, "users"))).Methods("PATCH")
+	api.HandleFunc("/users/{id:[0-9]+}", requireSelf(conditional(deleteUser, "users"))).Methods("DELETE")
+	api.HandleFunc("/users/{id:[0-9]+}/workspaces", requireExistingUser(blockingQuery(nestedList(getWorkspaces, "member_id")))).Methods("GET")
 
 	// Workspace routes
-	r.HandleFunc("/workspaces", createWorkspace).Methods("POST")
-	r.HandleFunc("/workspaces", getWorkspaces).Methods("GET")
-	r.HandleFunc("/workspaces/{id:[0-9]+}", getWorkspace).Methods("GET")
-	r.HandleFunc("/workspaces/{id:[0-9]+}", updateWorkspace).Methods("PUT")
-	r.HandleFunc("/workspaces/{id:[0-9]+}", deleteWorkspace).Methods("DELETE")
+	api.HandleFunc("/workspaces", createWorkspace).Methods("POST")
+	api.HandleFunc("/workspaces", blockingQuery(getWorkspaces)).Methods("GET")
+	api.HandleFunc("/workspaces/{id:[0-9]+}", requireWorkspaceRole(blockingQuery(conditional(getWorkspace, "workspaces")), sameID, RoleMember)).Methods("GET")
+	api.HandleFunc("/workspaces/{id:[0-9]+}", requireWorkspaceRole(conditional(updateWorkspace, "workspaces"), sameID, RoleAdmin)).Methods("PUT")
+	api.HandleFunc("/workspaces/{id:[0-9]+}", requireWorkspaceRole(conditional(patchWorkspace, "workspaces"), sameID, RoleAdmin)).Methods("PATCH")
+	api.HandleFunc("/workspaces/{id:[0-9]+}", requireWorkspaceRole(conditional(deleteWorkspace, "workspaces"), sameID, RoleAdmin)).Methods("DELETE")
+	api.HandleFunc("/workspaces/by-subdomain/{subdomain}", requireSubdomainRole(blockingQuery(conditionalBy(getWorkspaceBySubdomain, "workspaces", "subdomain", "subdomain")), RoleMember)).Methods("GET")
+	api.HandleFunc("/workspaces/{id:[0-9]+}/apps", requireWorkspaceRole(blockingQuery(nestedList(getApps, "workspace_id")), sameID, RoleMember)).Methods("GET")
+	api.HandleFunc("/workspaces/{id:[0-9]+}/roles", requireWorkspaceRole(blockingQuery(nestedList(getWorkspaceRoles, "workspace_id")), sameID, RoleMember)).Methods("GET")
 
 	// App routes
-	r.HandleFunc("/apps", createApp).Methods("POST")
-	r.HandleFunc("/apps", getApps).Methods("GET")
-	r.HandleFunc("/apps/{id:[0-9]+}", getApp).Methods("GET")
-	r.HandleFunc("/apps/{id:[0-9]+}", updateApp).Methods("PUT")
-	r.HandleFunc("/apps/{id:[0-9]+}", deleteApp).Methods("DELETE")
+	api.HandleFunc("/apps", createApp).Methods("POST")
+	api.HandleFunc("/apps", blockingQuery(getApps)).Methods("GET")
+	api.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(blockingQuery(conditional(getApp, "apps")), sameID, RoleUser)).Methods("GET")
+	api.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(conditional(updateApp, "apps"), sameID, RoleDeveloper)).Methods("PUT")
+	api.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(conditional(patchApp, "apps"), sameID, RoleDeveloper)).Methods("PATCH")
+	api.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(conditional(deleteApp, "apps"), sameID, RoleDeveloper)).Methods("DELETE")
+
+	// App schema routes
+	api.HandleFunc("/apps/{id:[0-9]+}/validate", requireAppRole(validateAppPayload, sameID, RoleUser)).Methods("POST")
+	api.HandleFunc("/apps/{id:[0-9]+}/invoke", requireAppRole(invokeApp, sameID, RoleUser)).Methods("POST")
+
+	// App revision routes
+	api.HandleFunc("/apps/{id:[0-9]+}/revisions", requireAppRole(blockingQuery(getAppRevisions), sameID, RoleUser)).Methods("GET")
+	api.HandleFunc("/apps/{id:[0-9]+}/revisions/{revision:[0-9]+}", requireAppRole(getAppRevision, sameID, RoleUser)).Methods("GET")
+	api.HandleFunc("/apps/{id:[0-9]+}/revisions/{revision:[0-9]+}/diff", requireAppRole(diffAppRevisions, sameID, RoleUser)).Methods("GET")
+	api.HandleFunc("/apps/{id:[0-9]+}/revisions/{revision:[0-9]+}/rollback", requireAppRole(conditional(rollbackApp, "apps"), sameID, RoleDeveloper)).Methods("POST")
+
+	// App instance routes
+	api.HandleFunc("/apps/{id:[0-9]+}/instances", requireAppRole(blockingQuery(getInstances), sameID, RoleUser)).Methods("GET")
+	api.HandleFunc("/apps/{id:[0-9]+}/instances", requireAppRole(createInstance, sameID, RoleDeveloper)).Methods("POST")
+	api.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}", requireAppRole(conditionalBy(getInstance, "app_instances", "id", "instance_id"), sameID, RoleUser)).Methods("GET")
+	api.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}", requireAppRole(conditionalBy(updateInstance, "app_instances", "id", "instance_id"), sameID, RoleDeveloper)).Methods("PUT")
+	api.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}", requireAppRole(conditionalBy(deleteInstance, "app_instances", "id", "instance_id"), sameID, RoleDeveloper)).Methods("DELETE")
+	api.HandleFunc("/apps/{id:[0-9]+}/instances/{instance_id:[0-9]+}/heartbeat", requireAppRole(heartbeatInstance, sameID, RoleDeveloper)).Methods("PUT")
+
+	// Workspace IP routes
+	api.HandleFunc("/workspaces/{id:[0-9]+}/ips", requireWorkspaceRole(addWorkspaceIP, sameID, RoleAdmin)).Methods("POST")
+	api.HandleFunc("/workspaces/{id:[0-9]+}/ips/{ip}", requireWorkspaceRole(releaseWorkspaceIP, sameID, RoleAdmin)).Methods("DELETE")
+	api.HandleFunc("/ips", blockingQuery(getIPs)).Methods("GET")
+
+	// IP pool routes
+	api.HandleFunc("/ip-pools", requireOperator(createIPPool)).Methods("POST")
+	api.HandleFunc("/ip-pools", blockingQuery(getIPPools)).Methods("GET")
+	api.HandleFunc("/ip-pools/{id:[0-9]+}", blockingQuery(conditional(getIPPool, "ip_pools"))).Methods("GET")
+	api.HandleFunc("/ip-pools/{id:[0-9]+}", requireOperator(conditional(deleteIPPool, "ip_pools"))).Methods("DELETE")
+
+	// Discovery routes
+	api.HandleFunc("/resolve", blockingQuery(resolveApp)).Methods("GET")
 
 	// Workspace role routes
-	r.HandleFunc("/workspace-roles", createWorkspaceRole).Methods("POST")
-	r.HandleFunc("/workspace-roles", getWorkspaceRoles).Methods("GET")
-	r.HandleFunc("/workspace-roles/{id:[0-9]+}", updateWorkspaceRole).Methods("PUT")
-	r.HandleFunc("/workspace-roles/{id:[0-9]+}", deleteWorkspaceRole).Methods("DELETE")
+	api.HandleFunc("/workspace-roles", createWorkspaceRole).Methods("POST")
+	api.HandleFunc("/workspace-roles", blockingQuery(getWorkspaceRoles)).Methods("GET")
+	api.HandleFunc("/workspace-roles/{id:[0-9]+}", requireWorkspaceRole(conditional(getWorkspaceRole, "workspace_roles"), workspaceOfWorkspaceRole, RoleMember)).Methods("GET")
+	api.HandleFunc("/workspace-roles/{id:[0-9]+}", requireWorkspaceRole(conditional(updateWorkspaceRole, "workspace_roles"), workspaceOfWorkspaceRole, RoleAdmin)).Methods("PUT")
+	api.HandleFunc("/workspace-roles/{id:[0-9]+}", requireWorkspaceRole(conditional(deleteWorkspaceRole, "workspace_roles"), workspaceOfWorkspaceRole, RoleAdmin)).Methods("DELETE")
 
 	// App role routes
-	r.HandleFunc("/app-roles", createAppRole).Methods("POST")
-	r.HandleFunc("/app-roles", getAppRoles).Methods("GET")
-	r.HandleFunc("/app-roles/{id:[0-9]+}", updateAppRole).Methods("PUT")
-	r.HandleFunc("/app-roles/{id:[0-9]+}", deleteAppRole).Methods("DELETE")
+	api.HandleFunc("/app-roles", createAppRole).Methods("POST")
+	api.HandleFunc("/app-roles", blockingQuery(getAppRoles)).Methods("GET")
+	api.HandleFunc("/app-roles/{id:[0-9]+}", requireAppRole(conditional(getAppRole, "app_roles"), appOfAppRole, RoleUser)).Methods("GET")
+	api.HandleFunc("/app-roles/{id:[0-9]+}", requireAppRole(conditional(updateAppRole, "app_roles"), appOfAppRole, RoleDeveloper)).Methods("PUT")
+	api.HandleFunc("/app-roles/{id:[0-9]+}", requireAppRole(conditional(deleteAppRole, "app_roles"), appOfAppRole, RoleDeveloper)).Methods("DELETE")
+	api.HandleFunc("/apps/{id:[0-9]+}/roles", requireAppRole(blockingQuery(nestedList(getAppRoles, "app_id")), sameID, RoleUser)).Methods("GET")
 
 	addr := fmt.Sprintf("%s:%d", bindAddress, port)
 	log.Printf("Server starting on %s", addr)
@@ -512,62 +976,178 @@ func main() {
 
 func deleteAppRole(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	_, err := db.Exec("DELETE FROM app_roles WHERE id = ?", params["id"])
+	id, _ := strconv.Atoi(params["id"])
+	appID, _ := appOfAppRole(id)
+	workspaceID := workspaceOfApp(appID)
+	err := execIfMatch(db, r, "DELETE FROM app_roles WHERE id = ?", params["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "App role", err)
 		return
 	}
+	events.publish(Event{Type: EventRoleRevoked, WorkspaceID: workspaceID, Data: deleted{id}})
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func updateUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var body userPatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	user := User{Username: body.Username, Password: body.Password}
 
 	// Validate email
 	_, err := mail.ParseAddress(user.Username)
 	if err != nil {
-		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		writeValidationError(w, "Invalid email address", ValidationError{Path: "/username", Message: "must be an email address"})
+		return
+	}
+	var current string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = ?", params["id"]).Scan(&current); err != nil {
+		writeDBError(w, "User", err)
+		return
+	}
+	if !renameAllowed(current, user.Username) {
+		writeAuthzError(w, errForbidden)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	// Without a password the stored one is kept, rather than rehashing ""
+	if user.Password != "" {
+		var hashedPassword []byte
+		if hashedPassword, err = bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to hash password")
+			return
+		}
+		err = execIfMatch(db, r, "UPDATE users SET username = ?, password = ?, revision = revision + 1 WHERE id = ?", user.Username, string(hashedPassword), params["id"])
+	} else {
+		err = execIfMatch(db, r, "UPDATE users SET username = ?, revision = revision + 1 WHERE id = ?", user.Username, params["id"])
+	}
 	if err != nil {
-		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		writeDBError(w, "User", err)
 		return
 	}
+	user.ID, _ = strconv.Atoi(params["id"])
+	events.publish(Event{Type: EventUserUpdated, Data: user})
+
+	user.Password = "" // Don't send password back
+	json.NewEncoder(w).Encode(user)
+}
 
-	_, err = db.Exec("UPDATE users SET username = ?, password = ? WHERE id = ?", user.Username, string(hashedPassword), params["id"])
+// userPatch is the form of a user in request bodies and patches, which
+// unlike User carries the password in JSON.
+type userPatch struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// patchUser changes the username, the password or both: PATCH /users/{id}
+// with a merge patch or JSON Patch body. The password is only rehashed when
+// the patch sets one.
+func patchUser(w http.ResponseWriter, r *http.Request) {
+	var current User
+	err := db.QueryRow("SELECT id, username FROM users WHERE id = ?", mux.Vars(r)["id"]).Scan(&current.ID, &current.Username)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "User", err)
+		return
+	}
+	var patched userPatch
+	if err := readPatch(r, current, &patched); err != nil {
+		writePatchError(w, err)
+		return
+	}
+	if patched.ID != current.ID {
+		writeError(w, http.StatusBadRequest, "id cannot be changed")
+		return
+	}
+	if _, err := mail.ParseAddress(patched.Username); err != nil {
+		writeValidationError(w, "Invalid email address", ValidationError{Path: "/username", Message: "must be an email address"})
+		return
+	}
+	if !renameAllowed(current.Username, patched.Username) {
+		writeAuthzError(w, errForbidden)
 		return
 	}
 
-	user.Password = "" // Don't send password back
+	if patched.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(patched.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to hash password")
+			return
+		}
+		err = execIfMatch(db, r, "UPDATE users SET username = ?, password = ?, revision = revision + 1 WHERE id = ?", patched.Username, string(hashedPassword), current.ID)
+	} else {
+		err = execIfMatch(db, r, "UPDATE users SET username = ?, revision = revision + 1 WHERE id = ?", patched.Username, current.ID)
+	}
+	if err != nil {
+		writeDBError(w, "User", err)
+		return
+	}
+
+	var user User
+	if err := db.QueryRow("SELECT id, username FROM users WHERE id = ?", current.ID).Scan(&user.ID, &user.Username); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	events.publish(Event{Type: EventUserUpdated, Data: user})
 	json.NewEncoder(w).Encode(user)
 }
 
 func createApp(w http.ResponseWriter, r *http.Request) {
 	var app App
 	if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !checkApp(w, r, &app) {
+		return
+	}
+
+	previous, found, err := previousAppVersion(app)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if found && !checkCompatibility(w, previous, &app) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	result, err := db.Exec("INSERT INTO apps (name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		app.Name, app.Description, app.GitHash, app.IPPort, app.Endpoint, app.Version, app.WorkspaceID, app.InputSchema, app.OutputSchema)
+	result, err := tx.Exec("INSERT INTO apps (name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema, health_check) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		app.Name, app.Description, app.GitHash, app.IPPort, app.Endpoint, app.Version, app.WorkspaceID, app.InputSchema, app.OutputSchema, marshalHealthCheck(app.HealthCheck))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "App", err)
 		return
 	}
 
 	id, _ := result.LastInsertId()
 	app.ID = int(id)
 
+	// The creator can always modify and deploy their own app
+	user, _ := currentUser(r)
+	_, err = tx.Exec("INSERT INTO app_roles (user_id, role, app_id) VALUES (?, ?, ?)", user.ID, RoleDeveloper, app.ID)
+	if err != nil {
+		writeDBError(w, "App role", err)
+		return
+	}
+	if err := recordRevision(tx, &app, user.ID, 0); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	events.publish(Event{Type: EventAppRegistered, WorkspaceID: app.WorkspaceID, Data: app})
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(app)
 }
@@ -575,119 +1155,497 @@ func createApp(w http.ResponseWriter, r *http.Request) {
 func createAppRole(w http.ResponseWriter, r *http.Request) {
 	var role AppRole
 	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !validAppRole(role.Role) {
+		writeValidationError(w, "Invalid app role", ValidationError{Path: "/role", Message: "must be developer or user"})
+		return
+	}
+	// A missing app is reported by checkReferences instead
+	if err := authorizeApp(r, role.AppID, RoleDeveloper); err != nil && err != sql.ErrNoRows {
+		writeAuthzError(w, err)
+		return
+	}
+	if !checkReferences(w, reference{"/user_id", "users", "user", role.UserID}, reference{"/app_id", "apps", "app", role.AppID}) {
 		return
 	}
 
 	result, err := db.Exec("INSERT INTO app_roles (user_id, role, app_id) VALUES (?, ?, ?)",
 		role.UserID, role.Role, role.AppID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "App role", err)
 		return
 	}
 
 	id, _ := result.LastInsertId()
 	role.ID = int(id)
+	events.publish(Event{Type: EventRoleGranted, WorkspaceID: workspaceOfApp(role.AppID), Data: role})
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(role)
 }
 
 func updateApp(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
 	var app App
 	if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	app.ID, _ = strconv.Atoi(mux.Vars(r)["id"])
+	saveApp(w, r, app)
+}
 
-	_, err := db.Exec("UPDATE apps SET name = ?, description = ?, git_hash = ?, ip_port = ?, endpoint = ?, version = ?, workspace_id = ?, input_schema = ?, output_schema = ? WHERE id = ?",
-		app.Name, app.Description, app.GitHash, app.IPPort, app.Endpoint, app.Version, app.WorkspaceID, app.InputSchema, app.OutputSchema, params["id"])
+// patchApp changes only the fields of an app that the patch mentions:
+// PATCH /apps/{id} with a merge patch or JSON Patch body
+func patchApp(w http.ResponseWriter, r *http.Request) {
+	current, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", mux.Vars(r)["id"]))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "App", err)
+		return
+	}
+	var app App
+	if err := readPatch(r, current, &app); err != nil {
+		writePatchError(w, err)
+		return
+	}
+	if app.ID != current.ID || app.Revision != current.Revision {
+		writeError(w, http.StatusBadRequest, "id and revision cannot be changed")
 		return
 	}
+	app.Health, app.Compatibility = nil, nil
+	saveApp(w, r, app)
+}
 
-	json.NewEncoder(w).Encode(app)
+// checkApp reports whether app is valid, normalizing its version, and the
+// caller belongs to its workspace. When it is not, the rejection has been
+// written to w.
+func checkApp(w http.ResponseWriter, r *http.Request, app *App) bool {
+	if err := validateHealthCheck(app.HealthCheck); err != nil {
+		writeValidationError(w, "Invalid app", ValidationError{Path: "/health_check", Message: err.Error()})
+		return false
+	}
+	if err := normalizeAppVersion(app); err != nil {
+		writeValidationError(w, "Invalid app", ValidationError{Path: "/version", Message: err.Error()})
+		return false
+	}
+	if errs := checkAppSchemas(*app); len(errs) > 0 {
+		writeSchemaErrors(w, http.StatusBadRequest, "Invalid JSON Schema", errs)
+		return false
+	}
+	// A missing workspace is reported by checkReferences instead
+	if err := authorizeWorkspace(r, app.WorkspaceID, RoleAdmin, RoleMember); err != nil && err != sql.ErrNoRows {
+		writeAuthzError(w, err)
+		return false
+	}
+	return checkReferences(w, reference{"/workspace_id", "workspaces", "workspace", app.WorkspaceID})
+}
+
+// saveApp validates app and writes it over the current version of the app,
+// recording a new revision, and responds with the app as stored.
+func saveApp(w http.ResponseWriter, r *http.Request, app App) {
+	// The app may be moved to another workspace, which the caller must belong to
+	if !checkApp(w, r, &app) {
+		return
+	}
+
+	// The app replaces its own current version
+	previous, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", app.ID))
+	if err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+	if !checkCompatibility(w, previous, &app) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if err := updateAppRow(tx, r, app); err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+	user, _ := currentUser(r)
+	if err := recordRevision(tx, &app, user.ID, 0); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	saved, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", app.ID))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	saved.Compatibility = app.Compatibility
+	events.publish(Event{Type: EventAppUpdated, WorkspaceID: saved.WorkspaceID, Data: saved})
+
+	saved.Health = appHealth(saved.ID)
+	json.NewEncoder(w).Encode(saved)
 }
 
 func updateWorkspace(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
 	var workspace Workspace
 	if err := json.NewDecoder(r.Body).Decode(&workspace); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	workspace.ID, _ = strconv.Atoi(mux.Vars(r)["id"])
+	saveWorkspace(w, r, workspace)
+}
 
-	_, err := db.Exec("UPDATE workspaces SET name = ?, user_id = ? WHERE id = ?",
-		workspace.Name, workspace.UserID, params["id"])
+// patchWorkspace changes only the fields of a workspace that the patch
+// mentions: PATCH /workspaces/{id} with a merge patch or JSON Patch body
+func patchWorkspace(w http.ResponseWriter, r *http.Request) {
+	current, err := scanWorkspace(db.QueryRow("SELECT "+workspaceColumns+" FROM workspaces WHERE id = ?", mux.Vars(r)["id"]))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, "Workspace", err)
 		return
 	}
+	var workspace Workspace
+	if err := readPatch(r, current, &workspace); err != nil {
+		writePatchError(w, err)
+		return
+	}
+	// IPs are allocated and released through /workspaces/{id}/ips
+	if workspace.ID != current.ID || workspace.Subdomain != current.Subdomain || !reflect.DeepEqual(workspace.IPs, current.IPs) || workspace.Pool != "" {
+		writeError(w, http.StatusBadRequest, "id, subdomain, ips and pool cannot be changed")
+		return
+	}
+	saveWorkspace(w, r, workspace)
+}
 
-	json.NewEncoder(w).Encode(workspace)
+// saveWorkspace writes the name, owner and schema policy of workspace and
+// responds with the workspace as stored. Without a user_id the owner is kept;
+// only the owner or an operator may change it.
+func saveWorkspace(w http.ResponseWriter, r *http.Request, workspace Workspace) {
+	if workspace.SchemaPolicy == "" {
+		workspace.SchemaPolicy = SchemaPolicyAllow
+	}
+	if !validSchemaPolicy(workspace.SchemaPolicy) {
+		writeValidationError(w, "Invalid schema policy", ValidationError{Path: "/schema_policy", Message: "must be allow or reject-breaking"})
+		return
+	}
+	var owner int
+	if err := db.QueryRow("SELECT COALESCE(user_id, 0) FROM workspaces WHERE id = ?", workspace.ID).Scan(&owner); err != nil {
+		writeDBError(w, "Workspace", err)
+		return
+	}
+	if workspace.UserID == 0 {
+		workspace.UserID = owner
+	} else if user, _ := currentUser(r); workspace.UserID != owner && user.ID != owner && !isOperator(user) {
+		writeAuthzError(w, errForbidden)
+		return
+	}
+	if !checkReferences(w, reference{"/user_id", "users", "user", workspace.UserID}) {
+		return
+	}
+
+	err := execIfMatch(db, r, "UPDATE workspaces SET name = ?, user_id = ?, schema_policy = ?, revision = revision + 1 WHERE id = ?",
+		workspace.Name, workspace.UserID, workspace.SchemaPolicy, workspace.ID)
+	if err != nil {
+		writeDBError(w, "Workspace", err)
+		return
+	}
+	saved, err := scanWorkspace(db.QueryRow("SELECT "+workspaceColumns+" FROM workspaces WHERE id = ?", workspace.ID))
+	if err != nil {
+		writeDBError(w, "Workspace", err)
+		return
+	}
+	events.publish(Event{Type: EventWorkspaceUpdated, WorkspaceID: saved.ID, Data: saved})
+
+	json.NewEncoder(w).Encode(saved)
+}
+
+var appRoleList = listSpec{
+	filters: map[string]listFilter{
+		"app_id":  {"app_id", filterInt},
+		"user_id": {"user_id", filterInt},
+		"role":    {"role", filterString},
+	},
+	sorts: map[string]string{
+		"id":      "id",
+		"app_id":  "COALESCE(app_id, 0)",
+		"user_id": "COALESCE(user_id, 0)",
+		"role":    "role",
+	},
+	defaultSort: "id",
 }
 
+// getAppRoles lists the roles on the apps the caller can see:
+// GET /app-roles[?app_id=<id>][&user_id=<id>][&role=<role>]
+// It takes the sort and page parameters described on listSpec.
 func getAppRoles(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, user_id, role, app_id FROM app_roles")
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	q, err := parseList(r, appRoleList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visible, args := visibleApps(user)
+	q.where("app_id IN ("+visible+")", args...)
+
+	rows, err := q.run(appRoleColumns, q.filtered("app_roles"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	defer rows.Close()
 
 	roles := []AppRole{}
-	for rows.Next() {
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
 		var role AppRole
-		if err := rows.Scan(&role.ID, &role.UserID, &role.Role, &role.AppID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := row.Scan(&role.ID, &role.UserID, &role.Role, &role.AppID); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 		roles = append(roles, role)
 	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	q.writeNextPage(w)
 	json.NewEncoder(w).Encode(roles)
 }
 
+var appList = listSpec{
+	filters: map[string]listFilter{
+		"name":         {"name", filterString},
+		"name_prefix":  {"name", filterPrefix},
+		"workspace_id": {"workspace_id", filterInt},
+	},
+	sorts: map[string]string{
+		"id":           "id",
+		"name":         "name",
+		"version":      "COALESCE(semver_key(version), '')",
+		"workspace_id": "COALESCE(workspace_id, 0)",
+	},
+	defaultSort: "name,-version,-id",
+}
+
+// getApps lists the apps the caller can see, newest version first:
+// GET /apps[?name=<name>][&name_prefix=<prefix>][&workspace_id=<id>][&version=<constraint>][&latest=true]
+// With latest=true only the highest matching version of each app in each
+// workspace is returned. It takes the sort and page parameters described on
+// listSpec.
 func getApps(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema FROM apps")
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	q, err := parseList(r, appList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visible, args := visibleApps(user)
+	q.where("id IN ("+visible+")", args...)
+
+	query := r.URL.Query()
+	if constraint := query.Get("version"); constraint != "" {
+		if _, err := ParseConstraint(constraint); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		q.where("semver_match(version, ?)", constraint)
+	}
+
+	source := q.filtered("apps")
+	if query.Get("latest") == "true" {
+		source = "(SELECT * FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY workspace_id, name ORDER BY semver_key(version) DESC, id DESC) AS newest FROM " + source + ") WHERE newest = 1)"
+	}
+	rows, err := q.run(appColumns, source)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	defer rows.Close()
 
 	apps := []App{}
-	for rows.Next() {
-		var a App
-		if err := rows.Scan(&a.ID, &a.Name, &a.Description, &a.GitHash, &a.IPPort, &a.Endpoint, &a.Version, &a.WorkspaceID, &a.InputSchema, &a.OutputSchema); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
+		a, err := scanApp(row)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+		a.Health = appHealth(a.ID)
 		apps = append(apps, a)
 	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
+	q.writeNextPage(w)
 	json.NewEncoder(w).Encode(apps)
 }
 
+// deleteUser deletes a user together with the workspaces they own, whose
+// apps, roles and IP leases go with them.
 func deleteUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	_, err := db.Exec("DELETE FROM users WHERE id = ?", params["id"])
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	cascade, err := userCascadeEvents(tx, params["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	err = execIfMatch(tx, r, "DELETE FROM users WHERE id = ?", params["id"])
+	if err != nil {
+		writeDBError(w, "User", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, event := range cascade {
+		events.publish(event)
+	}
+	id, _ := strconv.Atoi(params["id"])
+	unbindOperator(id)
+	events.publish(Event{Type: EventUserDeleted, Data: deleted{id}})
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// userCascadeEvents lists the events for the roles, apps, instances, IP
+// leases and workspaces that deleting a user deletes with it: their own roles
+// and the workspaces they own, with those workspaces' apps, roles, instances
+// and leases.
+func userCascadeEvents(tx *sql.Tx, userID string) ([]Event, error) {
+	cascade, err := releasedIPEvents(tx, "workspace_id IN (SELECT id FROM workspaces WHERE user_id = ?)", userID)
+	if err != nil {
+		return nil, err
+	}
+	more, err := cascadeEvents(tx, []cascadeQuery{
+		{EventRoleRevoked, `SELECT r.id, COALESCE(a.workspace_id, 0) FROM app_roles r
+			LEFT JOIN apps a ON a.id = r.app_id LEFT JOIN workspaces w ON w.id = a.workspace_id
+			WHERE r.user_id = ?1 OR w.user_id = ?1`},
+		{EventRoleRevoked, `SELECT r.id, COALESCE(r.workspace_id, 0) FROM workspace_roles r
+			LEFT JOIN workspaces w ON w.id = r.workspace_id
+			WHERE r.user_id = ?1 OR w.user_id = ?1`},
+		{EventInstanceDeregistered, `SELECT i.id, a.workspace_id FROM app_instances i
+			JOIN apps a ON a.id = i.app_id JOIN workspaces w ON w.id = a.workspace_id
+			WHERE w.user_id = ?1`},
+		{EventAppDeregistered, `SELECT a.id, a.workspace_id FROM apps a
+			JOIN workspaces w ON w.id = a.workspace_id
+			WHERE w.user_id = ?1`},
+		{EventWorkspaceDeleted, "SELECT id, id FROM workspaces WHERE user_id = ?1"},
+	}, userID)
+	return append(cascade, more...), err
+}
+
+// workspaceCascadeEvents lists the events for the roles, instances and apps
+// that deleting a workspace deletes with it.
+func workspaceCascadeEvents(tx *sql.Tx, workspaceID int) ([]Event, error) {
+	return cascadeEvents(tx, []cascadeQuery{
+		{EventRoleRevoked, `SELECT r.id, a.workspace_id FROM app_roles r
+			JOIN apps a ON a.id = r.app_id WHERE a.workspace_id = ?1`},
+		{EventRoleRevoked, "SELECT id, workspace_id FROM workspace_roles WHERE workspace_id = ?1"},
+		{EventInstanceDeregistered, `SELECT i.id, a.workspace_id FROM app_instances i
+			JOIN apps a ON a.id = i.app_id WHERE a.workspace_id = ?1`},
+		{EventAppDeregistered, "SELECT id, workspace_id FROM apps WHERE workspace_id = ?1"},
+	}, workspaceID)
+}
+
+// appCascadeEvents lists the events for the roles and instances that
+// deleting an app deletes with it.
+func appCascadeEvents(tx *sql.Tx, appID int) ([]Event, error) {
+	return cascadeEvents(tx, []cascadeQuery{
+		{EventRoleRevoked, `SELECT r.id, COALESCE(a.workspace_id, 0) FROM app_roles r
+			JOIN apps a ON a.id = r.app_id WHERE r.app_id = ?1`},
+		{EventInstanceDeregistered, `SELECT i.id, COALESCE(a.workspace_id, 0) FROM app_instances i
+			JOIN apps a ON a.id = i.app_id WHERE i.app_id = ?1`},
+	}, appID)
+}
+
+// cascadeQuery selects the id and workspace of each row a delete removes
+// along with the row it targets, and names the event announcing its removal.
+type cascadeQuery struct {
+	eventType string
+	query     string
+}
+
+// cascadeEvents runs queries within tx, before the delete, and returns an
+// event for every row they select.
+func cascadeEvents(tx *sql.Tx, queries []cascadeQuery, arg interface{}) ([]Event, error) {
+	var cascade []Event
+	for _, q := range queries {
+		rows, err := tx.Query(q.query, arg)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id, workspaceID int
+			if err := rows.Scan(&id, &workspaceID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			cascade = append(cascade, Event{Type: q.eventType, WorkspaceID: workspaceID, Data: deleted{id}})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return cascade, nil
+}
+
 func deleteApp(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	_, err := db.Exec("DELETE FROM apps WHERE id = ?", params["id"])
+
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer tx.Rollback()
+
+	var id, workspaceID int
+	err = tx.QueryRow("SELECT id, COALESCE(workspace_id, 0) FROM apps WHERE id = ?", params["id"]).Scan(&id, &workspaceID)
+	if err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+	// Its instances, revisions and roles go with it
+	cascade, err := appCascadeEvents(tx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := execIfMatch(tx, r, "DELETE FROM apps WHERE id = ?", id); err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, event := range cascade {
+		events.publish(event)
+	}
+	events.publish(Event{Type: EventAppDeregistered, WorkspaceID: workspaceID, Data: deleted{id}})
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -696,7 +1654,7 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 	var user User
 	err := db.QueryRow("SELECT id, username FROM users WHERE id = ?", params["id"]).Scan(&user.ID, &user.Username)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeDBError(w, "User", err)
 		return
 	}
 	json.NewEncoder(w).Encode(user)
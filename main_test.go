@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
@@ -16,6 +17,12 @@ import (
 )
 
 func clearDatabase() {
+	db.Exec("DELETE FROM ip_leases")
+	db.Exec("DELETE FROM ip_pools WHERE name NOT LIKE 'default-%'")
+	db.Exec("DELETE FROM app_instances")
+	db.Exec("DELETE FROM app_revisions")
+	db.Exec("DELETE FROM app_roles")
+	db.Exec("DELETE FROM workspace_roles")
 	db.Exec("DELETE FROM apps")
 	db.Exec("DELETE FROM workspaces")
 	db.Exec("DELETE FROM users")
@@ -23,12 +30,13 @@ func clearDatabase() {
 
 func TestGetWorkspaces(t *testing.T) {
 	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
 	// Insert test workspaces
-	_, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "workspace1", 1, "subdomain1", "10.0.0.1")
+	_, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "workspace1", user.ID, "subdomain1", "10.0.0.1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "workspace2", 1, "subdomain2", "10.0.0.2")
+	_, err = db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "workspace2", user.ID, "subdomain2", "10.0.0.2")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,6 +45,7 @@ func TestGetWorkspaces(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = asUser(req, user)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -60,11 +69,19 @@ func TestGetWorkspaces(t *testing.T) {
 
 func TestCreateApp(t *testing.T) {
 	clearDatabase()
-	requestBody := []byte(`{"name":"testapp","description":"Test app","git_hash":"abcdef","ip_port":"10.0.0.1:8080","endpoint":"/api","version":"1.0","workspace_id":1,"input_schema":"test input","output_schema":"test output"}`)
+	user := createTestUser(t, "owner@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", user.ID, "testsubdomain", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaceID, _ := result.LastInsertId()
+
+	requestBody := []byte(fmt.Sprintf(`{"name":"testapp","description":"Test app","git_hash":"abcdef","ip_port":"10.0.0.1:8080","endpoint":"/api","version":"1.0.0","workspace_id":%d,"input_schema":"{\"type\":\"object\"}","output_schema":"{\"type\":\"string\"}"}`, workspaceID))
 	req, err := http.NewRequest("POST", "/apps", bytes.NewBuffer(requestBody))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = asUser(req, user)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -85,25 +102,27 @@ func TestCreateApp(t *testing.T) {
 		t.Errorf("handler returned unexpected app name: got %v want %v", response.Name, "testapp")
 	}
 
-	if response.InputSchema != "test input" {
-		t.Errorf("handler returned unexpected input schema: got %v want %v", response.InputSchema, "test input")
+	if response.InputSchema != `{"type":"object"}` {
+		t.Errorf("handler returned unexpected input schema: got %v want %v", response.InputSchema, `{"type":"object"}`)
 	}
 
-	if response.OutputSchema != "test output" {
-		t.Errorf("handler returned unexpected output schema: got %v want %v", response.OutputSchema, "test output")
+	if response.OutputSchema != `{"type":"string"}` {
+		t.Errorf("handler returned unexpected output schema: got %v want %v", response.OutputSchema, `{"type":"string"}`)
 	}
 }
 
 func TestUpdateApp(t *testing.T) {
 	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
 	// Create a test workspace first
-	_, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", 1, "testsubdomain", "10.0.0.1")
+	wsResult, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", user.ID, "testsubdomain", "10.0.0.1")
 	if err != nil {
 		t.Fatal(err)
 	}
+	workspaceID, _ := wsResult.LastInsertId()
 
 	// Create a test app first
-	app := App{Name: "TestApp", Description: "Original description", IPPort: "10.0.0.1:8080", WorkspaceID: 1, InputSchema: "original input", OutputSchema: "original output"}
+	app := App{Name: "TestApp", Description: "Original description", IPPort: "10.0.0.1:8080", WorkspaceID: int(workspaceID), InputSchema: "original input", OutputSchema: "original output"}
 	result, err := db.Exec("INSERT INTO apps (name, description, ip_port, workspace_id, input_schema, output_schema) VALUES (?, ?, ?, ?, ?, ?)",
 		app.Name, app.Description, app.IPPort, app.WorkspaceID, app.InputSchema, app.OutputSchema)
 	if err != nil {
@@ -112,12 +131,13 @@ func TestUpdateApp(t *testing.T) {
 	appID, _ := result.LastInsertId()
 
 	// Now update the app
-	updatedApp := App{Name: "UpdatedTestApp", Description: "Updated description", IPPort: "10.0.0.2:8080", WorkspaceID: 1, InputSchema: "updated input", OutputSchema: "updated output"}
+	updatedApp := App{Name: "UpdatedTestApp", Description: "Updated description", IPPort: "10.0.0.2:8080", WorkspaceID: int(workspaceID), InputSchema: `{"type":"object","required":["name"]}`, OutputSchema: `{"type":"array"}`}
 	requestBody, _ := json.Marshal(updatedApp)
 	req, err := http.NewRequest("PUT", fmt.Sprintf("/apps/%d", appID), bytes.NewBuffer(requestBody))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = asUser(req, user)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -142,7 +162,9 @@ func TestUpdateApp(t *testing.T) {
 func TestMain(m *testing.M) {
 	// Set up
 	setupTestDB()
-	ipPool = NewIPPool()
+	tokenSecret = []byte("test-secret")
+	accessTokenTTL = 15 * time.Minute
+	refreshTokenTTL = time.Hour
 
 	// Run tests
 	code := m.Run()
@@ -162,11 +184,25 @@ func tearDownTestDB() {
 
 func TestCreateAppRole(t *testing.T) {
 	clearDatabase()
-	requestBody := []byte(`{"user_id":1,"role":"developer","app_id":1}`)
+	user := createTestUser(t, "owner@example.com", "secret")
+	developer := createTestUser(t, "developer@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", user.ID, "testsubdomain", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaceID, _ := result.LastInsertId()
+	result, err = db.Exec("INSERT INTO apps (name, ip_port, workspace_id) VALUES (?, ?, ?)", "TestApp", "10.0.0.1:8080", workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appID, _ := result.LastInsertId()
+
+	requestBody := []byte(fmt.Sprintf(`{"user_id":%d,"role":"developer","app_id":%d}`, developer.ID, appID))
 	req, err := http.NewRequest("POST", "/app-roles", bytes.NewBuffer(requestBody))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = asUser(req, user)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -200,7 +236,7 @@ func TestUpdateUser(t *testing.T) {
 	userID, _ := result.LastInsertId()
 
 	// Now update the user
-	updatedUser := User{Username: "updateduser@example.com", Password: "updatedpassword"}
+	updatedUser := userPatch{Username: "updateduser@example.com", Password: "updatedpassword"}
 	requestBody, _ := json.Marshal(updatedUser)
 	req, err := http.NewRequest("PUT", fmt.Sprintf("/users/%d", userID), bytes.NewBuffer(requestBody))
 	if err != nil {
@@ -225,12 +261,36 @@ func TestUpdateUser(t *testing.T) {
 	if updatedUserFromDB.Username != updatedUser.Username {
 		t.Errorf("user was not updated correctly: got %v, want %v", updatedUserFromDB.Username, updatedUser.Username)
 	}
+
+	// A PUT without a password keeps the current one
+	requestBody, _ = json.Marshal(userPatch{Username: "renamed@example.com"})
+	req, err = http.NewRequest("PUT", fmt.Sprintf("/users/%d", userID), bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte("")) == nil {
+		t.Error("a PUT without a password made the empty password valid")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(updatedUser.Password)) != nil {
+		t.Error("a PUT without a password changed the password")
+	}
 }
 
 func TestUpdateWorkspace(t *testing.T) {
 	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	newOwner := createTestUser(t, "new-owner@example.com", "secret")
 	// Create a test workspace first
-	workspace := Workspace{Name: "TestWorkspace", UserID: 1, Subdomain: "testsubdomain", IPs: []string{"10.0.0.1"}}
+	workspace := Workspace{Name: "TestWorkspace", UserID: owner.ID, Subdomain: "testsubdomain", IPs: []string{"10.0.0.1"}}
 	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)",
 		workspace.Name, workspace.UserID, workspace.Subdomain, strings.Join(workspace.IPs, ","))
 	if err != nil {
@@ -239,7 +299,7 @@ func TestUpdateWorkspace(t *testing.T) {
 	workspaceID, _ := result.LastInsertId()
 
 	// Now update the workspace
-	updatedWorkspace := Workspace{Name: "UpdatedTestWorkspace", UserID: 2}
+	updatedWorkspace := Workspace{Name: "UpdatedTestWorkspace", UserID: newOwner.ID}
 	requestBody, _ := json.Marshal(updatedWorkspace)
 	req, err := http.NewRequest("PUT", fmt.Sprintf("/workspaces/%d", workspaceID), bytes.NewBuffer(requestBody))
 	if err != nil {
@@ -249,7 +309,7 @@ func TestUpdateWorkspace(t *testing.T) {
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
 	router.HandleFunc("/workspaces/{id:[0-9]+}", updateWorkspace).Methods("PUT")
-	router.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, asUser(req, owner))
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
@@ -268,9 +328,15 @@ func TestUpdateWorkspace(t *testing.T) {
 
 func TestGetApps(t *testing.T) {
 	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", user.ID, "testsubdomain", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaceID, _ := result.LastInsertId()
 	// Insert a test app
-	_, err := db.Exec("INSERT INTO apps (name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		"testapp", "Test app", "abcdef", "10.0.0.1:8080", "/api", "1.0", 1, "test input", "test output")
+	_, err = db.Exec("INSERT INTO apps (name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"testapp", "Test app", "abcdef", "10.0.0.1:8080", "/api", "1.0", workspaceID, "test input", "test output")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -279,6 +345,7 @@ func TestGetApps(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = asUser(req, user)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -310,14 +377,22 @@ func TestGetApps(t *testing.T) {
 
 func TestDeleteWorkspace(t *testing.T) {
 	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
 	// Create a test workspace first
-	workspace := Workspace{Name: "TestWorkspace", UserID: 1, Subdomain: "testsubdomain", IPs: []string{"10.0.0.1"}}
+	workspace := Workspace{Name: "TestWorkspace", UserID: owner.ID, Subdomain: "testsubdomain", IPs: []string{"10.0.0.1"}}
 	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)",
 		workspace.Name, workspace.UserID, workspace.Subdomain, strings.Join(workspace.IPs, ","))
 	if err != nil {
 		t.Fatal(err)
 	}
 	workspaceID, _ := result.LastInsertId()
+	_, err = db.Exec("INSERT INTO ip_leases (ip, workspace_id) VALUES (?, ?)", "10.0.0.1", workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
 
 	// Now delete the workspace
 	req, err := http.NewRequest("DELETE", fmt.Sprintf("/workspaces/%d", workspaceID), nil)
@@ -343,6 +418,25 @@ func TestDeleteWorkspace(t *testing.T) {
 	if count != 0 {
 		t.Errorf("workspace was not deleted: got %v records, want 0", count)
 	}
+
+	// Verify that the workspace's IPs were released
+	err = db.QueryRow("SELECT COUNT(*) FROM ip_leases WHERE workspace_id = ?", workspaceID).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("IPs were not released: got %v leases, want 0", count)
+	}
+
+	// The released IP is announced before the workspace's deletion
+	var published []string
+	for len(feed) > 0 {
+		event := <-feed
+		published = append(published, fmt.Sprintf("%s %v", event.Type, event.Data))
+	}
+	if want := "[ip.released {10.0.0.1} workspace.deleted {" + fmt.Sprint(workspaceID) + "}]"; fmt.Sprint(published) != want {
+		t.Errorf("deleting the workspace published %v, want %v", published, want)
+	}
 }
 
 func TestDeleteUser(t *testing.T) {
@@ -408,18 +502,24 @@ func TestCreateUser(t *testing.T) {
 	if response.Username != "test@example.com" {
 		t.Errorf("handler returned unexpected username: got %v want %v", response.Username, "test@example.com")
 	}
+
+	// The password in the body is the one stored
+	var stored string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = ?", response.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte("testpassword")) != nil {
+		t.Error("created user does not have the password from the body")
+	}
 }
 
 func TestDeleteApp(t *testing.T) {
 	clearDatabase()
 	// Create a test workspace first
-	_, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", 1, "testsubdomain", "10.0.0.1")
-	if err != nil {
-		t.Fatal(err)
-	}
+	workspaceID := createTestWorkspace(t, createTestUser(t, "owner@example.com", "secret"), "testsubdomain")
 
 	// Create a test app first
-	app := App{Name: "TestApp", Description: "Test app for deletion", IPPort: "10.0.0.1:8080", WorkspaceID: 1}
+	app := App{Name: "TestApp", Description: "Test app for deletion", IPPort: "10.0.0.1:8080", WorkspaceID: workspaceID}
 	result, err := db.Exec("INSERT INTO apps (name, description, ip_port, workspace_id) VALUES (?, ?, ?, ?)",
 		app.Name, app.Description, app.IPPort, app.WorkspaceID)
 	if err != nil {
@@ -464,11 +564,13 @@ func setupTestDB() {
 
 func TestCreateWorkspace(t *testing.T) {
 	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
 	requestBody := []byte(`{"name":"testworkspace","user_id":1}`)
 	req, err := http.NewRequest("POST", "/workspaces", bytes.NewBuffer(requestBody))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = asUser(req, user)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -488,6 +590,23 @@ func TestCreateWorkspace(t *testing.T) {
 	if response.Name != "testworkspace" {
 		t.Errorf("handler returned unexpected workspace name: got %v want %v", response.Name, "testworkspace")
 	}
+
+	if response.UserID != user.ID {
+		t.Errorf("handler returned unexpected workspace owner: got %v want %v", response.UserID, user.ID)
+	}
+
+	// Verify that the workspace's IP is leased to it
+	if len(response.IPs) != 1 {
+		t.Fatalf("handler returned unexpected number of IPs: got %v want %v", len(response.IPs), 1)
+	}
+	var owner int
+	err = db.QueryRow("SELECT workspace_id FROM ip_leases WHERE ip = ?", response.IPs[0]).Scan(&owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != response.ID {
+		t.Errorf("IP was leased to the wrong workspace: got %v want %v", owner, response.ID)
+	}
 }
 
 func tearDownTestEnvironment() {
@@ -499,11 +618,20 @@ func tearDownTestEnvironment() {
 
 func TestCreateWorkspaceRole(t *testing.T) {
 	clearDatabase()
-	requestBody := []byte(`{"user_id":1,"role":"admin","workspace_id":1}`)
+	user := createTestUser(t, "owner@example.com", "secret")
+	admin := createTestUser(t, "admin@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "TestWorkspace", user.ID, "testsubdomain", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaceID, _ := result.LastInsertId()
+
+	requestBody := []byte(fmt.Sprintf(`{"user_id":%d,"role":"admin","workspace_id":%d}`, admin.ID, workspaceID))
 	req, err := http.NewRequest("POST", "/workspace-roles", bytes.NewBuffer(requestBody))
 	if err != nil {
 		t.Fatal(err)
 	}
+	req = asUser(req, user)
 
 	rr := httptest.NewRecorder()
 	router := mux.NewRouter()
@@ -557,3 +685,45 @@ func TestGetUsers(t *testing.T) {
 		t.Errorf("handler returned unexpected number of users: got %v want %v", len(response), 1)
 	}
 }
+
+func TestRestoreAllocations(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	result, err := db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "workspace1", owner.ID, "restored1", "10.0.0.0,10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspaceID, _ := result.LastInsertId()
+	_, err = db.Exec("INSERT INTO workspaces (name, user_id, subdomain, ips) VALUES (?, ?, ?, ?)", "workspace2", owner.ID, "restored2", "172.16.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreAllocations(); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM ip_leases").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("unexpected number of leases restored: got %v want %v", count, 3)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for i := 0; i < 3; i++ {
+		ip, err := allocateIP(tx, int(workspaceID), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip == "10.0.0.0" || ip == "10.0.0.1" || ip == "172.16.0.0" {
+			t.Errorf("pool handed out an IP owned by an existing workspace: %v", ip)
+		}
+	}
+}
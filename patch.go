@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Media types of PATCH bodies. A plain application/json body is treated as a
+// merge patch.
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+var (
+	errUnsupportedPatch = errors.New("PATCH body must be application/merge-patch+json or application/json-patch+json")
+	errPatchTestFailed  = errors.New("patch test operation failed")
+)
+
+// patchOp is one operation of a JSON Patch.
+type patchOp struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// readPatch applies the patch in the request body to current and decodes the
+// result into dest. Fields the patch does not mention keep their values from
+// current, and fields dest does not have are rejected.
+func readPatch(r *http.Request, current, dest interface{}) error {
+	mediaType := mergePatchType
+	if v := r.Header.Get("Content-Type"); v != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(v); err != nil {
+			return errUnsupportedPatch
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	switch mediaType {
+	case mergePatchType, "application/json":
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return err
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return errors.New("merge patch must be a JSON object")
+		}
+		doc = mergePatch(doc, patch)
+	case jsonPatchType:
+		var ops []patchOp
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return err
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			return err
+		}
+	default:
+		return errUnsupportedPatch
+	}
+
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(dest)
+}
+
+// writePatchError reports why a patch could not be applied.
+func writePatchError(w http.ResponseWriter, err error) {
+	switch err {
+	case errUnsupportedPatch:
+		writeError(w, http.StatusUnsupportedMediaType, err.Error())
+	case errPatchTestFailed:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// mergePatch applies an RFC 7396 merge patch: objects are merged member by
+// member, null removes a member and anything else replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// applyJSONPatch applies the operations of an RFC 6902 JSON Patch in order.
+// If any of them fails, so does the whole patch.
+func applyJSONPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add":
+			var value interface{}
+			if value, err = op.value(); err == nil {
+				doc, err = addPointer(doc, op.Path, value)
+			}
+		case "remove":
+			doc, _, err = removePointer(doc, op.Path)
+		case "replace":
+			var value interface{}
+			if value, err = op.value(); err == nil {
+				if doc, _, err = removePointer(doc, op.Path); err == nil {
+					doc, err = addPointer(doc, op.Path, value)
+				}
+			}
+		case "move":
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				err = errors.New("cannot move a value into itself")
+				break
+			}
+			var value interface{}
+			if doc, value, err = removePointer(doc, op.From); err == nil {
+				doc, err = addPointer(doc, op.Path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = getPointer(doc, op.From); err == nil {
+				doc, err = addPointer(doc, op.Path, deepCopy(value))
+			}
+		case "test":
+			var value, actual interface{}
+			if value, err = op.value(); err == nil {
+				if actual, err = getPointer(doc, op.Path); err == nil && !reflect.DeepEqual(actual, value) {
+					return nil, errPatchTestFailed
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %v", i, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op patchOp) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, errors.New(op.Op + " needs a value")
+	}
+	var value interface{}
+	err := json.Unmarshal(*op.Value, &value)
+	return value, err
+}
+
+// splitPointer splits an RFC 6901 JSON Pointer into its unescaped tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses token as an index into an array of length n. If end is
+// set, "-" and n address the position after the last element.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if end && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func getPointer(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path %q does not exist", pointer)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("path %q does not exist", pointer)
+		}
+	}
+	return doc, nil
+}
+
+// addPointer adds value at pointer, replacing an object member or inserting
+// into an array, and returns the updated document.
+func addPointer(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := getPointer(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node[:i], append([]interface{}{value}, node[i:]...)...)
+		return setPointer(doc, parentPointer, node)
+	}
+	return nil, fmt.Errorf("path %q does not exist", pointer)
+}
+
+// setPointer replaces the existing value at pointer, which arrays need after
+// they grow or shrink.
+func setPointer(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parent, err := getPointer(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	}
+	return doc, nil
+}
+
+// removePointer removes the value at pointer and returns the updated document
+// and the removed value.
+func removePointer(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := getPointer(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path %q does not exist", pointer)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[i]
+		node = append(node[:i:i], node[i+1:]...)
+		doc, err = setPointer(doc, parentPointer, node)
+		return doc, value, err
+	}
+	return nil, nil, fmt.Errorf("path %q does not exist", pointer)
+}
+
+func deepCopy(value interface{}) interface{} {
+	data, _ := json.Marshal(value)
+	var copied interface{}
+	json.Unmarshal(data, &copied)
+	return copied
+}
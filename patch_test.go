@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestApplyJSONPatch(t *testing.T) {
+	const doc = `{"name":"billing","tags":["a","b"],"meta":{"x/y":1,"z~":2}}`
+	for _, tc := range []struct {
+		name  string
+		patch string
+		want  string // empty if the patch must fail
+	}{
+		{"replace", `[{"op":"replace","path":"/name","value":"payments"}]`, `{"meta":{"x/y":1,"z~":2},"name":"payments","tags":["a","b"]}`},
+		{"add member", `[{"op":"add","path":"/description","value":"d"}]`, `{"description":"d","meta":{"x/y":1,"z~":2},"name":"billing","tags":["a","b"]}`},
+		{"insert and append", `[{"op":"add","path":"/tags/0","value":"c"},{"op":"add","path":"/tags/-","value":"d"}]`, `{"meta":{"x/y":1,"z~":2},"name":"billing","tags":["c","a","b","d"]}`},
+		{"remove escaped", `[{"op":"remove","path":"/meta/x~1y"},{"op":"remove","path":"/meta/z~0"}]`, `{"meta":{},"name":"billing","tags":["a","b"]}`},
+		{"remove element", `[{"op":"remove","path":"/tags/0"}]`, `{"meta":{"x/y":1,"z~":2},"name":"billing","tags":["b"]}`},
+		{"move", `[{"op":"move","from":"/name","path":"/title"}]`, `{"meta":{"x/y":1,"z~":2},"tags":["a","b"],"title":"billing"}`},
+		{"copy", `[{"op":"copy","from":"/tags","path":"/meta/tags"}]`, `{"meta":{"tags":["a","b"],"x/y":1,"z~":2},"name":"billing","tags":["a","b"]}`},
+		{"test passes", `[{"op":"test","path":"/tags","value":["a","b"]},{"op":"replace","path":"/name","value":"x"}]`, `{"meta":{"x/y":1,"z~":2},"name":"x","tags":["a","b"]}`},
+		{"test fails", `[{"op":"test","path":"/name","value":"other"}]`, ""},
+		{"missing path", `[{"op":"replace","path":"/missing","value":1}]`, ""},
+		{"index out of range", `[{"op":"add","path":"/tags/5","value":"x"}]`, ""},
+		{"unknown op", `[{"op":"merge","path":"/name"}]`, ""},
+		{"move into itself", `[{"op":"move","from":"/meta","path":"/meta/inner"}]`, ""},
+	} {
+		var parsed interface{}
+		json.Unmarshal([]byte(doc), &parsed)
+		var ops []patchOp
+		if err := json.Unmarshal([]byte(tc.patch), &ops); err != nil {
+			t.Fatal(err)
+		}
+		result, err := applyJSONPatch(parsed, ops)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s: patch succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got, _ := json.Marshal(result); string(got) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	var target, patch interface{}
+	json.Unmarshal([]byte(`{"a":"b","c":{"d":"e","f":"g"}}`), &target)
+	json.Unmarshal([]byte(`{"a":"z","c":{"f":null}}`), &patch)
+	if got, _ := json.Marshal(mergePatch(target, patch)); string(got) != `{"a":"z","c":{"d":"e"}}` {
+		t.Errorf("merge patch returned %s", got)
+	}
+}
+
+func TestPatchResources(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "patch1")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8001")
+	if err := backfillRevisions(db); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id:[0-9]+}", patchUser).Methods("PATCH")
+	router.HandleFunc("/workspaces/{id:[0-9]+}", patchWorkspace).Methods("PATCH")
+	router.HandleFunc("/apps/{id:[0-9]+}", patchApp).Methods("PATCH")
+
+	patch := func(path, contentType, body string, want int, response interface{}) {
+		t.Helper()
+		req, err := http.NewRequest("PATCH", path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req = asUser(req, user)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != want {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v: %s", body, status, want, rr.Body.String())
+		}
+		if response != nil {
+			if err := json.Unmarshal(rr.Body.Bytes(), response); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	userPath := fmt.Sprintf("/users/%d", user.ID)
+	workspacePath := fmt.Sprintf("/workspaces/%d", workspaceID)
+	appPath := fmt.Sprintf("/apps/%d", appID)
+
+	// Changing the username leaves the password alone
+	var patchedUser User
+	patch(userPath, mergePatchType, `{"username":"renamed@example.com"}`, http.StatusOK, &patchedUser)
+	var hash string
+	db.QueryRow("SELECT password FROM users WHERE id = ?", user.ID).Scan(&hash)
+	if patchedUser.Username != "renamed@example.com" || bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")) != nil {
+		t.Errorf("patch changed more than the username: %+v", patchedUser)
+	}
+	patch(userPath, jsonPatchType, `[{"op":"add","path":"/password","value":"changed"}]`, http.StatusOK, nil)
+	db.QueryRow("SELECT password FROM users WHERE id = ?", user.ID).Scan(&hash)
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("changed")) != nil {
+		t.Error("patch did not change the password")
+	}
+	patch(userPath, mergePatchType, `{"username":"not an email"}`, http.StatusBadRequest, nil)
+	patch(userPath, mergePatchType, `{"admin":true}`, http.StatusBadRequest, nil)
+
+	var workspace Workspace
+	patch(workspacePath, mergePatchType, `{"name":"Renamed"}`, http.StatusOK, &workspace)
+	if workspace.Name != "Renamed" || workspace.Subdomain != "patch1" || workspace.UserID != user.ID || workspace.SchemaPolicy != SchemaPolicyAllow {
+		t.Errorf("handler returned unexpected workspace: %+v", workspace)
+	}
+	patch(workspacePath, mergePatchType, `{"subdomain":"other"}`, http.StatusBadRequest, nil)
+	patch(workspacePath, mergePatchType, `{"schema_policy":"sometimes"}`, http.StatusBadRequest, nil)
+	patch(workspacePath, "text/plain", `name=x`, http.StatusUnsupportedMediaType, nil)
+	patch("/workspaces/9999", mergePatchType, `{"name":"x"}`, http.StatusNotFound, nil)
+
+	// Apps go through the same checks as updates and record a revision
+	var app App
+	patch(appPath, jsonPatchType, `[{"op":"test","path":"/version","value":"1.0.0"},{"op":"replace","path":"/version","value":"1.1.0"}]`, http.StatusOK, &app)
+	if app.Version != "1.1.0" || app.Name != "billing" || app.IPPort != "10.0.0.1:8001" || app.Endpoint != "/api" || app.Revision != 2 {
+		t.Errorf("handler returned unexpected app: %+v", app)
+	}
+	patch(appPath, jsonPatchType, `[{"op":"test","path":"/version","value":"1.0.0"},{"op":"replace","path":"/version","value":"2.0.0"}]`, http.StatusConflict, nil)
+	patch(appPath, mergePatchType, `{"version":"latest"}`, http.StatusBadRequest, nil)
+	patch(appPath, mergePatchType, `{"revision":7}`, http.StatusBadRequest, nil)
+	patch(appPath, mergePatchType, `{"description":"Invoices","health_check":null}`, http.StatusOK, &app)
+	stored, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", appID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Description != "Invoices" || stored.Version != "1.1.0" || stored.Revision != 3 {
+		t.Errorf("app was not patched: %+v", stored)
+	}
+}
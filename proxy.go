@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxReplayBody is the largest request body the proxy keeps around so that
+// it can be sent again to another instance.
+const maxReplayBody = 10 << 20
+
+var (
+	proxyAddr    string
+	proxyDomain  string
+	proxyTimeout time.Duration
+	proxyRetries int
+)
+
+// hopHeaders only apply to one connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// appProxy routes requests for <subdomain>.<domain> to the app in that
+// workspace whose endpoint is the longest prefix of the request path, trying
+// up to retries other instances when one cannot be reached.
+type appProxy struct {
+	domain    string
+	retries   int
+	transport http.RoundTripper
+}
+
+// newAppProxy returns a proxy that waits up to timeout for an instance's
+// response headers, or indefinitely if timeout is 0. The response body is
+// not limited, so long-running and streaming responses get through.
+func newAppProxy(domain string, timeout time.Duration, retries int) *appProxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	return &appProxy{
+		domain:    strings.Trim(strings.ToLower(domain), "."),
+		retries:   retries,
+		transport: transport,
+	}
+}
+
+// workspaceSubdomain returns the subdomain that host is in, if it is a
+// direct subdomain of the proxy's domain.
+func (p *appProxy) workspaceSubdomain(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	subdomain := strings.TrimSuffix(host, "."+p.domain)
+	if subdomain == host || subdomain == "" || strings.Contains(subdomain, ".") {
+		return "", false
+	}
+	return subdomain, true
+}
+
+// endpointMatches reports whether endpoint is a prefix of path that ends on
+// a path segment boundary.
+func endpointMatches(endpoint, path string) bool {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if endpoint == "" {
+		return true
+	}
+	return path == endpoint || strings.HasPrefix(path, endpoint+"/")
+}
+
+// routeApp finds the app a request path is routed to in a workspace. Among
+// apps with the same endpoint the highest version wins.
+func routeApp(workspaceID int, path string) (App, bool, error) {
+	rows, err := db.Query("SELECT "+appColumns+" FROM apps WHERE workspace_id = ?", workspaceID)
+	if err != nil {
+		return App{}, false, err
+	}
+	defer rows.Close()
+
+	var candidates []App
+	longest := -1
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			return App{}, false, err
+		}
+		if !endpointMatches(app.Endpoint, path) {
+			continue
+		}
+		length := len(strings.TrimSuffix(app.Endpoint, "/"))
+		switch {
+		case length > longest:
+			candidates, longest = []App{app}, length
+		case length == longest:
+			candidates = append(candidates, app)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return App{}, false, err
+	}
+
+	app, ok := selectApp(candidates, nil)
+	return app, ok, nil
+}
+
+func (p *appProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	subdomain, ok := p.workspaceSubdomain(r.Host)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown host")
+		return
+	}
+	var workspaceID int
+	if err := db.QueryRow("SELECT id FROM workspaces WHERE subdomain = ?", subdomain).Scan(&workspaceID); err != nil {
+		writeError(w, http.StatusNotFound, "Unknown host")
+		return
+	}
+
+	app, ok, err := routeApp(workspaceID, r.URL.Path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "No app serves this path")
+		return
+	}
+
+	instances, err := appInstances(app)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	instances = healthyInstances(instances)
+	first, err := pickInstance(app.ID, instances, StrategyRoundRobin)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "No healthy instances")
+		return
+	}
+
+	// Try the picked instance first and then the ones after it
+	order := []Instance{first}
+	for i, instance := range instances {
+		if instance.ID == first.ID && instance.Address == first.Address {
+			order = append(order, instances[i+1:]...)
+			order = append(order, instances[:i]...)
+			break
+		}
+	}
+	if len(order) > p.retries+1 {
+		order = order[:p.retries+1]
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxReplayBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > maxReplayBody {
+		writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+
+	for i, instance := range order {
+		last := i == len(order)-1
+		resp, err := p.transport.RoundTrip(p.outgoing(r.Context(), r, instance.Address, body))
+		if err == nil && !last && retryableStatus(r.Method, resp.StatusCode) {
+			resp.Body.Close()
+			err = errors.New(resp.Status)
+		}
+		if err != nil {
+			log.Printf("Proxying %s %s to %s failed: %v", r.Method, r.URL.Path, instance.Address, err)
+			if !last && retryableError(r.Method, err) {
+				continue
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				writeError(w, http.StatusGatewayTimeout, "Upstream timed out")
+			} else {
+				writeError(w, http.StatusBadGateway, "Upstream unavailable")
+			}
+			return
+		}
+
+		removeHopHeaders(resp.Header)
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		copyFlushing(w, resp.Body)
+		resp.Body.Close()
+		return
+	}
+}
+
+// copyFlushing copies body to w, flushing after every read so that streamed
+// responses such as server-sent events reach the client as they arrive.
+func copyFlushing(w http.ResponseWriter, body io.Reader) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// outgoing builds the request sent to the instance at address.
+func (p *appProxy) outgoing(ctx context.Context, r *http.Request, address string, body []byte) *http.Request {
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	out.URL.Scheme = "http"
+	out.URL.Host = address
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	if len(body) == 0 && r.ContentLength <= 0 {
+		out.Body = nil
+	}
+	removeHopHeaders(out.Header)
+
+	if client, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			client = prior + ", " + client
+		}
+		out.Header.Set("X-Forwarded-For", client)
+	}
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	return out
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range header["Connection"] {
+		for _, name := range strings.Split(h, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryableStatus reports whether a response means another instance should be
+// tried. Only idempotent requests are retried after reaching an instance.
+func retryableStatus(method string, status int) bool {
+	if !idempotent(method) {
+		return false
+	}
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// retryableError reports whether a failed request should be tried on another
+// instance. Requests that are not idempotent are only retried if the instance
+// could not be connected to, so they are never sent twice.
+func retryableError(method string, err error) bool {
+	if idempotent(method) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointMatches(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint, path string
+		want           bool
+	}{
+		{"/api", "/api", true},
+		{"/api", "/api/users", true},
+		{"/api/", "/api/users", true},
+		{"/api", "/apix", false},
+		{"", "/anything", true},
+		{"/", "/anything", true},
+	} {
+		if got := endpointMatches(tc.endpoint, tc.path); got != tc.want {
+			t.Errorf("endpointMatches(%q, %q) = %v, want %v", tc.endpoint, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestAppProxy(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "proxy123")
+
+	var forwarded http.Header
+	var forwardedBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		body, _ := io.ReadAll(r.Body)
+		forwardedBody = string(body)
+		w.Header().Set("X-Backend", "v2")
+		io.WriteString(w, "v2 "+r.URL.Path)
+	}))
+	defer backend.Close()
+	root := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "root "+r.URL.Path)
+	}))
+	defer root.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	// Sends its headers in time but takes longer than the timeout to finish
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "second")
+	}))
+	defer streaming.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddress := dead.Addr().String()
+	dead.Close()
+
+	address := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id) VALUES ('web', ?, '/', '1.0.0', ?)", address(root), workspaceID)
+	db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id) VALUES ('api', ?, '/api', '1.0.0', ?)", deadAddress, workspaceID)
+	var apiID int
+	db.QueryRow("SELECT id FROM apps WHERE name = 'api'").Scan(&apiID)
+	// One instance is down, so requests have to be retried on the other
+	db.Exec("INSERT INTO app_instances (app_id, address) VALUES (?, ?)", apiID, deadAddress)
+	db.Exec("INSERT INTO app_instances (app_id, address) VALUES (?, ?)", apiID, address(backend))
+	db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id) VALUES ('slow', ?, '/slow', '1.0.0', ?)", address(slow), workspaceID)
+	db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id) VALUES ('down', ?, '/down', '1.0.0', ?)", deadAddress, workspaceID)
+	db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id) VALUES ('streaming', ?, '/streaming', '1.0.0', ?)", address(streaming), workspaceID)
+
+	proxy := newAppProxy("apps.test", 100*time.Millisecond, 2)
+
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("POST", "http://proxy123.apps.test/api/users", bytes.NewBufferString(`{"name":"x"}`))
+		req.Header.Set("Connection", "close")
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != "v2 /api/users" || rr.Header().Get("X-Backend") != "v2" {
+			t.Fatalf("proxy returned %v %q", rr.Code, rr.Body.String())
+		}
+	}
+	if forwarded.Get("X-Forwarded-Host") != "proxy123.apps.test" || forwarded.Get("X-Forwarded-Proto") != "http" || forwarded.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Errorf("proxy forwarded unexpected headers: %v", forwarded)
+	}
+	if forwardedBody != `{"name":"x"}` {
+		t.Errorf("proxy forwarded body %q", forwardedBody)
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want int
+		body string
+	}{
+		{"http://PROXY123.apps.test:8000/index.html", http.StatusOK, "root /index.html"},
+		{"http://proxy123.apps.test/apix", http.StatusOK, "root /apix"},
+		{"http://proxy123.apps.test/slow", http.StatusGatewayTimeout, ""},
+		{"http://proxy123.apps.test/down", http.StatusBadGateway, ""},
+		{"http://proxy123.apps.test/streaming", http.StatusOK, "first second"},
+		{"http://missing1.apps.test/", http.StatusNotFound, ""},
+		{"http://proxy123.example.com/", http.StatusNotFound, ""},
+	} {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest("GET", tc.url, nil))
+		if rr.Code != tc.want {
+			t.Errorf("%s: proxy returned wrong status code: got %v want %v", tc.url, rr.Code, tc.want)
+		}
+		if tc.body != "" && rr.Body.String() != tc.body {
+			t.Errorf("%s: proxy returned %q, want %q", tc.url, rr.Body.String(), tc.body)
+		}
+	}
+
+	// A timeout of 0 does not limit how long an instance may take
+	rr := httptest.NewRecorder()
+	newAppProxy("apps.test", 0, 0).ServeHTTP(rr, httptest.NewRequest("GET", "http://proxy123.apps.test/slow", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("proxy without a timeout returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestAppProxyStreams(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "stream123")
+
+	// Sends one event and then holds the response open until released
+	release := make(chan struct{})
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer events.Close()
+	db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id) VALUES ('events', ?, '/', '1.0.0', ?)", strings.TrimPrefix(events.URL, "http://"), workspaceID)
+
+	server := httptest.NewServer(newAppProxy("apps.test", time.Second, 0))
+	defer server.Close()
+	defer close(release)
+	req, err := http.NewRequest("GET", server.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "stream123.apps.test"
+
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		first, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- first
+	}()
+	select {
+	case first := <-line:
+		if first != "data: first\n" {
+			t.Errorf("proxy streamed %q, want the first event", first)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("proxy did not pass the first event on before the upstream finished")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// reference is a field of a request body that names another resource.
+type reference struct {
+	path     string // JSON Pointer of the field
+	table    string
+	resource string // e.g. "workspace", for messages
+	id       int
+}
+
+// checkReferences reports whether every reference names an existing row.
+// When one does not, the rejection, listing each missing reference, has been
+// written to w.
+func checkReferences(w http.ResponseWriter, refs ...reference) bool {
+	var errs []ValidationError
+	for _, ref := range refs {
+		var id int
+		err := db.QueryRow("SELECT id FROM "+ref.table+" WHERE id = ?", ref.id).Scan(&id)
+		if err == sql.ErrNoRows {
+			errs = append(errs, ValidationError{Path: ref.path, Message: fmt.Sprintf("%s %d does not exist", ref.resource, ref.id)})
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return false
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, "Referenced resource does not exist", errs...)
+		return false
+	}
+	return true
+}
+
+// nullDanglingReferences lets the service start on a database that refers to
+// deleted rows, by setting those references to NULL, or deleting the rows
+// where the column cannot be NULL.
+var nullDanglingReferences bool
+
+// danglingReference counts the rows whose column names a row of parent that
+// does not exist.
+type danglingReference struct {
+	table, column, parent string
+	fkid, rows            int
+	notNull               bool
+}
+
+func (d danglingReference) String() string {
+	return fmt.Sprintf("%s.%s -> %s (%d rows)", d.table, d.column, d.parent, d.rows)
+}
+
+// findDanglingReferences lists the references to deleted rows that databases
+// created before foreign keys were enforced may hold.
+func findDanglingReferences(db *sql.DB) ([]danglingReference, error) {
+	rows, err := db.Query(`SELECT c."table", l."from", c.parent, c.fkid, COUNT(*), t."notnull"
+		FROM pragma_foreign_key_check AS c
+		JOIN pragma_foreign_key_list(c."table") AS l ON l.id = c.fkid
+		JOIN pragma_table_info(c."table") AS t ON t.name = l."from"
+		GROUP BY c."table", c.fkid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dangling []danglingReference
+	for rows.Next() {
+		var d danglingReference
+		if err := rows.Scan(&d.table, &d.column, &d.parent, &d.fkid, &d.rows, &d.notNull); err != nil {
+			return nil, err
+		}
+		dangling = append(dangling, d)
+	}
+	return dangling, rows.Err()
+}
+
+// checkDanglingReferences refuses a database that refers to deleted rows,
+// unless nullDanglingReferences is set, in which case it logs them and sets
+// them to NULL. Rows whose reference cannot be NULL, such as a lease of a
+// deleted workspace, are deleted instead.
+func checkDanglingReferences(db *sql.DB) error {
+	dangling, err := findDanglingReferences(db)
+	if err != nil || len(dangling) == 0 {
+		return err
+	}
+	if !nullDanglingReferences {
+		return fmt.Errorf("database refers to deleted rows: %v; fix them by hand or start with -null-dangling-references to set them to NULL or delete them", dangling)
+	}
+
+	for _, d := range dangling {
+		dangles := "rowid IN (SELECT rowid FROM pragma_foreign_key_check(?) WHERE fkid = ?)"
+		if d.notNull {
+			log.Printf("Deleting %s", d)
+			_, err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", d.table, dangles), d.table, d.fkid)
+		} else {
+			log.Printf("Setting %s to NULL", d)
+			_, err = db.Exec(fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s", d.table, d.column, dangles), d.table, d.fkid)
+		}
+		if err != nil {
+			return fmt.Errorf("repairing %s: %v", d, err)
+		}
+	}
+	return nil
+}
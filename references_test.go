@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestReferenceValidation(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "refs1")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8001")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", createApp).Methods("POST")
+	router.HandleFunc("/workspace-roles", createWorkspaceRole).Methods("POST")
+	router.HandleFunc("/app-roles", createAppRole).Methods("POST")
+	router.HandleFunc("/workspaces/{id:[0-9]+}", updateWorkspace).Methods("PUT")
+
+	send := func(method, path string, body interface{}, want int) APIError {
+		t.Helper()
+		var response APIError
+		json.Unmarshal(sendAs(t, router, user, method, path, body, want).Body.Bytes(), &response)
+		return response
+	}
+	paths := func(response APIError) []string {
+		var paths []string
+		for _, e := range response.Errors {
+			paths = append(paths, e.Path)
+		}
+		return paths
+	}
+
+	response := send("POST", "/apps", App{Name: "orphan", IPPort: "10.0.0.1:8002", WorkspaceID: 9999}, http.StatusBadRequest)
+	if response.Code != CodeValidationFailed || fmt.Sprint(paths(response)) != "[/workspace_id]" {
+		t.Errorf("app in a missing workspace returned %+v", response)
+	}
+	response = send("POST", "/workspace-roles", WorkspaceRole{UserID: 9999, Role: RoleMember, WorkspaceID: 9998}, http.StatusBadRequest)
+	if fmt.Sprint(paths(response)) != "[/user_id /workspace_id]" {
+		t.Errorf("role for a missing user returned %+v", response)
+	}
+	response = send("POST", "/app-roles", AppRole{UserID: user.ID, Role: RoleUser, AppID: 9999}, http.StatusBadRequest)
+	if fmt.Sprint(paths(response)) != "[/app_id]" {
+		t.Errorf("role on a missing app returned %+v", response)
+	}
+	send("PUT", fmt.Sprintf("/workspaces/%d", workspaceID), Workspace{Name: "moved", UserID: 9999}, http.StatusBadRequest)
+
+	// Callers without a role are refused before references are checked
+	stranger := createTestUser(t, "stranger@example.com", "secret")
+	sendAs(t, router, stranger, "POST", "/workspace-roles", WorkspaceRole{UserID: 9999, Role: RoleMember, WorkspaceID: workspaceID}, http.StatusForbidden)
+	sendAs(t, router, stranger, "POST", "/app-roles", AppRole{UserID: 9999, Role: RoleUser, AppID: appID}, http.StatusForbidden)
+
+	send("POST", "/app-roles", AppRole{UserID: user.ID, Role: RoleUser, AppID: appID}, http.StatusCreated)
+}
+
+func TestDeleteUserCascades(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	other := createTestUser(t, "other@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "cascade1")
+	appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8001")
+	for _, query := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{"INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", []interface{}{other.ID, RoleMember, workspaceID}},
+		{"INSERT INTO app_roles (user_id, role, app_id) VALUES (?, ?, ?)", []interface{}{other.ID, RoleUser, appID}},
+		{"INSERT INTO app_instances (app_id, address) VALUES (?, ?)", []interface{}{appID, "10.0.0.1:8001"}},
+		{"INSERT INTO ip_leases (ip, workspace_id) VALUES (?, ?)", []interface{}{"10.0.0.9", workspaceID}},
+	} {
+		if _, err := db.Exec(query.sql, query.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("/users/%d", user.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id:[0-9]+}", deleteUser).Methods("DELETE")
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	for _, table := range []string{"workspaces", "apps", "workspace_roles", "app_roles", "app_instances", "ip_leases"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("deleting the owner left %d rows in %s", count, table)
+		}
+	}
+	// Everything the cascade deleted is announced
+	var published []string
+	for len(feed) > 0 {
+		event := <-feed
+		if event.WorkspaceID != workspaceID && event.Type != EventUserDeleted {
+			t.Errorf("%s event for workspace %d, want %d", event.Type, event.WorkspaceID, workspaceID)
+		}
+		published = append(published, event.Type)
+	}
+	if want := "[ip.released role.revoked role.revoked instance.deregistered app.deregistered workspace.deleted user.deleted]"; fmt.Sprint(published) != want {
+		t.Errorf("deleting the owner published %v, want %v", published, want)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", other.ID).Scan(&count)
+	if count != 1 {
+		t.Error("deleting a user deleted another user")
+	}
+}
+
+func TestDeleteWorkspaceAndAppCascade(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	other := createTestUser(t, "other@example.com", "secret")
+	router := mux.NewRouter()
+	router.HandleFunc("/workspaces/{id:[0-9]+}", deleteWorkspace).Methods("DELETE")
+	router.HandleFunc("/apps/{id:[0-9]+}", deleteApp).Methods("DELETE")
+
+	for _, tc := range []struct {
+		path func(workspaceID, appID int) string
+		want string
+	}{
+		{func(workspaceID, appID int) string { return fmt.Sprintf("/apps/%d", appID) },
+			"[role.revoked instance.deregistered app.deregistered]"},
+		{func(workspaceID, appID int) string { return fmt.Sprintf("/workspaces/%d", workspaceID) },
+			"[role.revoked role.revoked instance.deregistered app.deregistered workspace.deleted]"},
+	} {
+		workspaceID := createTestWorkspace(t, owner, "cascade1")
+		appID := createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:8001")
+		for _, query := range []struct {
+			sql  string
+			args []interface{}
+		}{
+			{"INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", []interface{}{other.ID, RoleMember, workspaceID}},
+			{"INSERT INTO app_roles (user_id, role, app_id) VALUES (?, ?, ?)", []interface{}{other.ID, RoleUser, appID}},
+			{"INSERT INTO app_instances (app_id, address) VALUES (?, ?)", []interface{}{appID, "10.0.0.1:8001"}},
+		} {
+			if _, err := db.Exec(query.sql, query.args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		feed := events.subscribe()
+		sendAs(t, router, owner, "DELETE", tc.path(workspaceID, appID), nil, http.StatusNoContent)
+		events.unsubscribe(feed)
+
+		var published []string
+		for len(feed) > 0 {
+			event := <-feed
+			if event.WorkspaceID != workspaceID {
+				t.Errorf("%s event for workspace %d, want %d", event.Type, event.WorkspaceID, workspaceID)
+			}
+			published = append(published, event.Type)
+		}
+		if fmt.Sprint(published) != tc.want {
+			t.Errorf("DELETE %s published %v, want %v", tc.path(workspaceID, appID), published, tc.want)
+		}
+		db.Exec("DELETE FROM workspaces")
+	}
+}
+
+func TestDanglingReferences(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "dangling1")
+
+	// Databases created before foreign keys were enforced can refer to deleted rows
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"PRAGMA foreign_keys = OFF",
+		fmt.Sprintf("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (9999, '%s', %d)", RoleMember, workspaceID),
+		"INSERT INTO ip_leases (ip, workspace_id) VALUES ('10.0.0.9', 9999)",
+		"INSERT INTO app_instances (app_id, address) VALUES (9999, '10.0.0.1:8001')",
+		"PRAGMA foreign_keys = ON",
+	} {
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	if err := checkDanglingReferences(db); err == nil || !strings.Contains(err.Error(), "workspace_roles.user_id -> users (1 rows)") {
+		t.Errorf("dangling reference was not reported: %v", err)
+	}
+
+	nullDanglingReferences = true
+	defer func() { nullDanglingReferences = false }()
+	if err := checkDanglingReferences(db); err != nil {
+		t.Fatal(err)
+	}
+	var roles, nulls int
+	db.QueryRow("SELECT COUNT(*), COUNT(*) - COUNT(user_id) FROM workspace_roles").Scan(&roles, &nulls)
+	if roles != 1 || nulls != 1 {
+		t.Errorf("got %d roles with %d NULL users, want the role kept with its user set to NULL", roles, nulls)
+	}
+	// Leases and instances cannot lose their reference, so they go
+	for _, table := range []string{"ip_leases", "app_instances"} {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		if count != 0 {
+			t.Errorf("got %d rows in %s, want the dangling rows deleted", count, table)
+		}
+	}
+	if dangling, err := findDanglingReferences(db); err != nil || len(dangling) != 0 {
+		t.Errorf("references still dangle after repairing them: %v %v", dangling, err)
+	}
+}
+
+func TestAppWithoutWorkspace(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	developer := createTestUser(t, "developer@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "orphan1")
+	appID := createTestApp(t, workspaceID, "orphan", "1.0.0", "10.0.0.1:8001")
+	for _, query := range []string{
+		fmt.Sprintf("INSERT INTO app_roles (user_id, role, app_id) VALUES (%d, '%s', %d)", developer.ID, RoleDeveloper, appID),
+		fmt.Sprintf("INSERT INTO app_instances (app_id, address) VALUES (%d, '10.0.0.1:8001')", appID),
+		// Repairing a dangling workspace reference leaves the app without one
+		fmt.Sprintf("UPDATE apps SET workspace_id = NULL WHERE id = %d", appID),
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(getApp, sameID, RoleUser)).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}", requireAppRole(deleteApp, sameID, RoleDeveloper)).Methods("DELETE")
+	appPath := fmt.Sprintf("/apps/%d", appID)
+
+	// Only the app's own roles count once it has no workspace
+	sendAs(t, router, owner, "GET", appPath, nil, http.StatusForbidden)
+	sendAs(t, router, developer, "GET", appPath, nil, http.StatusOK)
+	sendAs(t, router, developer, "DELETE", appPath, nil, http.StatusNoContent)
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM apps WHERE id = ?", appID).Scan(&count)
+	if count != 0 {
+		t.Errorf("app without a workspace was not deleted")
+	}
+}
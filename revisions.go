@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AppRevision is an immutable snapshot of an app, recorded every time the app
+// is registered, updated or rolled back.
+type AppRevision struct {
+	AppID        int          `json:"app_id"`
+	Revision     int          `json:"revision"`
+	Name         string       `json:"name"`
+	Description  string       `json:"description"`
+	GitHash      string       `json:"git_hash"`
+	IPPort       string       `json:"ip_port"`
+	Endpoint     string       `json:"endpoint"`
+	Version      string       `json:"version"`
+	WorkspaceID  int          `json:"workspace_id"`
+	InputSchema  Schema       `json:"input_schema"`
+	OutputSchema Schema       `json:"output_schema"`
+	HealthCheck  *HealthCheck `json:"health_check,omitempty"`
+	AuthorID     int          `json:"author_id"`
+	RollbackOf   int          `json:"rollback_of,omitempty"` // The revision this one restored
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+// RevisionChange is a field that differs between two revisions.
+type RevisionChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// RevisionDiff compares two revisions of an app.
+type RevisionDiff struct {
+	From          int              `json:"from"`
+	To            int              `json:"to"`
+	Changes       []RevisionChange `json:"changes"`
+	Compatibility *Compatibility   `json:"compatibility"`
+}
+
+const revisionColumns = "app_id, revision, name, description, git_hash, ip_port, endpoint, version, workspace_id, input_schema, output_schema, health_check, author_id, rollback_of, created_at"
+
+func scanRevision(row rowScanner) (AppRevision, error) {
+	var revision AppRevision
+	var healthCheck string
+	err := row.Scan(&revision.AppID, &revision.Revision, &revision.Name, &revision.Description, &revision.GitHash, &revision.IPPort, &revision.Endpoint, &revision.Version,
+		&revision.WorkspaceID, &revision.InputSchema, &revision.OutputSchema, &healthCheck, &revision.AuthorID, &revision.RollbackOf, &revision.CreatedAt)
+	revision.HealthCheck = unmarshalHealthCheck(healthCheck)
+	return revision, err
+}
+
+// app returns the app as it was at the revision.
+func (revision AppRevision) app() App {
+	return App{
+		ID:           revision.AppID,
+		Name:         revision.Name,
+		Description:  revision.Description,
+		GitHash:      revision.GitHash,
+		IPPort:       revision.IPPort,
+		Endpoint:     revision.Endpoint,
+		Version:      revision.Version,
+		WorkspaceID:  revision.WorkspaceID,
+		InputSchema:  revision.InputSchema,
+		OutputSchema: revision.OutputSchema,
+		HealthCheck:  revision.HealthCheck,
+		Revision:     revision.Revision,
+	}
+}
+
+// recordRevision snapshots app as its next revision and makes that the app's
+// current revision.
+func recordRevision(tx *sql.Tx, app *App, authorID, rollbackOf int) error {
+	var next int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(revision), 0) + 1 FROM app_revisions WHERE app_id = ?", app.ID).Scan(&next); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO app_revisions ("+revisionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		app.ID, next, app.Name, app.Description, app.GitHash, app.IPPort, app.Endpoint, app.Version,
+		app.WorkspaceID, app.InputSchema, app.OutputSchema, marshalHealthCheck(app.HealthCheck), authorID, rollbackOf, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE apps SET revision = ? WHERE id = ?", next, app.ID); err != nil {
+		return err
+	}
+	app.Revision = next
+	return nil
+}
+
+// backfillRevisions records the current state of apps registered before
+// revisions were kept as their first revision.
+func backfillRevisions(db *sql.DB) error {
+	_, err := db.Exec(`
+		INSERT INTO app_revisions (` + revisionColumns + `)
+		SELECT id, 1, name, COALESCE(description, ''), COALESCE(git_hash, ''), ip_port, COALESCE(endpoint, ''), COALESCE(version, ''),
+			COALESCE(workspace_id, 0), COALESCE(input_schema, ''), COALESCE(output_schema, ''), COALESCE(health_check, ''), 0, 0, CURRENT_TIMESTAMP
+		FROM apps WHERE revision = 0
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE apps SET revision = 1 WHERE revision = 0")
+	return err
+}
+
+func loadRevision(appID, revision interface{}) (AppRevision, error) {
+	return scanRevision(db.QueryRow("SELECT "+revisionColumns+" FROM app_revisions WHERE app_id = ? AND revision = ?", appID, revision))
+}
+
+var revisionList = listSpec{
+	sorts: map[string]string{
+		"revision":   "revision",
+		"created_at": "CAST(created_at AS TEXT)",
+	},
+	defaultSort: "-revision",
+}
+
+// getAppRevisions lists the revisions of an app, newest first:
+// GET /apps/{id}/revisions
+// It takes the sort and page parameters described on listSpec.
+func getAppRevisions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	q, err := parseList(r, revisionList)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.where("app_id = ?", params["id"])
+	// Revisions are numbered per app, so the revision is what breaks ties
+	rows, err := q.run(revisionColumns, q.filtered("(SELECT *, revision AS id FROM app_revisions)"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	revisions := []AppRevision{}
+	for row, ok := q.next(rows); ok; row, ok = q.next(rows) {
+		revision, err := scanRevision(row)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	q.writeNextPage(w)
+	json.NewEncoder(w).Encode(revisions)
+}
+
+func getAppRevision(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	revision, err := loadRevision(params["id"], params["revision"])
+	if err != nil {
+		writeDBError(w, "Revision", err)
+		return
+	}
+	json.NewEncoder(w).Encode(revision)
+}
+
+// diffAppRevisions compares a revision with an earlier one, by default the
+// revision before it:
+// GET /apps/{id}/revisions/{revision}/diff[?against=<revision>]
+func diffAppRevisions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	to, err := loadRevision(params["id"], params["revision"])
+	if err != nil {
+		writeDBError(w, "Revision", err)
+		return
+	}
+
+	against := to.Revision - 1
+	if v := r.URL.Query().Get("against"); v != "" {
+		if against, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid against revision")
+			return
+		}
+	}
+	from, err := loadRevision(params["id"], against)
+	if err != nil {
+		writeDBError(w, "Revision to compare against", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(diffRevisions(from, to))
+}
+
+func diffRevisions(from, to AppRevision) RevisionDiff {
+	diff := RevisionDiff{From: from.Revision, To: to.Revision, Changes: []RevisionChange{}}
+	for _, field := range []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"name", from.Name, to.Name},
+		{"description", from.Description, to.Description},
+		{"git_hash", from.GitHash, to.GitHash},
+		{"ip_port", from.IPPort, to.IPPort},
+		{"endpoint", from.Endpoint, to.Endpoint},
+		{"version", from.Version, to.Version},
+		{"workspace_id", from.WorkspaceID, to.WorkspaceID},
+		{"input_schema", from.InputSchema, to.InputSchema},
+		{"output_schema", from.OutputSchema, to.OutputSchema},
+		{"health_check", from.HealthCheck, to.HealthCheck},
+	} {
+		if !reflect.DeepEqual(field.from, field.to) {
+			diff.Changes = append(diff.Changes, RevisionChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+	diff.Compatibility = compareAppSchemas(from.app(), to.app())
+	return diff
+}
+
+// rollbackApp makes an earlier revision of an app current again, which is
+// recorded as a new revision.
+func rollbackApp(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	revision, err := loadRevision(params["id"], params["revision"])
+	if err != nil {
+		writeDBError(w, "Revision", err)
+		return
+	}
+	app := revision.app()
+	// The revision may be in another workspace, which the caller must belong
+	// to and which may have been deleted since
+	if !checkApp(w, r, &app) {
+		return
+	}
+
+	current, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", app.ID))
+	if err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+	if !checkCompatibility(w, current, &app) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if err := updateAppRow(tx, r, app); err != nil {
+		writeDBError(w, "App", err)
+		return
+	}
+	user, _ := currentUser(r)
+	if err := recordRevision(tx, &app, user.ID, revision.Revision); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	events.publish(Event{Type: EventAppUpdated, WorkspaceID: app.WorkspaceID, Data: app})
+
+	json.NewEncoder(w).Encode(app)
+}
+
+// updateAppRow writes every field of app to its row, if it is still at the
+// revision the request's If-Match named.
+func updateAppRow(tx *sql.Tx, r *http.Request, app App) error {
+	return execIfMatch(tx, r, "UPDATE apps SET name = ?, description = ?, git_hash = ?, ip_port = ?, endpoint = ?, version = ?, workspace_id = ?, input_schema = ?, output_schema = ?, health_check = ? WHERE id = ?",
+		app.Name, app.Description, app.GitHash, app.IPPort, app.Endpoint, app.Version, app.WorkspaceID, app.InputSchema, app.OutputSchema, marshalHealthCheck(app.HealthCheck), app.ID)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAppRevisions(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "revisions1")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", createApp).Methods("POST")
+	router.HandleFunc("/apps/{id:[0-9]+}", updateApp).Methods("PUT")
+	router.HandleFunc("/apps/{id:[0-9]+}/revisions", getAppRevisions).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/revisions/{revision:[0-9]+}", getAppRevision).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/revisions/{revision:[0-9]+}/diff", diffAppRevisions).Methods("GET")
+	router.HandleFunc("/apps/{id:[0-9]+}/revisions/{revision:[0-9]+}/rollback", rollbackApp).Methods("POST")
+
+	app := App{Name: "billing", GitHash: "aaa", IPPort: "10.0.0.1:8080", Version: "1.0.0", WorkspaceID: workspaceID, OutputSchema: `{"type":"object"}`}
+	var created App
+	json.Unmarshal(sendAs(t, router, user, "POST", "/apps", app, http.StatusCreated).Body.Bytes(), &created)
+	if created.Revision != 1 {
+		t.Errorf("new app has revision %d, want 1", created.Revision)
+	}
+
+	app.GitHash, app.Version = "bbb", "1.1.0"
+	var updated App
+	json.Unmarshal(sendAs(t, router, user, "PUT", fmt.Sprintf("/apps/%d", created.ID), app, http.StatusOK).Body.Bytes(), &updated)
+	app.GitHash, app.Version, app.OutputSchema = "ccc", "2.0.0", `{"type":"array"}`
+	json.Unmarshal(sendAs(t, router, user, "PUT", fmt.Sprintf("/apps/%d", created.ID), app, http.StatusOK).Body.Bytes(), &updated)
+	if updated.Revision != 3 {
+		t.Errorf("updated app has revision %d, want 3", updated.Revision)
+	}
+
+	var revisions []AppRevision
+	json.Unmarshal(sendAs(t, router, user, "GET", fmt.Sprintf("/apps/%d/revisions", created.ID), nil, http.StatusOK).Body.Bytes(), &revisions)
+	if len(revisions) != 3 || revisions[0].Revision != 3 || revisions[2].GitHash != "aaa" || revisions[0].AuthorID != user.ID {
+		t.Fatalf("handler returned unexpected revisions: %+v", revisions)
+	}
+
+	var revision AppRevision
+	json.Unmarshal(sendAs(t, router, user, "GET", fmt.Sprintf("/apps/%d/revisions/2", created.ID), nil, http.StatusOK).Body.Bytes(), &revision)
+	if revision.Version != "1.1.0" || revision.CreatedAt.IsZero() {
+		t.Errorf("handler returned unexpected revision: %+v", revision)
+	}
+	sendAs(t, router, user, "GET", fmt.Sprintf("/apps/%d/revisions/9", created.ID), nil, http.StatusNotFound)
+
+	var diff RevisionDiff
+	json.Unmarshal(sendAs(t, router, user, "GET", fmt.Sprintf("/apps/%d/revisions/3/diff", created.ID), nil, http.StatusOK).Body.Bytes(), &diff)
+	var fields []string
+	for _, change := range diff.Changes {
+		fields = append(fields, change.Field)
+	}
+	if diff.From != 2 || diff.To != 3 || fmt.Sprint(fields) != "[git_hash version output_schema]" || diff.Compatibility.Level != CompatBreaking {
+		t.Errorf("handler returned unexpected diff: %+v", diff)
+	}
+	json.Unmarshal(sendAs(t, router, user, "GET", fmt.Sprintf("/apps/%d/revisions/3/diff?against=1", created.ID), nil, http.StatusOK).Body.Bytes(), &diff)
+	if diff.From != 1 || len(diff.Changes) != 3 || diff.Changes[0].From != "aaa" {
+		t.Errorf("handler returned unexpected diff: %+v", diff)
+	}
+
+	var rolledBack App
+	json.Unmarshal(sendAs(t, router, user, "POST", fmt.Sprintf("/apps/%d/revisions/1/rollback", created.ID), nil, http.StatusOK).Body.Bytes(), &rolledBack)
+	if rolledBack.Revision != 4 || rolledBack.GitHash != "aaa" || rolledBack.Version != "1.0.0" {
+		t.Errorf("handler returned unexpected app: %+v", rolledBack)
+	}
+	current, err := scanApp(db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", created.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.GitHash != "aaa" || current.Revision != 4 || current.OutputSchema != `{"type":"object"}` {
+		t.Errorf("app was not rolled back: %+v", current)
+	}
+	json.Unmarshal(sendAs(t, router, user, "GET", fmt.Sprintf("/apps/%d/revisions/4", created.ID), nil, http.StatusOK).Body.Bytes(), &revision)
+	if revision.RollbackOf != 1 {
+		t.Errorf("rollback revision restored %d, want 1", revision.RollbackOf)
+	}
+
+	// A revision in a workspace that has since been deleted is rejected
+	if _, err := db.Exec("UPDATE app_revisions SET workspace_id = 9999 WHERE app_id = ? AND revision = 2", created.ID); err != nil {
+		t.Fatal(err)
+	}
+	sendAs(t, router, user, "POST", fmt.Sprintf("/apps/%d/revisions/2/rollback", created.ID), nil, http.StatusBadRequest)
+}
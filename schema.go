@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a JSON Schema embedded in an app as JSON, like json.RawMessage.
+// For clients written before schemas were embedded, a JSON string holding
+// the schema is accepted as well. Schemas are kept compacted, and an empty
+// Schema, encoded as null, accepts anything.
+type Schema string
+
+// normalize compacts a schema that is valid JSON and leaves anything else,
+// which checkSchema rejects, as it is.
+func (s Schema) normalize() Schema {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil {
+		return Schema(strings.TrimSpace(string(s)))
+	}
+	if buf.String() == "null" {
+		return ""
+	}
+	return Schema(buf.String())
+}
+
+func (s Schema) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return []byte("null"), nil
+	}
+	if !json.Valid([]byte(s)) {
+		// Stored before schemas were validated
+		return json.Marshal(string(s))
+	}
+	return []byte(s), nil
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err == nil {
+		*s = Schema(encoded).normalize()
+		return nil
+	}
+	*s = Schema(data).normalize()
+	return nil
+}
+
+func (s *Schema) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = ""
+	case string:
+		*s = Schema(v)
+	case []byte:
+		*s = Schema(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a schema", src)
+	}
+	return nil
+}
+
+func (s Schema) Value() (driver.Value, error) {
+	return string(s.normalize()), nil
+}
+
+// normalizeSchemas compacts the schemas of apps stored by earlier versions.
+func normalizeSchemas(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, COALESCE(input_schema, ''), COALESCE(output_schema, '') FROM apps")
+	if err != nil {
+		return err
+	}
+	type stored struct {
+		id            int
+		input, output Schema
+	}
+	var changed []stored
+	for rows.Next() {
+		var app stored
+		if err := rows.Scan(&app.id, &app.input, &app.output); err != nil {
+			rows.Close()
+			return err
+		}
+		if app.input.normalize() != app.input || app.output.normalize() != app.output {
+			changed = append(changed, app)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, app := range changed {
+		if _, err := db.Exec("UPDATE apps SET input_schema = ?, output_schema = ? WHERE id = ?", app.input, app.output, app.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidationError is one problem found in a schema or in a payload checked
+// against one. Path is a JSON Pointer to the offending value.
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationResult is the outcome of checking a payload against a schema.
+type ValidationResult struct {
+	Valid  bool              `json:"valid"`
+	Errors []ValidationError `json:"errors"`
+}
+
+// JSON Schema support covers the keywords apps use to describe their
+// payloads: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, uniqueItems, minLength, maxLength, pattern,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, allOf,
+// anyOf, oneOf and not. Schemas using other keywords that constrain values,
+// such as $ref or if/then/else, are rejected rather than letting through
+// payloads they were meant to stop. Annotations such as title and
+// description are allowed and ignored.
+
+var unsupportedKeywords = []string{
+	"$dynamicRef", "$recursiveRef", "$ref", "additionalItems", "contains",
+	"dependencies", "dependentRequired", "dependentSchemas", "else", "if",
+	"prefixItems", "propertyNames", "then", "unevaluatedItems", "unevaluatedProperties",
+}
+
+var schemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+func pointer(path, token string) string {
+	token = strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+	return path + "/" + token
+}
+
+// parseSchema decodes a schema stored on an app. An empty schema accepts
+// anything.
+func parseSchema(raw Schema) (interface{}, []ValidationError) {
+	if strings.TrimSpace(string(raw)) == "" {
+		return true, nil
+	}
+	var schema interface{}
+	if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+		return nil, []ValidationError{{Path: "", Message: "schema is not valid JSON: " + err.Error()}}
+	}
+	if errs := checkSchema(schema, ""); len(errs) > 0 {
+		return nil, errs
+	}
+	return schema, nil
+}
+
+// checkSchema reports the ways in which schema is not a valid JSON Schema.
+func checkSchema(schema interface{}, path string) []ValidationError {
+	var errs []ValidationError
+	fail := func(keyword, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: pointer(path, keyword), Message: fmt.Sprintf(format, args...)})
+	}
+
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		if _, ok := schema.(bool); ok {
+			return nil
+		}
+		return []ValidationError{{Path: path, Message: "schema must be an object or a boolean"}}
+	}
+
+	for _, keyword := range unsupportedKeywords {
+		if _, ok := s[keyword]; ok {
+			fail(keyword, "%s is not supported", keyword)
+		}
+	}
+
+	if t, ok := s["type"]; ok {
+		var types []interface{}
+		switch t := t.(type) {
+		case string:
+			types = []interface{}{t}
+		case []interface{}:
+			types = t
+		default:
+			fail("type", "type must be a string or an array of strings")
+		}
+		for _, t := range types {
+			if name, ok := t.(string); !ok || !schemaTypes[name] {
+				fail("type", "unknown type %v", t)
+			}
+		}
+	}
+
+	for _, keyword := range []string{"properties", "patternProperties"} {
+		if v, ok := s[keyword]; ok {
+			properties, ok := v.(map[string]interface{})
+			if !ok {
+				fail(keyword, "%s must be an object", keyword)
+				continue
+			}
+			for name, property := range properties {
+				if keyword == "patternProperties" {
+					if _, err := regexp.Compile(name); err != nil {
+						fail(keyword, "invalid pattern %q", name)
+					}
+				}
+				errs = append(errs, checkSchema(property, pointer(pointer(path, keyword), name))...)
+			}
+		}
+	}
+
+	for _, keyword := range []string{"additionalProperties", "items", "not"} {
+		if v, ok := s[keyword]; ok {
+			errs = append(errs, checkSchema(v, pointer(path, keyword))...)
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		if v, ok := s[keyword]; ok {
+			subschemas, ok := v.([]interface{})
+			if !ok || len(subschemas) == 0 {
+				fail(keyword, "%s must be a non-empty array of schemas", keyword)
+				continue
+			}
+			for i, subschema := range subschemas {
+				errs = append(errs, checkSchema(subschema, pointer(pointer(path, keyword), strconv.Itoa(i)))...)
+			}
+		}
+	}
+
+	if v, ok := s["required"]; ok {
+		required, ok := v.([]interface{})
+		if !ok {
+			fail("required", "required must be an array of strings")
+		}
+		for _, name := range required {
+			if _, ok := name.(string); !ok {
+				fail("required", "required must be an array of strings")
+				break
+			}
+		}
+	}
+
+	if v, ok := s["enum"]; ok {
+		if _, ok := v.([]interface{}); !ok {
+			fail("enum", "enum must be an array")
+		}
+	}
+
+	for _, keyword := range []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf"} {
+		if v, ok := s[keyword]; ok {
+			n, ok := v.(float64)
+			if !ok {
+				fail(keyword, "%s must be a number", keyword)
+			} else if keyword == "multipleOf" && n <= 0 {
+				fail(keyword, "multipleOf must be greater than 0")
+			}
+		}
+	}
+
+	for _, keyword := range []string{"minLength", "maxLength", "minItems", "maxItems", "minProperties", "maxProperties"} {
+		if v, ok := s[keyword]; ok {
+			if n, ok := v.(float64); !ok || n < 0 || n != math.Trunc(n) {
+				fail(keyword, "%s must be a non-negative integer", keyword)
+			}
+		}
+	}
+
+	if v, ok := s["uniqueItems"]; ok {
+		if _, ok := v.(bool); !ok {
+			fail("uniqueItems", "uniqueItems must be a boolean")
+		}
+	}
+
+	if v, ok := s["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			fail("pattern", "pattern must be a string")
+		} else if _, err := regexp.Compile(pattern); err != nil {
+			fail("pattern", "invalid pattern: %v", err)
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	return errs
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func hasType(value interface{}, want string) bool {
+	got := typeOf(value)
+	return got == want || (want == "number" && got == "integer")
+}
+
+// validateValue reports the ways in which value does not match a schema that
+// passed checkSchema.
+func validateValue(schema, value interface{}, path string) []ValidationError {
+	var errs []ValidationError
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if b, ok := schema.(bool); ok {
+		if !b {
+			fail("no value is allowed here")
+		}
+		return errs
+	}
+	s := schema.(map[string]interface{})
+
+	if t, ok := s["type"]; ok {
+		types, ok := t.([]interface{})
+		if !ok {
+			types = []interface{}{t}
+		}
+		matched := false
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = t.(string)
+			if hasType(value, names[i]) {
+				matched = true
+			}
+		}
+		if !matched {
+			fail("expected %s, got %s", strings.Join(names, " or "), typeOf(value))
+			// The remaining keywords assume the right type
+			return errs
+		}
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		fail("value must be %v", c)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		errs = append(errs, validateObject(s, v, path)...)
+	case []interface{}:
+		errs = append(errs, validateArray(s, v, path)...)
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := s["minLength"].(float64); ok && length < min {
+			fail("must be at least %v characters long", min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && length > max {
+			fail("must be at most %v characters long", max)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				fail("must match pattern %s", pattern)
+			}
+		}
+	case float64:
+		if min, ok := s["minimum"].(float64); ok && v < min {
+			fail("must be at least %v", min)
+		}
+		if max, ok := s["maximum"].(float64); ok && v > max {
+			fail("must be at most %v", max)
+		}
+		if min, ok := s["exclusiveMinimum"].(float64); ok && v <= min {
+			fail("must be greater than %v", min)
+		}
+		if max, ok := s["exclusiveMaximum"].(float64); ok && v >= max {
+			fail("must be less than %v", max)
+		}
+		if m, ok := s["multipleOf"].(float64); ok {
+			if !isMultipleOf(v, m) {
+				fail("must be a multiple of %v", m)
+			}
+		}
+	}
+
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, subschema := range all {
+			errs = append(errs, validateValue(subschema, value, path)...)
+		}
+	}
+	if any, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, subschema := range any {
+			if len(validateValue(subschema, value, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one schema in anyOf")
+		}
+	}
+	if one, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, subschema := range one {
+			if len(validateValue(subschema, value, path)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one schema in oneOf, matched %d", matched)
+		}
+	}
+	if not, ok := s["not"]; ok && len(validateValue(not, value, path)) == 0 {
+		fail("must not match the schema in not")
+	}
+
+	return errs
+}
+
+func validateObject(s, object map[string]interface{}, path string) []ValidationError {
+	var errs []ValidationError
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+	}
+	if min, ok := s["minProperties"].(float64); ok && float64(len(object)) < min {
+		fail("must have at least %v properties", min)
+	}
+	if max, ok := s["maxProperties"].(float64); ok && float64(len(object)) > max {
+		fail("must have at most %v properties", max)
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	patterns, _ := s["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := object[name]
+		matched := false
+		if property, ok := properties[name]; ok {
+			matched = true
+			errs = append(errs, validateValue(property, value, pointer(path, name))...)
+		}
+		for pattern, property := range patterns {
+			if re, err := regexp.Compile(pattern); err == nil && re.MatchString(name) {
+				matched = true
+				errs = append(errs, validateValue(property, value, pointer(path, name))...)
+			}
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				errs = append(errs, ValidationError{Path: pointer(path, name), Message: "additional property is not allowed"})
+			} else {
+				errs = append(errs, validateValue(additional, value, pointer(path, name))...)
+			}
+		}
+	}
+	return errs
+}
+
+func validateArray(s map[string]interface{}, array []interface{}, path string) []ValidationError {
+	var errs []ValidationError
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if min, ok := s["minItems"].(float64); ok && float64(len(array)) < min {
+		fail("must have at least %v items", min)
+	}
+	if max, ok := s["maxItems"].(float64); ok && float64(len(array)) > max {
+		fail("must have at most %v items", max)
+	}
+	if unique, ok := s["uniqueItems"].(bool); ok && unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if reflect.DeepEqual(array[i], array[j]) {
+					fail("items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+	if items, ok := s["items"]; ok {
+		for i, item := range array {
+			errs = append(errs, validateValue(items, item, pointer(path, strconv.Itoa(i)))...)
+		}
+	}
+	return errs
+}
+
+// validatePayload checks a raw JSON payload against a schema stored on an app.
+func validatePayload(rawSchema Schema, payload []byte) (ValidationResult, error) {
+	schema, errs := parseSchema(rawSchema)
+	if len(errs) > 0 {
+		return ValidationResult{}, fmt.Errorf("app has an invalid schema: %s", errs[0].Message)
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return ValidationResult{Errors: []ValidationError{{Path: "", Message: "payload is not valid JSON: " + err.Error()}}}, nil
+	}
+	errs = validateValue(schema, value, "")
+	if errs == nil {
+		errs = []ValidationError{}
+	}
+	return ValidationResult{Valid: len(errs) == 0, Errors: errs}, nil
+}
+
+// isMultipleOf reports whether v is a whole multiple of m, comparing the
+// decimals they were written as, since 0.3 / 0.1 is not exactly 3 in floating
+// point.
+func isMultipleOf(v, m float64) bool {
+	value, valueOK := new(big.Rat).SetString(strconv.FormatFloat(v, 'g', -1, 64))
+	divisor, divisorOK := new(big.Rat).SetString(strconv.FormatFloat(m, 'g', -1, 64))
+	if !valueOK || !divisorOK || divisor.Sign() == 0 {
+		return false
+	}
+	return new(big.Rat).Quo(value, divisor).IsInt()
+}
+
+// writeSchemaErrors rejects a schema or a payload, listing where it failed.
+func writeSchemaErrors(w http.ResponseWriter, status int, message string, errs []ValidationError) {
+	writeAPIError(w, &APIError{Status: status, Code: codeOf(status), Message: message, Errors: errs})
+}
+
+// checkAppSchemas reports the problems with an app's input and output
+// schemas, with paths prefixed by the field they were found in.
+func checkAppSchemas(app App) []ValidationError {
+	var errs []ValidationError
+	for _, field := range []struct {
+		name   string
+		schema Schema
+	}{{"input_schema", app.InputSchema}, {"output_schema", app.OutputSchema}} {
+		_, fieldErrs := parseSchema(field.schema)
+		for _, e := range fieldErrs {
+			e.Path = "/" + field.name + e.Path
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["name", "count"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "pattern": "^[a-z]+$"},
+		"count": {"type": "integer", "minimum": 1, "maximum": 10},
+		"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "uniqueItems": true},
+		"mode": {"oneOf": [{"const": "fast"}, {"const": "slow"}]}
+	}
+}`
+
+func TestSchemaJSON(t *testing.T) {
+	for _, tc := range []struct {
+		body, schema, encoded string
+	}{
+		{`{"input_schema": {"type": "object", "required": ["id"]}}`, `{"type":"object","required":["id"]}`, `{"type":"object","required":["id"]}`},
+		{`{"input_schema": "{\"type\": \"string\"}"}`, `{"type":"string"}`, `{"type":"string"}`},
+		{`{"input_schema": true}`, `true`, `true`},
+		{`{"input_schema": null}`, ``, `null`},
+		{`{"input_schema": ""}`, ``, `null`},
+		{`{}`, ``, `null`},
+		{`{"input_schema": "legacy text"}`, `legacy text`, `"legacy text"`},
+	} {
+		var app App
+		if err := json.Unmarshal([]byte(tc.body), &app); err != nil {
+			t.Fatalf("decoding %s: %v", tc.body, err)
+		}
+		if string(app.InputSchema) != tc.schema {
+			t.Errorf("decoding %s gave schema %q, want %q", tc.body, app.InputSchema, tc.schema)
+		}
+		encoded, err := json.Marshal(app.InputSchema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != tc.encoded {
+			t.Errorf("encoding schema %q gave %s, want %s", app.InputSchema, encoded, tc.encoded)
+		}
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	for _, tc := range []struct {
+		schema string
+		paths  []string
+	}{
+		{"", nil},
+		{testSchema, nil},
+		{"true", nil},
+		{"not json", []string{""}},
+		{`"string"`, []string{""}},
+		{`{"type":"text"}`, []string{"/type"}},
+		{`{"properties":{"a":{"minLength":-1}}}`, []string{"/properties/a/minLength"}},
+		{`{"items":{"pattern":"("}}`, []string{"/items/pattern"}},
+		{`{"anyOf":[]}`, []string{"/anyOf"}},
+		{`{"$defs":{"id":{"type":"integer"}},"properties":{"id":{"$ref":"#/$defs/id"}}}`, []string{"/properties/id/$ref"}},
+		{`{"oneOf":[{"if":{"type":"string"},"then":{"minLength":1}}]}`, []string{"/oneOf/0/if", "/oneOf/0/then"}},
+		{`{"type":"array","contains":{"const":1}}`, []string{"/contains"}},
+		{`{"required":"name","multipleOf":0}`, []string{"/multipleOf", "/required"}},
+	} {
+		_, errs := parseSchema(Schema(tc.schema))
+		var paths []string
+		for _, e := range errs {
+			paths = append(paths, e.Path)
+		}
+		if fmt.Sprint(paths) != fmt.Sprint(tc.paths) {
+			t.Errorf("parseSchema(%q) reported errors at %v, want %v: %v", tc.schema, paths, tc.paths, errs)
+		}
+	}
+}
+
+func TestValidatePayload(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		paths   []string
+	}{
+		{`{"name":"abc","count":3}`, nil},
+		{`{"name":"abc","count":3,"tags":["a","b"],"mode":"fast"}`, nil},
+		{`{"name":"abc"}`, []string{""}},
+		{`{"name":"ABC","count":3.5}`, []string{"/count", "/name"}},
+		{`{"name":"abc","count":11,"extra":true}`, []string{"/count", "/extra"}},
+		{`{"name":"abc","count":1,"tags":["a","c","a"],"mode":"medium"}`, []string{"/mode", "/tags", "/tags/1"}},
+		{`[]`, []string{""}},
+		{`{`, []string{""}},
+	} {
+		result, err := validatePayload(testSchema, []byte(tc.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, e := range result.Errors {
+			paths = append(paths, e.Path)
+		}
+		if result.Valid != (tc.paths == nil) || fmt.Sprint(paths) != fmt.Sprint(tc.paths) {
+			t.Errorf("validatePayload(%s) = %v with errors at %v, want errors at %v: %v", tc.payload, result.Valid, paths, tc.paths, result.Errors)
+		}
+	}
+}
+
+func TestMultipleOfDecimals(t *testing.T) {
+	for _, tc := range []struct {
+		schema  string
+		payload string
+		valid   bool
+	}{
+		{`{"multipleOf":0.1}`, `0.3`, true},
+		{`{"multipleOf":0.01}`, `19.99`, true},
+		{`{"multipleOf":0.1}`, `0.35`, false},
+		{`{"multipleOf":3}`, `9`, true},
+		{`{"multipleOf":3}`, `10`, false},
+	} {
+		result, err := validatePayload(Schema(tc.schema), []byte(tc.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Valid != tc.valid {
+			t.Errorf("%s against %s: valid = %v, want %v", tc.payload, tc.schema, result.Valid, tc.valid)
+		}
+	}
+}
+
+func TestCreateAppRejectsInvalidSchema(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "schema1")
+
+	requestBody := []byte(fmt.Sprintf(`{"name":"testapp","ip_port":"10.0.0.1:8080","workspace_id":%d,"input_schema":"{\"type\":\"text\"}"}`, workspaceID))
+	req, err := http.NewRequest("POST", "/apps", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = asUser(req, user)
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", createApp).Methods("POST")
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	var response APIError
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Path != "/input_schema/type" {
+		t.Errorf("handler returned unexpected errors: %v", response.Errors)
+	}
+}
+
+func TestInvokeApp(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, user, "schema2")
+
+	var invoked string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		invoked = r.Method + " " + r.URL.Path + " " + string(body)
+		if strings.Contains(string(body), "huge") {
+			w.Write(bytes.Repeat([]byte(" "), maxReplayBody+1))
+			return
+		}
+		if strings.Contains(string(body), "bad") {
+			io.WriteString(w, `{"total":"many"}`)
+			return
+		}
+		io.WriteString(w, `{"total":3}`)
+	}))
+	defer backend.Close()
+
+	result, err := db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id, input_schema, output_schema) VALUES ('counter', ?, '/count', '1.0.0', ?, ?, ?)",
+		strings.TrimPrefix(backend.URL, "http://"), workspaceID, testSchema, `{"type":"object","properties":{"total":{"type":"integer"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appID, _ := result.LastInsertId()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps/{id:[0-9]+}/validate", validateAppPayload).Methods("POST")
+	router.HandleFunc("/apps/{id:[0-9]+}/invoke", invokeApp).Methods("POST")
+
+	for _, tc := range []struct {
+		path, body string
+		want       int
+		response   string
+	}{
+		{"validate", `{"name":"abc","count":3}`, http.StatusOK, `{"valid":true,"errors":[]}`},
+		{"validate", `{"name":"abc"}`, http.StatusOK, `{"valid":false,"errors":[{"path":"","message":"missing required property \"count\""}]}`},
+		{"validate?schema=output", `{"total":1.5}`, http.StatusOK, `{"valid":false,"errors":[{"path":"/total","message":"expected integer, got number"}]}`},
+		{"validate?schema=other", `{}`, http.StatusBadRequest, ""},
+		{"invoke", `{"name":"abc","count":3}`, http.StatusOK, `{"total":3}`},
+		{"invoke", `{"name":"abc","count":0}`, http.StatusUnprocessableEntity, ""},
+		{"invoke", `{"name":"huge","count":3}`, http.StatusBadGateway, ""},
+		{"invoke", `{"name":"bad","count":3}`, http.StatusOK, `{"total":"many"}`},
+		{"invoke?validate_output=true", `{"name":"bad","count":3}`, http.StatusBadGateway, ""},
+	} {
+		req, err := http.NewRequest("POST", fmt.Sprintf("/apps/%d/%s", appID, tc.path), bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = asUser(req, user)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tc.want {
+			t.Errorf("%s %s: handler returned wrong status code: got %v want %v", tc.path, tc.body, status, tc.want)
+		}
+		if tc.response != "" && strings.TrimSpace(rr.Body.String()) != tc.response {
+			t.Errorf("%s %s: handler returned %s, want %s", tc.path, tc.body, rr.Body.String(), tc.response)
+		}
+	}
+	if invoked != `POST /count {"name":"bad","count":3}` {
+		t.Errorf("app was invoked with %q", invoked)
+	}
+
+	// A schema stored before it was validated is the server's fault
+	result, err = db.Exec("INSERT INTO apps (name, ip_port, endpoint, version, workspace_id, input_schema) VALUES ('broken', ?, '/count', '1.0.0', ?, ?)",
+		strings.TrimPrefix(backend.URL, "http://"), workspaceID, `{"type":"banana"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokenID, _ := result.LastInsertId()
+	for _, path := range []string{"validate", "invoke"} {
+		sendAs(t, router, user, "POST", fmt.Sprintf("/apps/%d/%s", brokenID, path), `{}`, http.StatusInternalServerError)
+	}
+}
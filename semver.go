@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version as defined by https://semver.org. A leading
+// "v" is accepted and ignored.
+type Version struct {
+	Major, Minor, Patch uint64
+	Prerelease          []string
+	Build               string
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+func validIdentifier(id string, allowLeadingZero bool) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return false
+		}
+	}
+	if !allowLeadingZero && len(id) > 1 && id[0] == '0' && isNumeric(id) {
+		return false
+	}
+	return true
+}
+
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func parseNumber(s string) (uint64, error) {
+	if !isNumeric(s) || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid version number %q", s)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// ParseVersion parses a full MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] version.
+func ParseVersion(s string) (Version, error) {
+	v, parts, err := parsePartialVersion(s)
+	if err != nil {
+		return v, err
+	}
+	if parts != 3 {
+		return v, fmt.Errorf("invalid semantic version %q", s)
+	}
+	return v, nil
+}
+
+// parsePartialVersion parses a version that may leave out trailing numbers or
+// use x/X/* wildcards for them, as in constraints like "1.2" or "1.x". It
+// returns how many numbers were given.
+func parsePartialVersion(s string) (Version, int, error) {
+	var v Version
+	invalid := fmt.Errorf("invalid semantic version %q", s)
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if s == "" {
+		return v, 0, invalid
+	}
+
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		v.Build = s[i+1:]
+		s = s[:i]
+		for _, id := range strings.Split(v.Build, ".") {
+			if !validIdentifier(id, true) {
+				return v, 0, invalid
+			}
+		}
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.Prerelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, id := range v.Prerelease {
+			if !validIdentifier(id, false) {
+				return v, 0, invalid
+			}
+			// Numeric identifiers are compared as numbers, so they must fit one
+			if isNumeric(id) {
+				if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+					return v, 0, invalid
+				}
+			}
+		}
+	}
+
+	numbers := strings.Split(s, ".")
+	if len(numbers) > 3 {
+		return v, 0, invalid
+	}
+	fields := []*uint64{&v.Major, &v.Minor, &v.Patch}
+	parts := 0
+	for i, n := range numbers {
+		if n == "x" || n == "X" || n == "*" {
+			// Everything after a wildcard is a wildcard too
+			break
+		}
+		value, err := parseNumber(n)
+		if err != nil {
+			return v, 0, invalid
+		}
+		*fields[i] = value
+		parts++
+	}
+	if parts < 3 && (len(v.Prerelease) > 0 || v.Build != "") {
+		return v, 0, invalid
+	}
+	return v, parts, nil
+}
+
+// normalizeAppVersion checks that an app's version, if it has one, is a
+// semantic version and writes it in canonical form.
+func normalizeAppVersion(app *App) error {
+	if strings.TrimSpace(app.Version) == "" {
+		app.Version = ""
+		return nil
+	}
+	v, err := ParseVersion(app.Version)
+	if err != nil {
+		return err
+	}
+	app.Version = v.String()
+	return nil
+}
+
+func compareIdentifiers(a, b string) int {
+	aNum, bNum := isNumeric(a), isNumeric(b)
+	switch {
+	case aNum && bNum:
+		x, _ := strconv.ParseUint(a, 10, 64)
+		y, _ := strconv.ParseUint(b, 10, 64)
+		return compareUint(x, y)
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Compare returns -1, 0 or 1 depending on the precedence of v and o. Build
+// metadata does not affect precedence.
+func (v Version) Compare(o Version) int {
+	if c := compareUint(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+
+	// A pre-release has lower precedence than the release itself
+	switch {
+	case len(v.Prerelease) == 0 && len(o.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(o.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		if c := compareIdentifiers(v.Prerelease[i], o.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.Prerelease)), uint64(len(o.Prerelease)))
+}
+
+func (v Version) sameCore(o Version) bool {
+	return v.Major == o.Major && v.Minor == o.Minor && v.Patch == o.Patch
+}
+
+// comparator is a single bound such as ">=1.2.0".
+type comparator struct {
+	op      string
+	version Version
+}
+
+func (c comparator) matches(v Version) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Constraint is a version range in the syntax used by npm and Composer:
+// comparators separated by spaces (or commas) must all match, and
+// alternatives are separated by "||". Supported forms are =, !=, >, >=, <,
+// <=, ^ (compatible with), ~ (patch-level changes), partial versions and
+// x/* wildcards, e.g. "^1.2", "~1.2.3", ">=2.0.0 <3.0.0" or "1.x || >=3".
+//
+// Pre-releases only satisfy a constraint that names a pre-release of the same
+// MAJOR.MINOR.PATCH, so "^1.2" never selects 1.3.0-beta.
+type Constraint struct {
+	alternatives [][]comparator
+}
+
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	for _, alternative := range strings.Split(s, "||") {
+		var comparators []comparator
+		fields := strings.Fields(strings.ReplaceAll(alternative, ",", " "))
+		// Join operators written apart from their version, as in ">= 1.2"
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			if strings.Trim(field, "<>=!^~") == "" && i+1 < len(fields) {
+				field += fields[i+1]
+				i++
+			}
+			expanded, err := parseComparator(field)
+			if err != nil {
+				return c, err
+			}
+			comparators = append(comparators, expanded...)
+		}
+		c.alternatives = append(c.alternatives, comparators)
+	}
+	return c, nil
+}
+
+// parseComparator expands one comparator into plain bounds.
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			s = s[len(prefix):]
+			break
+		}
+	}
+	v, parts, err := parsePartialVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	if parts == 0 {
+		// A bare wildcard matches everything
+		switch op {
+		case "", "=", ">=", "^", "~":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("invalid constraint %q", op+s)
+	}
+	// The first version past the range given by the specified numbers
+	next := func(level int) Version {
+		switch level {
+		case 0:
+			return Version{Major: v.Major + 1}
+		case 1:
+			return Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	lower := Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch, Prerelease: v.Prerelease}
+
+	switch op {
+	case "^":
+		// Changes that do not modify the left-most non-zero number
+		level := 0
+		switch {
+		case v.Major == 0 && v.Minor == 0 && parts >= 3:
+			level = 2
+		case v.Major == 0 && parts >= 2:
+			level = 1
+		}
+		return []comparator{{">=", lower}, {"<", next(level)}}, nil
+	case "~":
+		level := 1
+		if parts == 1 {
+			level = 0
+		}
+		return []comparator{{">=", lower}, {"<", next(level)}}, nil
+	case "", "=":
+		if parts == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", lower}, {"<", next(parts - 1)}}, nil
+	case ">":
+		if parts == 3 {
+			return []comparator{{">", v}}, nil
+		}
+		return []comparator{{">=", next(parts - 1)}}, nil
+	case "<=":
+		if parts == 3 {
+			return []comparator{{"<=", v}}, nil
+		}
+		return []comparator{{"<", next(parts - 1)}}, nil
+	case "!=":
+		if parts != 3 {
+			return nil, fmt.Errorf("invalid constraint %q", op+s)
+		}
+		return []comparator{{"!=", v}}, nil
+	}
+	// >= and < with missing numbers treat them as zero
+	return []comparator{{op, lower}}, nil
+}
+
+// Check reports whether v satisfies the constraint.
+func (c Constraint) Check(v Version) bool {
+	for _, comparators := range c.alternatives {
+		matched := true
+		prereleaseAllowed := len(v.Prerelease) == 0
+		for _, comp := range comparators {
+			if !comp.matches(v) {
+				matched = false
+				break
+			}
+			if len(comp.version.Prerelease) > 0 && comp.version.sameCore(v) {
+				prereleaseAllowed = true
+			}
+		}
+		if matched && prereleaseAllowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, valid := range []string{"1.0.0", "v2.3.4", "0.0.1-alpha", "1.0.0-alpha.1", "1.0.0-0.3.7", "1.0.0+20130313144700", "1.0.0-beta+exp.sha.5114f85"} {
+		if _, err := ParseVersion(valid); err != nil {
+			t.Errorf("ParseVersion(%q) failed: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"", "1", "1.0", "1.0.0.0", "01.0.0", "1.0.0-", "1.0.0-01", "1.0.0+", "a.b.c", "1.0.0-beta..1", "1.0.0-123456789012345678901"} {
+		if _, err := ParseVersion(invalid); err == nil {
+			t.Errorf("ParseVersion(%q) was accepted", invalid)
+		}
+	}
+}
+
+func TestVersionOrdering(t *testing.T) {
+	// Precedence example from the semver specification
+	want := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.10.0", "2.0.0"}
+	got := make([]string, 0, len(want))
+	for i := len(want) - 1; i >= 0; i-- {
+		got = append(got, want[i])
+	}
+	sort.Slice(got, func(i, j int) bool {
+		a, _ := ParseVersion(got[i])
+		b, _ := ParseVersion(got[j])
+		return a.Compare(b) < 0
+	})
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected ordering: got %v want %v", got, want)
+		}
+	}
+
+	a, _ := ParseVersion("1.0.0+build.1")
+	b, _ := ParseVersion("1.0.0+build.2")
+	if a.Compare(b) != 0 {
+		t.Errorf("build metadata affected precedence")
+	}
+}
+
+func TestConstraintCheck(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"^1.2", "1.2.0", true},
+		{"^1.2", "1.9.3", true},
+		{"^1.2", "2.0.0", false},
+		{"^1.2", "1.1.9", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1", "1.9.0", true},
+		{"1.2", "1.2.7", true},
+		{"1.x", "1.5.0", true},
+		{"1.x", "2.0.0", false},
+		{"*", "3.1.4", true},
+		{">=2.0.0 <3.0.0", "2.5.0", true},
+		{">=2.0.0 <3.0.0", "3.0.0", false},
+		{">= 2.0.0, < 3.0.0", "2.0.0", true},
+		{">1.2", "1.2.9", false},
+		{">1.2", "1.3.0", true},
+		{"<=1.2", "1.2.9", true},
+		{"!=1.2.3", "1.2.3", false},
+		{"1.x || >=3", "3.2.0", true},
+		{"1.x || >=3", "2.2.0", false},
+		// Pre-releases need to be asked for explicitly
+		{"^1.2", "1.3.0-beta", false},
+		{"<2.0.0", "2.0.0-rc.1", false},
+		{"^1.3.0-beta", "1.3.0-beta.2", true},
+		{"^1.3.0-beta", "1.3.1-beta", false},
+		{"=1.0.0+abc", "1.0.0", true},
+	} {
+		c, err := ParseConstraint(tc.constraint)
+		if err != nil {
+			t.Fatalf("ParseConstraint(%q) failed: %v", tc.constraint, err)
+		}
+		v, err := ParseVersion(tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Check(v); got != tc.want {
+			t.Errorf("%q satisfies %q: got %v want %v", tc.version, tc.constraint, got, tc.want)
+		}
+	}
+
+	for _, invalid := range []string{"^", ">=abc", "1.2.3.4", "!=1.2", "<*"} {
+		if _, err := ParseConstraint(invalid); err == nil {
+			t.Errorf("ParseConstraint(%q) was accepted", invalid)
+		}
+	}
+}
+
+func TestSemverKey(t *testing.T) {
+	versions := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha-x", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0+build.1", "1.0.1", "1.10.0", "2.0.0", "10.0.0"}
+	for _, a := range versions {
+		for _, b := range versions {
+			va, _ := ParseVersion(a)
+			vb, _ := ParseVersion(b)
+			ka, kb := semverKey(a).(string), semverKey(b).(string)
+			if want, got := va.Compare(vb), strings.Compare(ka, kb); want != got {
+				t.Errorf("keys of %s and %s compare as %d, want %d", a, b, got, want)
+			}
+		}
+	}
+	if key := semverKey("1.0"); key != nil {
+		t.Errorf("semverKey of an invalid version = %v, want nil", key)
+	}
+	if key := semverKey(nil); key != nil {
+		t.Errorf("semverKey of NULL = %v, want nil", key)
+	}
+}
+
+func TestGetAppsVersionQuery(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "semver1")
+	otherID := createTestWorkspace(t, owner, "semver2")
+	for _, app := range []struct {
+		name, version string
+		workspaceID   int
+	}{
+		{"billing", "1.9.0", workspaceID},
+		{"billing", "2.0.0", workspaceID},
+		{"billing", "2.10.0", workspaceID},
+		{"billing", "2.9.1", workspaceID},
+		{"billing", "3.0.0-beta.1", workspaceID},
+		{"billing", "2.11.0", otherID},
+		{"search", "2.0.0+build.5", workspaceID},
+		{"legacy", "", workspaceID},
+	} {
+		if _, err := db.Exec("INSERT INTO apps (name, ip_port, version, workspace_id) VALUES (?, '10.0.0.1:80', ?, ?)", app.name, app.version, app.workspaceID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", getApps).Methods("GET")
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"billing 3.0.0-beta.1", "billing 2.11.0", "billing 2.10.0", "billing 2.9.1", "billing 2.0.0", "billing 1.9.0", "legacy ", "search 2.0.0+build.5"}},
+		{"?name=billing&version=>=2.0.0 <3.0.0", []string{"billing 2.11.0", "billing 2.10.0", "billing 2.9.1", "billing 2.0.0"}},
+		{fmt.Sprintf("?name=billing&version=2.x&latest=true&workspace_id=%d", workspaceID), []string{"billing 2.10.0"}},
+		{"?latest=true", []string{"billing 3.0.0-beta.1", "billing 2.11.0", "legacy ", "search 2.0.0+build.5"}},
+		{"?version=^2", []string{"billing 2.11.0", "billing 2.10.0", "billing 2.9.1", "billing 2.0.0", "search 2.0.0+build.5"}},
+	} {
+		req, err := http.NewRequest("GET", "/apps"+strings.ReplaceAll(strings.ReplaceAll(tc.query, " ", "%20"), "+", "%2B"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, asUser(req, owner))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tc.query, status, http.StatusOK)
+		}
+
+		var apps []App
+		if err := json.Unmarshal(rr.Body.Bytes(), &apps); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, app := range apps {
+			got = append(got, app.Name+" "+app.Version)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: handler returned %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// A pre-release number too long for uint64 is rejected on create, and
+	// one stored before that does not break sorting by version
+	router.HandleFunc("/apps", createApp).Methods("POST")
+	sendAs(t, router, owner, "POST", "/apps", App{Name: "overflow", IPPort: "10.0.0.1:80", Version: "1.0.0-123456789012345678901", WorkspaceID: workspaceID}, http.StatusBadRequest)
+	createTestApp(t, workspaceID, "overflow", "1.0.0-123456789012345678901", "10.0.0.1:80")
+	rr := sendAs(t, router, owner, "GET", "/apps?name=overflow", nil, http.StatusOK)
+	var apps []App
+	if err := json.Unmarshal(rr.Body.Bytes(), &apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].Version != "1.0.0-123456789012345678901" {
+		t.Errorf("handler returned %v, want the stored overflow app", apps)
+	}
+
+	req, _ := http.NewRequest("GET", "/apps?version=banana", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, asUser(req, owner))
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
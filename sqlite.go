@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is SQLite with the functions queries on versions need:
+//
+//	semver_key(version)              a string that sorts in semver precedence
+//	                                 order, or NULL if version is not semver
+//	semver_match(version, range)     whether version satisfies a Constraint
+const sqliteDriver = "sqlite3_discover"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("semver_key", semverKey, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("semver_match", semverMatch, true)
+		},
+	})
+}
+
+// semverKey encodes a version so that comparing keys as strings compares the
+// versions by precedence. Build metadata is left out, as it does not affect
+// precedence.
+func semverKey(version interface{}) interface{} {
+	v, err := parseStoredVersion(version)
+	if err != nil {
+		return nil
+	}
+	key := fmt.Sprintf("%020d.%020d.%020d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) == 0 {
+		// A release sorts after its pre-releases
+		return key + "~"
+	}
+	// Numeric identifiers sort before alphanumeric ones, and the separator
+	// sorts before any identifier character so shorter lists come first
+	ids := make([]string, len(v.Prerelease))
+	for i, id := range v.Prerelease {
+		if isNumeric(id) {
+			ids[i] = "0" + strings.Repeat("0", 20-len(id)) + id
+		} else {
+			ids[i] = "1" + id
+		}
+	}
+	return key + "-" + strings.Join(ids, " ")
+}
+
+// parseStoredVersion parses a version column, which may be NULL.
+func parseStoredVersion(version interface{}) (Version, error) {
+	switch v := version.(type) {
+	case string:
+		return ParseVersion(v)
+	case []byte:
+		return ParseVersion(string(v))
+	}
+	return Version{}, fmt.Errorf("invalid semantic version %v", version)
+}
+
+// constraints caches parsed constraints, as semver_match is called once per
+// row with the same constraint.
+var constraints sync.Map
+
+func semverMatch(version interface{}, constraint string) (bool, error) {
+	c, ok := constraints.Load(constraint)
+	if !ok {
+		parsed, err := ParseConstraint(constraint)
+		if err != nil {
+			return false, err
+		}
+		c, _ = constraints.LoadOrStore(constraint, parsed)
+	}
+	v, err := parseStoredVersion(version)
+	if err != nil {
+		return false, nil
+	}
+	return c.(Constraint).Check(v), nil
+}
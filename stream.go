@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamKeepAlive is how often an idle stream is pinged so proxies keep it open.
+const streamKeepAlive = 15 * time.Second
+
+var upgrader = websocket.Upgrader{
+	// Streams are authenticated by token rather than by cookie, so any origin
+	// may connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// eventFilter decides which events a stream passes on: only events in
+// workspaces its user can see, narrowed down by the ?workspace_id and ?type
+// query parameters. Both take comma-separated lists; a type is either a full
+// event type such as app.registered or an entity such as app.
+type eventFilter struct {
+	user       User
+	workspaces map[int]bool
+	types      []string
+	visible    map[int]bool
+}
+
+func newEventFilter(r *http.Request, user User) (*eventFilter, error) {
+	f := &eventFilter{user: user}
+	query := r.URL.Query()
+	if v := query.Get("workspace_id"); v != "" {
+		f.workspaces = make(map[int]bool)
+		for _, s := range strings.Split(v, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid workspace_id %q", s)
+			}
+			f.workspaces[id] = true
+		}
+	}
+	if v := query.Get("type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			f.types = append(f.types, strings.TrimSpace(t))
+		}
+	}
+	return f, f.refresh()
+}
+
+// refresh reloads the workspaces the user can see. A workspace that has been
+// deleted stays visible until its workspace.deleted event comes through, so
+// the events of a cascade published before it still reach the stream.
+func (f *eventFilter) refresh() error {
+	visible, args := visibleWorkspaces(f.user)
+	rows, err := db.Query(visible, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	previous := f.visible
+	f.visible = make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		f.visible[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id := range previous {
+		if f.visible[id] {
+			continue
+		}
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM workspaces WHERE id = ?)", id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			f.visible[id] = true
+		}
+	}
+	return nil
+}
+
+func (f *eventFilter) matches(event Event) bool {
+	// Events that can change who sees a workspace are shown to anyone who
+	// could see it before or after
+	seen := f.visible[event.WorkspaceID]
+	switch {
+	case event.Type == EventWorkspaceCreated, event.Type == EventWorkspaceUpdated, strings.HasPrefix(event.Type, "role."):
+		f.refresh()
+	case event.Type == EventWorkspaceDeleted:
+		delete(f.visible, event.WorkspaceID)
+	}
+	if !seen && !f.visible[event.WorkspaceID] {
+		return false
+	}
+
+	if f.workspaces != nil && !f.workspaces[event.WorkspaceID] {
+		return false
+	}
+	if f.types == nil {
+		return true
+	}
+	for _, t := range f.types {
+		if event.Type == t || strings.HasPrefix(event.Type, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// queryToken lets clients that cannot set headers, such as browsers opening
+// an EventSource or a WebSocket, pass their access token as ?access_token.
+func queryToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamEvents sends registry events as Server-Sent Events, using the event
+// type as the SSE event name and the registry index as its ID.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	filter, err := newEventFilter(r, user)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-feed:
+			if !filter.matches(event) {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Index, event.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamEventsWS sends registry events over a WebSocket, one JSON message per
+// event.
+func streamEventsWS(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	filter, err := newEventFilter(r, user)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		return
+	}
+	defer conn.Close()
+
+	// Clients do not send anything, but reading is how a close is noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-feed:
+			if !filter.matches(event) {
+				continue
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepAlive)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
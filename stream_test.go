@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestEventFilter(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	stranger := createTestUser(t, "stranger@example.com", "secret")
+	mine := createTestWorkspace(t, owner, "stream1")
+	other := createTestWorkspace(t, owner, "stream2")
+	theirs := createTestWorkspace(t, stranger, "stream3")
+
+	for _, tc := range []struct {
+		query string
+		event Event
+		want  bool
+	}{
+		{"", Event{Type: EventAppRegistered, WorkspaceID: mine}, true},
+		{"", Event{Type: EventAppRegistered, WorkspaceID: theirs}, false},
+		{"type=app", Event{Type: EventAppDeregistered, WorkspaceID: mine}, true},
+		{"type=app", Event{Type: EventRoleGranted, WorkspaceID: mine}, false},
+		{"type=role.granted,ip", Event{Type: EventIPReleased, WorkspaceID: mine}, true},
+		{"type=role.granted,ip", Event{Type: EventRoleRevoked, WorkspaceID: mine}, false},
+		{"workspace_id=" + strconv.Itoa(other), Event{Type: EventAppRegistered, WorkspaceID: mine}, false},
+		{"workspace_id=" + strconv.Itoa(other), Event{Type: EventAppRegistered, WorkspaceID: other}, true},
+	} {
+		req, _ := http.NewRequest("GET", "/events/stream?"+tc.query, nil)
+		filter, err := newEventFilter(req, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filter.matches(tc.event); got != tc.want {
+			t.Errorf("%q: filter matched %s in workspace %d: got %v want %v", tc.query, tc.event.Type, tc.event.WorkspaceID, got, tc.want)
+		}
+	}
+
+	// Being granted a role makes the workspace visible from then on
+	req, _ := http.NewRequest("GET", "/events/stream", nil)
+	filter, err := newEventFilter(req, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", owner.ID, RoleMember, theirs)
+	if !filter.matches(Event{Type: EventRoleGranted, WorkspaceID: theirs}) {
+		t.Errorf("filter did not pass the role grant that made the workspace visible")
+	}
+	if !filter.matches(Event{Type: EventAppRegistered, WorkspaceID: theirs}) {
+		t.Errorf("filter did not pass events of a newly visible workspace")
+	}
+
+	if _, err := newEventFilter(httptest.NewRequest("GET", "/events/stream?workspace_id=abc", nil), owner); err == nil {
+		t.Errorf("filter accepted an invalid workspace_id")
+	}
+}
+
+func newStreamServer() *httptest.Server {
+	router := mux.NewRouter()
+	stream := router.PathPrefix("/events").Subrouter()
+	stream.Use(queryToken, authMiddleware)
+	stream.HandleFunc("/stream", streamEvents).Methods("GET")
+	stream.HandleFunc("/ws", streamEventsWS).Methods("GET")
+	return httptest.NewServer(router)
+}
+
+func TestStreamEvents(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	stranger := createTestUser(t, "stranger@example.com", "secret")
+	mine := createTestWorkspace(t, owner, "stream1")
+	theirs := createTestWorkspace(t, stranger, "stream2")
+	tokens, err := issueTokens(owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newStreamServer()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events/stream?type=app", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("handler returned %v with content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events.publish(Event{Type: EventAppRegistered, WorkspaceID: theirs})
+	events.publish(Event{Type: EventRoleGranted, WorkspaceID: mine})
+	events.publish(Event{Type: EventAppRegistered, WorkspaceID: mine})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < 3 {
+		select {
+		case line := <-lines:
+			if line != "" {
+				got = append(got, line)
+			}
+		case <-timeout:
+			t.Fatalf("stream did not send an event, got %v", got)
+		}
+	}
+	if !strings.HasPrefix(got[0], "id: ") || got[1] != "event: "+EventAppRegistered || !strings.HasPrefix(got[2], "data: ") {
+		t.Fatalf("stream sent an unexpected event: %v", got)
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(got[2], "data: ")), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.WorkspaceID != mine {
+		t.Errorf("stream sent an event of workspace %d, want %d", event.WorkspaceID, mine)
+	}
+
+	// Without a token the stream is refused
+	resp, err = http.Get(server.URL + "/events/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestStreamEventsWS(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	stranger := createTestUser(t, "stranger@example.com", "secret")
+	mine := createTestWorkspace(t, owner, "stream1")
+	theirs := createTestWorkspace(t, stranger, "stream2")
+	tokens, err := issueTokens(owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newStreamServer()
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/events/ws?access_token=" + tokens.AccessToken
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	events.publish(Event{Type: EventWorkspaceDeleted, WorkspaceID: theirs})
+	events.publish(Event{Type: EventIPReleased, WorkspaceID: mine, Data: ipEvent{"10.0.0.9"}})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event Event
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventIPReleased || event.WorkspaceID != mine || event.Index == 0 {
+		t.Errorf("stream sent an unexpected event: %+v", event)
+	}
+}
+
+func TestStreamEventsOwnerDeleted(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	member := createTestUser(t, "member@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "stream1")
+	createTestApp(t, workspaceID, "billing", "1.0.0", "10.0.0.1:80")
+	if _, err := db.Exec("INSERT INTO workspace_roles (user_id, role, workspace_id) VALUES (?, ?, ?)", member.ID, RoleMember, workspaceID); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := issueTokens(member.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newStreamServer()
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The member loses access to the workspace with the first event of the
+	// cascade, but still sees the rest of it
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id:[0-9]+}", deleteUser).Methods("DELETE")
+	sendAs(t, router, owner, "DELETE", "/users/"+strconv.Itoa(owner.ID), nil, http.StatusNoContent)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) == 0 || got[len(got)-1] != EventWorkspaceDeleted {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, "event: ") {
+				got = append(got, strings.TrimPrefix(line, "event: "))
+			}
+		case <-timeout:
+			t.Fatalf("stream did not send workspace.deleted, got %v", got)
+		}
+	}
+	want := []string{EventRoleRevoked, EventAppDeregistered, EventWorkspaceDeleted}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("stream sent %v, want %v", got, want)
+	}
+}
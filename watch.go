@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchWait = 5 * time.Minute
+	maxWatchWait     = 10 * time.Minute
+)
+
+// registry tracks the registry index, which grows by one on every change and
+// is persisted so that it keeps growing across restarts. Watchers wait on
+// changed, which is closed and replaced whenever the index moves.
+var registry = struct {
+	sync.Mutex
+	index   uint64
+	changed chan struct{}
+}{changed: make(chan struct{})}
+
+// loadRegistryIndex restores the registry index from the database.
+func loadRegistryIndex() error {
+	registry.Lock()
+	defer registry.Unlock()
+	return db.QueryRow("SELECT value FROM meta WHERE key = 'registry_index'").Scan(&registry.index)
+}
+
+// bumpRegistryIndex records a change and wakes up every watcher.
+func bumpRegistryIndex() uint64 {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.index++
+	if _, err := db.Exec("UPDATE meta SET value = ? WHERE key = 'registry_index'", registry.index); err != nil {
+		// Watchers still see the change, the index just restarts lower
+		log.Printf("Persisting registry index failed: %v", err)
+	}
+	close(registry.changed)
+	registry.changed = make(chan struct{})
+	return registry.index
+}
+
+func currentRegistryIndex() (uint64, chan struct{}) {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.index, registry.changed
+}
+
+// blockingQuery lets a GET handler be used as a watch: with ?index=N it only
+// answers once the registry index is past N, or once ?wait (default 5m, at
+// most 10m) has elapsed. The response carries the current index in
+// X-Discover-Index, to be passed as ?index on the next call.
+func blockingQuery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if v := query.Get("index"); v != "" {
+			index, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "index must be a non-negative integer")
+				return
+			}
+			wait := defaultWatchWait
+			if v := query.Get("wait"); v != "" {
+				wait, err = time.ParseDuration(v)
+				if err != nil || wait < 0 {
+					writeError(w, http.StatusBadRequest, "wait must be a duration such as 30s")
+					return
+				}
+			}
+			if wait > maxWatchWait {
+				wait = maxWatchWait
+			}
+
+			timeout := time.NewTimer(wait)
+			defer timeout.Stop()
+		watch:
+			for {
+				current, changed := currentRegistryIndex()
+				if current > index {
+					break
+				}
+				select {
+				case <-changed:
+				case <-timeout.C:
+					break watch
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+
+		current, _ := currentRegistryIndex()
+		w.Header().Set("X-Discover-Index", strconv.FormatUint(current, 10))
+		next(w, r)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRegistryIndexPersists(t *testing.T) {
+	index := bumpRegistryIndex()
+
+	registry.Lock()
+	registry.index = 0
+	registry.Unlock()
+
+	if err := loadRegistryIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := currentRegistryIndex(); current != index {
+		t.Errorf("loaded registry index %d, want %d", current, index)
+	}
+}
+
+func TestBlockingQuery(t *testing.T) {
+	clearDatabase()
+	owner := createTestUser(t, "owner@example.com", "secret")
+	workspaceID := createTestWorkspace(t, owner, "watch1")
+	bumpRegistryIndex()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/apps", blockingQuery(getApps)).Methods("GET")
+
+	get := func(query string) (*httptest.ResponseRecorder, time.Duration) {
+		req, err := http.NewRequest("GET", "/apps"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		router.ServeHTTP(rr, asUser(req, owner))
+		return rr, time.Since(start)
+	}
+
+	rr, _ := get("")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	index := rr.Header().Get("X-Discover-Index")
+	if index == "" {
+		t.Fatal("handler did not return the registry index")
+	}
+
+	// Nothing changes, so the query waits out its timeout
+	rr, elapsed := get("?index=" + index + "&wait=50ms")
+	if elapsed < 50*time.Millisecond || rr.Header().Get("X-Discover-Index") != index {
+		t.Errorf("blocking query returned after %v with index %s, want a timeout at index %s", elapsed, rr.Header().Get("X-Discover-Index"), index)
+	}
+
+	// An older index is answered right away
+	previous, _ := strconv.ParseUint(index, 10, 64)
+	if _, elapsed := get("?index=" + strconv.FormatUint(previous-1, 10) + "&wait=5s"); elapsed > time.Second {
+		t.Errorf("blocking query with a stale index waited %v", elapsed)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		db.Exec("INSERT INTO apps (name, ip_port, workspace_id) VALUES ('billing', '10.0.0.1:8000', ?)", workspaceID)
+		events.publish(Event{Type: EventAppRegistered, WorkspaceID: workspaceID})
+	}()
+	rr, elapsed = get("?index=" + index + "&wait=5s")
+	if elapsed > 4*time.Second {
+		t.Errorf("blocking query did not return when the registry changed")
+	}
+	if got := rr.Header().Get("X-Discover-Index"); got == index {
+		t.Errorf("blocking query returned the old index %s", got)
+	}
+	if body := rr.Body.String(); len(body) < 10 {
+		t.Errorf("blocking query did not return the new app: %s", body)
+	}
+
+	for _, query := range []string{"?index=-1", "?index=1&wait=soon"} {
+		if rr, _ := get(query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPublishOrder(t *testing.T) {
+	feed := events.subscribe()
+	defer events.unsubscribe(feed)
+
+	// Concurrent publishers still deliver events in index order
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				events.publish(Event{Type: EventAppUpdated})
+			}
+		}()
+	}
+	wg.Wait()
+
+	var last uint64
+	for len(feed) > 0 {
+		event := <-feed
+		if event.Index <= last {
+			t.Fatalf("event with index %d arrived after %d", event.Index, last)
+		}
+		last = event.Index
+	}
+}
+
+func TestUserAndPoolChangesBumpIndex(t *testing.T) {
+	clearDatabase()
+	user := createTestUser(t, "owner@example.com", "secret")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{id:[0-9]+}", updateUser).Methods("PUT")
+	router.HandleFunc("/ip-pools", createIPPool).Methods("POST")
+
+	for _, change := range []struct {
+		method, path string
+		body         interface{}
+		want         int
+	}{
+		{"PUT", "/users/" + strconv.Itoa(user.ID), map[string]string{"username": "renamed@example.com"}, http.StatusOK},
+		{"POST", "/ip-pools", IPPool{Name: "watched", CIDR: "10.20.0.0/24"}, http.StatusCreated},
+	} {
+		before, _ := currentRegistryIndex()
+		sendAs(t, router, user, change.method, change.path, change.body, change.want)
+		if after, _ := currentRegistryIndex(); after <= before {
+			t.Errorf("%s %s left the registry index at %d", change.method, change.path, after)
+		}
+	}
+}